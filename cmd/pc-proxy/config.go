@@ -143,6 +143,10 @@ func LoadConfigFile(confFile string, onChange func(conf *config.Config)) error {
 }
 
 func loadConfig() error {
+	// decode the listeners into a new list (the existing list is reused otherwise, keeping removed listeners when the
+	// list gets shorter)
+	config.GetConfig().Listen.Listeners = nil
+
 	err := k.Unmarshal("", config.GetConfig())
 
 	return err
@@ -8,8 +8,11 @@ import (
 	"testing"
 	"time"
 
+	bypassStore "github.com/cthayer/pc-proxy/internal/bypass"
 	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/credential"
 	"github.com/cthayer/pc-proxy/internal/proxy"
+	"github.com/cthayer/pc-proxy/internal/rule"
 )
 
 func TestLoadConfigFile(t *testing.T) {
@@ -80,6 +83,90 @@ func TestLoadConfigFile(t *testing.T) {
 		if ty != "host" {
 			t.Errorf("expected %v, got %v", "host", ty)
 		}
+
+		if conf.RateLimit.RequestsPerSecond != 0 {
+			t.Errorf("expected RateLimit.RequestsPerSecond to be 0, got %v", conf.RateLimit.RequestsPerSecond)
+		}
+
+		if len(conf.ClientGroups) != 1 {
+			t.Fatalf("expected 1 client group, got %v", len(conf.ClientGroups))
+		}
+
+		if conf.ClientGroups[0].Name != "kids" {
+			t.Errorf("expected %v, got %v", "kids", conf.ClientGroups[0].Name)
+		}
+
+		if len(conf.ClientGroups[0].Clients) != 1 || conf.ClientGroups[0].Clients[0] != "192.168.1.100/30" {
+			t.Errorf("expected %v, got %v", []string{"192.168.1.100/30"}, conf.ClientGroups[0].Clients)
+		}
+
+		if conf.ClientGroups[0].RequestsPerSecond != 10 {
+			t.Errorf("expected %v, got %v", 10, conf.ClientGroups[0].RequestsPerSecond)
+		}
+
+		if conf.ClientGroups[0].MaxConnections != 50 {
+			t.Errorf("expected %v, got %v", 50, conf.ClientGroups[0].MaxConnections)
+		}
+
+		if len(conf.Credentials) != 2 {
+			t.Fatalf("expected 2 credentials, got %v", len(conf.Credentials))
+		}
+
+		if conf.Credentials[0].Name != "parent" {
+			t.Errorf("expected %v, got %v", "parent", conf.Credentials[0].Name)
+		}
+
+		if _, err := credential.New(conf.Credentials[0].Name, conf.Credentials[0].Hash, conf.Credentials[0].Tags, conf.Credentials[0].MaxDuration); err != nil {
+			t.Errorf("expected a valid credential hash, got %v", err)
+		}
+
+		if _, err := credential.NewTOTP(conf.Credentials[1].Name, conf.Credentials[1].TotpSecrets, conf.Credentials[1].Tags, conf.Credentials[1].MaxDuration); err != nil {
+			t.Errorf("expected a valid totp credential, got %v", err)
+		}
+
+		if conf.Bypass.Duration != time.Hour*20 {
+			t.Errorf("expected %v, got %v", time.Hour*20, conf.Bypass.Duration)
+		}
+
+		if conf.Bypass.Scope != "rule" {
+			t.Errorf("expected %v, got %v", "rule", conf.Bypass.Scope)
+		}
+
+		if conf.Bypass.Scheme != "basic" {
+			t.Errorf("expected %v, got %v", "basic", conf.Bypass.Scheme)
+		}
+
+		if conf.Bypass.MaxFailures != 5 {
+			t.Errorf("expected %v, got %v", 5, conf.Bypass.MaxFailures)
+		}
+
+		if conf.Bypass.MaxLockoutDuration != time.Hour {
+			t.Errorf("expected %v, got %v", time.Hour, conf.Bypass.MaxLockoutDuration)
+		}
+
+		if conf.AccessRequests.Enabled || conf.AccessRequests.MaxPending != 5 {
+			t.Errorf("expected access requests to be disabled with 5 max pending, got %v", conf.AccessRequests)
+		}
+
+		if conf.Pac.Enabled || len(conf.Pac.DirectHosts) != 4 || conf.Pac.DirectHosts[3] != "192.168.0.0/16" {
+			t.Errorf("expected the PAC file to be disabled with 4 direct hosts, got %v", conf.Pac)
+		}
+
+		if len(conf.Listen.Listeners) != 2 || conf.Listen.Listeners[0].Address != "[::]:3128" || conf.Listen.Listeners[1].Protocol != "http" {
+			t.Errorf("expected 2 http listeners, got %v", conf.Listen.Listeners)
+		}
+
+		if conf.Upstream.Enabled || conf.Upstream.Route != "upstream" || len(conf.Upstream.DirectHosts) != 1 || conf.Upstream.DirectHosts[0] != "\\.lan$" {
+			t.Errorf("expected the upstream proxy to be disabled with 1 direct host, got %v", conf.Upstream)
+		}
+
+		if conf.Intercept.Enabled || len(conf.Intercept.DoNotIntercept) != 2 || conf.Intercept.DoNotIntercept[1] != "\\.icloud\\.com$" {
+			t.Errorf("expected interception to be disabled with 2 do not intercept hosts, got %v", conf.Intercept)
+		}
+
+		if conf.Dns.Enabled || conf.Dns.Port != 53 || conf.Dns.Upstream != "1.1.1.1:53" {
+			t.Errorf("expected the DNS server to be disabled with upstream 1.1.1.1:53, got %v", conf.Dns)
+		}
 	}
 }
 
@@ -192,9 +279,13 @@ func TestLoadConfigFileWithProxy(t *testing.T) {
 		target := "https://" + patternReplaceRegex.ReplaceAllString(r.Pattern, "") + "/foo/bar"
 
 		req := httptest.NewRequest("GET", target, nil)
-		bypassCache := map[string]map[string]time.Duration{}
+		bypass := rule.Bypass{
+			Credentials: credential.NewSet(credential.NewPlaintext("test", "test")),
+			Store:       bypassStore.NewMemoryStore(),
+			Duration:    time.Minute,
+		}
 
-		match, allowed := r.Match(req, httptest.NewRecorder(), "test", &bypassCache, time.Minute)
+		match, allowed := r.Match(req, httptest.NewRecorder(), bypass)
 
 		if !match {
 			t.Errorf("expected r %v to match %v", r.Pattern, target)
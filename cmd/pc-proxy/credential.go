@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cthayer/pc-proxy/internal/credential"
+)
+
+var cliHashPasswordCmd = cobra.Command{
+	Use:     "hash-password",
+	Short:   "Create a bcrypt hash of a bypass password for use in the `credentials` configuration",
+	Long:    "Create a bcrypt hash of a bypass password for use in the `credentials` configuration.  The password is read from the first line of stdin",
+	Example: "  echo 'secret' | pc-proxy hash-password",
+	Args:    cobra.ExactArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return hashPassword()
+	},
+}
+
+func init() {
+	cliRootCmd.AddCommand(&cliHashPasswordCmd)
+}
+
+func hashPassword() error {
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	if err != nil && password == "" {
+		return errors.New("error reading password from stdin: " + err.Error())
+	}
+
+	password = strings.TrimRight(password, "\r\n")
+
+	if password == "" {
+		return errors.New("password must not be empty")
+	}
+
+	hash, err := credential.Hash(password)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(hash)
+
+	return nil
+}
@@ -7,7 +7,9 @@ import (
 	"os/signal"
 	"strconv"
 	"syscall"
+	"time"
 
+	"github.com/cthayer/pc-proxy/internal/activation"
 	"github.com/cthayer/pc-proxy/internal/logger"
 	"github.com/cthayer/pc-proxy/internal/proxy"
 )
@@ -56,6 +58,15 @@ func runProxy() {
 		}
 	}
 
+	// use the sockets passed by systemd socket activation, or by the process this one replaced during an upgrade
+	sockets, err := activation.Inherited()
+
+	if err != nil {
+		log.Error("Error reading the passed sockets", zap.Error(err))
+	}
+
+	pxy.UseSockets(sockets)
+
 	// start the proxy
 	startErr := pxy.Start()
 
@@ -65,16 +76,32 @@ func runProxy() {
 		return
 	}
 
+	if err := upgradeReady(); err != nil {
+		log.Error("Error telling the old process the upgrade is running", zap.Error(err))
+	}
+
+	if err := activation.Notify("READY=1"); err != nil {
+		log.Warn("Error notifying systemd", zap.Error(err))
+	}
+
 	// setup OS signal handler
-	done := setupSignalHandler()
+	done := setupSignalHandler(pxy)
 
-	// wait until signaled to exit (SIGINT or SIGTERM)
-	<-done
+	// wait until signaled to exit (SIGINT or SIGTERM), or a new process took over (SIGUSR2)
+	upgraded := <-done
 
-	log.Info("Shutting down")
+	var stopErrs []error
 
-	// stop the server
-	stopErrs := pxy.Stop()
+	if upgraded {
+		log.Info("Upgraded, draining connections")
+
+		stopErrs = pxy.Drain(time.Second * UPGRADE_DRAIN_TIMEOUT)
+	} else {
+		log.Info("Shutting down")
+
+		// stop the server
+		stopErrs = pxy.Stop()
+	}
 
 	if len(stopErrs) > 0 {
 		log.Error("Proxy failed to stop", zap.Any("errors", stopErrs))
@@ -85,7 +112,9 @@ func runProxy() {
 	log.Info("Shutdown complete")
 }
 
-func setupSignalHandler() chan bool {
+// setupSignalHandler returns a channel that receives when the proxy should exit: true after an upgrade (the old process
+// drains its connections), false when stopped
+func setupSignalHandler(pxy *proxy.Proxy) chan bool {
 	log := logger.GetLogger()
 
 	sigs := make(chan os.Signal, 1)
@@ -95,6 +124,10 @@ func setupSignalHandler() chan bool {
 	// the config file for changes
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
+	if upgradeSignal != nil {
+		signal.Notify(sigs, upgradeSignal)
+	}
+
 	go func() {
 		defer close(done)
 
@@ -105,7 +138,21 @@ func setupSignalHandler() chan bool {
 
 			switch sig {
 			case syscall.SIGINT, syscall.SIGTERM:
+				done <- false
+				return
+			case upgradeSignal:
+				log.Info("Upgrading")
+
+				if err := upgrade(pxy); err != nil {
+					log.Error("Upgrade failed, still running", zap.Error(err))
+					continue
+				}
+
+				// exit right away when signaled while draining
+				signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+
 				done <- true
+				return
 			}
 		}
 	}()
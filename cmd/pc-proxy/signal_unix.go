@@ -0,0 +1,11 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// the signal that starts a graceful upgrade
+var upgradeSignal os.Signal = syscall.SIGUSR2
@@ -0,0 +1,10 @@
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// graceful upgrades aren't supported on windows (sockets can't be passed to the new process)
+var upgradeSignal os.Signal = nil
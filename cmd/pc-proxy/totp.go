@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cthayer/pc-proxy/internal/credential"
+)
+
+var totpIssuer string
+
+var cliTotpSecretCmd = cobra.Command{
+	Use:     "totp-secret <name>",
+	Short:   "Generate a TOTP secret for use in the `credentials` configuration",
+	Long:    "Generate a TOTP secret for use in the `totpSecrets` of a credential, and print the otpauth:// URI used to enroll it in an authenticator app",
+	Example: "  pc-proxy totp-secret babysitter",
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return totpSecret(args[0])
+	},
+}
+
+func init() {
+	cliTotpSecretCmd.Flags().StringVarP(&totpIssuer, "issuer", "", credential.DEFAULT_TOTP_ISSUER, "the issuer shown in the authenticator app")
+
+	cliRootCmd.AddCommand(&cliTotpSecretCmd)
+}
+
+func totpSecret(name string) error {
+	secret, err := credential.GenerateTOTPSecret()
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("secret: " + secret)
+	fmt.Println("uri:    " + credential.TOTPURI(secret, name, totpIssuer))
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/cthayer/pc-proxy/internal/activation"
+	"github.com/cthayer/pc-proxy/internal/logger"
+	"github.com/cthayer/pc-proxy/internal/proxy"
+)
+
+const (
+	// the file descriptor the new process writes to when it is running, during an upgrade
+	UPGRADE_READY_FD_ENV_NAME = "UPGRADE_READY_FD"
+
+	// how long the old process waits for open connections (CONNECT tunnels) to close after an upgrade
+	UPGRADE_DRAIN_TIMEOUT = 600
+)
+
+// upgrade starts a new process from the executable (a new build when it was replaced), passing it the listening
+// sockets.  Returns once the new process is running, the old process then drains its connections and exits
+func upgrade(pxy *proxy.Proxy) error {
+	files, names, err := pxy.Files()
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	// the new process loads the bypass grants when it starts (grants not saved yet would be lost)
+	if err := pxy.SaveState(); err != nil {
+		return errors.New("error saving the bypass state: " + err.Error())
+	}
+
+	exe, err := os.Executable()
+
+	if err != nil {
+		return errors.New("error finding the executable: " + err.Error())
+	}
+
+	ready, readyWriter, err := os.Pipe()
+
+	if err != nil {
+		return err
+	}
+
+	defer ready.Close()
+
+	// the sockets are the files after stdin, stdout and stderr, followed by the ready pipe
+	env := append(activation.Env(os.Environ(), names), UPGRADE_READY_FD_ENV_NAME+"="+strconv.Itoa(activation.LISTEN_FDS_START+len(files)))
+	procFiles := append(append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...), readyWriter)
+
+	proc, err := os.StartProcess(exe, os.Args, &os.ProcAttr{Env: env, Files: procFiles})
+
+	readyWriter.Close()
+
+	if err != nil {
+		return errors.New("error starting the new process: " + err.Error())
+	}
+
+	// wait for the new process to start its listeners (the pipe is closed when it exits)
+	_ = ready.SetReadDeadline(time.Now().Add(time.Second * PROXY_START_TIMEOUT))
+
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		_ = proc.Kill()
+		_, _ = proc.Wait()
+
+		return errors.New("the new process didn't start: " + err.Error())
+	}
+
+	// the new process is the service's main process now
+	if err := activation.Notify("MAINPID=" + strconv.Itoa(proc.Pid)); err != nil {
+		logger.GetLogger().Warn("error notifying systemd of the new main process", zap.Error(err))
+	}
+
+	return proc.Release()
+}
+
+// upgradeReady tells the process that started this one during an upgrade that the proxy is running
+func upgradeReady() error {
+	fd := os.Getenv(UPGRADE_READY_FD_ENV_NAME)
+
+	_ = os.Unsetenv(UPGRADE_READY_FD_ENV_NAME)
+
+	if fd == "" {
+		return nil
+	}
+
+	n, err := strconv.Atoi(fd)
+
+	if err != nil {
+		return errors.New("invalid " + UPGRADE_READY_FD_ENV_NAME + ": " + fd)
+	}
+
+	f := os.NewFile(uintptr(n), "upgrade-ready")
+
+	defer f.Close()
+
+	_, err = f.Write([]byte{1})
+
+	return err
+}
@@ -0,0 +1,200 @@
+package access
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	STATUS_PENDING  Status = "pending"
+	STATUS_APPROVED Status = "approved"
+	STATUS_DENIED   Status = "denied"
+
+	// decided requests are kept this long so clients can check their status
+	DECIDED_REQUEST_TTL = time.Hour * 24
+)
+
+var (
+	ErrNotFound       = errors.New("access request not found")
+	ErrAlreadyDecided = errors.New("access request has already been decided")
+	ErrTooManyPending = errors.New("too many pending access requests")
+)
+
+type Status string
+
+// Request is a client asking a parent for access to a blocked URL
+type Request struct {
+	ID        string
+	Client    string
+	URL       string
+	Rule      string // pattern of the rule blocking the URL
+	Reason    string
+	Status    Status
+	Created   time.Time
+	Decided   time.Time
+	DecidedBy string
+	Duration  time.Duration // how long access was approved for
+}
+
+// Queue holds access requests.  It is safe for concurrent use
+type Queue struct {
+	mu         sync.Mutex
+	requests   map[string]*Request
+	maxPending int
+	now        func() time.Time
+}
+
+// NewQueue creates a queue that allows each client to have at most `maxPending` pending requests (0 is unlimited)
+func NewQueue(maxPending int) *Queue {
+	return newQueue(maxPending, time.Now)
+}
+
+func newQueue(maxPending int, now func() time.Time) *Queue {
+	return &Queue{
+		requests:   map[string]*Request{},
+		maxPending: maxPending,
+		now:        now,
+	}
+}
+
+func (q *Queue) SetMaxPending(maxPending int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.maxPending = maxPending
+}
+
+// Create adds a pending request.  A pending request from the same client for the same URL is returned instead of creating a duplicate
+func (q *Queue) Create(client string, url string, rule string, reason string) (Request, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pending := 0
+
+	for _, r := range q.requests {
+		if r.Client != client || r.Status != STATUS_PENDING {
+			continue
+		}
+
+		if r.URL == url {
+			return *r, nil
+		}
+
+		pending++
+	}
+
+	if q.maxPending > 0 && pending >= q.maxPending {
+		return Request{}, ErrTooManyPending
+	}
+
+	id, err := newId()
+
+	if err != nil {
+		return Request{}, err
+	}
+
+	r := &Request{
+		ID:      id,
+		Client:  client,
+		URL:     url,
+		Rule:    rule,
+		Reason:  reason,
+		Status:  STATUS_PENDING,
+		Created: q.now(),
+	}
+
+	q.requests[id] = r
+
+	return *r, nil
+}
+
+func (q *Queue) Get(id string) (Request, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r, ok := q.requests[id]
+
+	if !ok {
+		return Request{}, false
+	}
+
+	return *r, true
+}
+
+// Pending returns the pending requests, oldest first
+func (q *Queue) Pending() []Request {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var pending []Request
+
+	for _, r := range q.requests {
+		if r.Status == STATUS_PENDING {
+			pending = append(pending, *r)
+		}
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Created.Before(pending[j].Created)
+	})
+
+	return pending
+}
+
+func (q *Queue) Approve(id string, duration time.Duration, by string) (Request, error) {
+	return q.decide(id, STATUS_APPROVED, duration, by)
+}
+
+func (q *Queue) Deny(id string, by string) (Request, error) {
+	return q.decide(id, STATUS_DENIED, 0, by)
+}
+
+// Prune removes requests that were decided more than DECIDED_REQUEST_TTL ago
+func (q *Queue) Prune() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+
+	for id, r := range q.requests {
+		if r.Status != STATUS_PENDING && now.Sub(r.Decided) > DECIDED_REQUEST_TTL {
+			delete(q.requests, id)
+		}
+	}
+}
+
+func (q *Queue) decide(id string, status Status, duration time.Duration, by string) (Request, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r, ok := q.requests[id]
+
+	if !ok {
+		return Request{}, ErrNotFound
+	}
+
+	if r.Status != STATUS_PENDING {
+		return *r, ErrAlreadyDecided
+	}
+
+	r.Status = status
+	r.Decided = q.now()
+	r.DecidedBy = by
+	r.Duration = duration
+
+	return *r, nil
+}
+
+func newId() (string, error) {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
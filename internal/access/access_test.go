@@ -0,0 +1,107 @@
+package access
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestQueue_Create(t *testing.T) {
+	q := NewQueue(2)
+
+	a, err := q.Create("10.0.0.1", "http://youtube.com", "youtube\\.com", "homework video")
+
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	if a.ID == "" || a.Status != STATUS_PENDING {
+		t.Errorf("expected a pending request with an id, got %v", a)
+	}
+
+	if dup, _ := q.Create("10.0.0.1", "http://youtube.com", "youtube\\.com", ""); dup.ID != a.ID {
+		t.Error("expected a duplicate request to return the pending request")
+	}
+
+	if _, err := q.Create("10.0.0.1", "http://games.com", "games\\.com", ""); err != nil {
+		t.Errorf("Create() error = %v", err)
+	}
+
+	if _, err := q.Create("10.0.0.1", "http://social.com", "social\\.com", ""); err != ErrTooManyPending {
+		t.Errorf("expected %v, got %v", ErrTooManyPending, err)
+	}
+
+	if _, err := q.Create("10.0.0.2", "http://social.com", "social\\.com", ""); err != nil {
+		t.Errorf("expected other clients to have their own limit, got %v", err)
+	}
+
+	if pending := q.Pending(); len(pending) != 3 || pending[0].ID != a.ID {
+		t.Errorf("expected 3 pending requests (oldest first), got %v", pending)
+	}
+}
+
+func TestQueue_Approve_Deny(t *testing.T) {
+	q := NewQueue(0)
+
+	a, _ := q.Create("10.0.0.1", "http://youtube.com", "youtube\\.com", "")
+	b, _ := q.Create("10.0.0.1", "http://games.com", "games\\.com", "")
+
+	approved, err := q.Approve(a.ID, time.Hour, "parent")
+
+	if err != nil {
+		t.Fatalf("Approve() error = %v", err)
+	}
+
+	if approved.Status != STATUS_APPROVED || approved.Duration != time.Hour || approved.DecidedBy != "parent" {
+		t.Errorf("expected an approved request, got %v", approved)
+	}
+
+	if _, err := q.Deny(a.ID, "parent"); err != ErrAlreadyDecided {
+		t.Errorf("expected %v, got %v", ErrAlreadyDecided, err)
+	}
+
+	if denied, err := q.Deny(b.ID, "parent"); err != nil || denied.Status != STATUS_DENIED {
+		t.Errorf("expected a denied request, got %v (%v)", denied, err)
+	}
+
+	if _, err := q.Approve("missing", time.Hour, "parent"); err != ErrNotFound {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+
+	if pending := q.Pending(); len(pending) != 0 {
+		t.Errorf("expected no pending requests, got %v", pending)
+	}
+
+	if r, ok := q.Get(a.ID); !ok || r.Status != STATUS_APPROVED {
+		t.Errorf("expected decided requests to be kept, got %v", r)
+	}
+}
+
+func TestQueue_Prune(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	q := newQueue(0, clock.now)
+
+	a, _ := q.Create("10.0.0.1", "http://youtube.com", "youtube\\.com", "")
+	b, _ := q.Create("10.0.0.1", "http://games.com", "games\\.com", "")
+
+	_, _ = q.Deny(a.ID, "parent")
+
+	clock.t = clock.t.Add(DECIDED_REQUEST_TTL + time.Second)
+
+	q.Prune()
+
+	if _, ok := q.Get(a.ID); ok {
+		t.Error("expected old decided requests to be removed")
+	}
+
+	if _, ok := q.Get(b.ID); !ok {
+		t.Error("expected pending requests to be kept")
+	}
+}
@@ -0,0 +1,200 @@
+package activation
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// the first file descriptor passed to the process (SD_LISTEN_FDS_START)
+	LISTEN_FDS_START = 3
+
+	ENV_LISTEN_PID     = "LISTEN_PID"
+	ENV_LISTEN_FDS     = "LISTEN_FDS"
+	ENV_LISTEN_FDNAMES = "LISTEN_FDNAMES"
+	ENV_NOTIFY_SOCKET  = "NOTIFY_SOCKET"
+)
+
+// Socket is a listening socket passed to the process
+type Socket struct {
+	Name       string
+	Listener   net.Listener   // stream sockets
+	PacketConn net.PacketConn // datagram sockets
+}
+
+func (s *Socket) Addr() net.Addr {
+	if s.Listener != nil {
+		return s.Listener.Addr()
+	}
+
+	return s.PacketConn.LocalAddr()
+}
+
+// Close closes the socket
+func (s *Socket) Close() error {
+	if s.Listener != nil {
+		return s.Listener.Close()
+	}
+
+	return s.PacketConn.Close()
+}
+
+// Sockets are the sockets passed to the process that haven't been used yet.  A nil set has no sockets
+type Sockets struct {
+	lock    sync.Mutex
+	sockets []*Socket
+}
+
+func NewSockets(sockets []*Socket) *Sockets {
+	return &Sockets{sockets: sockets}
+}
+
+// Listener takes the stream socket listening on the address ("host:port"), returning nil when there isn't one
+func (s *Sockets) Listener(address string) net.Listener {
+	if sock := s.take(address, true); sock != nil {
+		return sock.Listener
+	}
+
+	return nil
+}
+
+// PacketConn takes the datagram socket bound to the address ("host:port"), returning nil when there isn't one
+func (s *Sockets) PacketConn(address string) net.PacketConn {
+	if sock := s.take(address, false); sock != nil {
+		return sock.PacketConn
+	}
+
+	return nil
+}
+
+// Remaining returns the sockets that haven't been used
+func (s *Sockets) Remaining() []*Socket {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]*Socket{}, s.sockets...)
+}
+
+func (s *Sockets) take(address string, stream bool) *Socket {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, sock := range s.sockets {
+		if (sock.Listener != nil) != stream || !SameAddress(sock.Addr(), address) {
+			continue
+		}
+
+		s.sockets = append(s.sockets[:i], s.sockets[i+1:]...)
+
+		return sock
+	}
+
+	return nil
+}
+
+// SameAddress returns true when the socket address is the address ("host:port").  An empty or unspecified host
+// matches every unspecified address ("0.0.0.0" and "::")
+func SameAddress(addr net.Addr, address string) bool {
+	var ip net.IP
+	var port int
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	default:
+		return false
+	}
+
+	want, err := net.ResolveTCPAddr("tcp", address)
+
+	if err != nil || want.Port != port {
+		return false
+	}
+
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return ip == nil || ip.IsUnspecified()
+	}
+
+	return want.IP.Equal(ip)
+}
+
+// Env returns the environment of a child process the sockets are passed to (as the files after stdin, stdout and
+// stderr), in the same variables systemd uses.  `LISTEN_PID` is left out, it isn't known until the process is started
+func Env(env []string, names []string) []string {
+	var childEnv []string
+
+	for _, v := range env {
+		if strings.HasPrefix(v, ENV_LISTEN_PID+"=") || strings.HasPrefix(v, ENV_LISTEN_FDS+"=") || strings.HasPrefix(v, ENV_LISTEN_FDNAMES+"=") {
+			continue
+		}
+
+		childEnv = append(childEnv, v)
+	}
+
+	return append(childEnv, ENV_LISTEN_FDS+"="+strconv.Itoa(len(names)), ENV_LISTEN_FDNAMES+"="+strings.Join(names, ":"))
+}
+
+// Notify sends a state change ("READY=1", "MAINPID=<pid>") to systemd.  Does nothing when the service manager didn't
+// ask for notifications
+func Notify(state string) error {
+	addr := os.Getenv(ENV_NOTIFY_SOCKET)
+
+	if addr == "" {
+		return nil
+	}
+
+	// abstract socket
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.Dial("unixgram", addr)
+
+	if err != nil {
+		return errors.New("error connecting to the notify socket: " + err.Error())
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+
+	return err
+}
+
+// listenEnv reads the sockets passed to the process from the environment, and unsets the variables so child processes
+// don't see them.  The sockets are passed to this process when `LISTEN_PID` is this process, or isn't set (an upgrade)
+func listenEnv() (int, []string, error) {
+	pid := os.Getenv(ENV_LISTEN_PID)
+	fds := os.Getenv(ENV_LISTEN_FDS)
+	names := os.Getenv(ENV_LISTEN_FDNAMES)
+
+	_ = os.Unsetenv(ENV_LISTEN_PID)
+	_ = os.Unsetenv(ENV_LISTEN_FDS)
+	_ = os.Unsetenv(ENV_LISTEN_FDNAMES)
+
+	if fds == "" || (pid != "" && pid != strconv.Itoa(os.Getpid())) {
+		return 0, nil, nil
+	}
+
+	n, err := strconv.Atoi(fds)
+
+	if err != nil || n < 0 {
+		return 0, nil, errors.New("invalid " + ENV_LISTEN_FDS + ": " + fds)
+	}
+
+	return n, strings.Split(names, ":"), nil
+}
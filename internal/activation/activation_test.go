@@ -0,0 +1,134 @@
+package activation
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSameAddress(t *testing.T) {
+	tests := []struct {
+		addr    net.Addr
+		address string
+		want    bool
+	}{
+		{addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 80}, address: "127.0.0.1:80", want: true},
+		{addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 80}, address: "127.0.0.1:8080", want: false},
+		{addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 80}, address: "192.168.1.1:80", want: false},
+		{addr: &net.TCPAddr{IP: net.ParseIP("::"), Port: 80}, address: ":80", want: true},
+		{addr: &net.TCPAddr{IP: net.ParseIP("::"), Port: 80}, address: "0.0.0.0:80", want: true},
+		{addr: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 3128}, address: "[::1]:3128", want: true},
+		{addr: &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: 53}, address: "0.0.0.0:53", want: true},
+		{addr: &net.UnixAddr{Name: "/run/pc-proxy.sock", Net: "unix"}, address: "0.0.0.0:53", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := SameAddress(tt.addr, tt.address); got != tt.want {
+			t.Errorf("SameAddress(%v, %v) = %v, want %v", tt.addr, tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestSockets(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	defer l.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+
+	defer pc.Close()
+
+	sockets := NewSockets([]*Socket{{Name: "http", Listener: l}, {Name: "dns", PacketConn: pc}})
+
+	if got := sockets.Listener(pc.LocalAddr().String()); got != nil {
+		t.Errorf("Listener() = %v, want nil for the address of a datagram socket", got.Addr())
+	}
+
+	if got := sockets.Listener(l.Addr().String()); got != l {
+		t.Errorf("Listener() = %v, want the passed listener", got)
+	}
+
+	if got := sockets.Listener(l.Addr().String()); got != nil {
+		t.Error("Listener() returned the passed listener twice")
+	}
+
+	if remaining := sockets.Remaining(); len(remaining) != 1 || remaining[0].Name != "dns" {
+		t.Errorf("Remaining() = %v, want the dns socket", remaining)
+	}
+
+	if got := sockets.PacketConn(pc.LocalAddr().String()); got != pc {
+		t.Errorf("PacketConn() = %v, want the passed socket", got)
+	}
+
+	var none *Sockets
+
+	if none.Listener(l.Addr().String()) != nil || none.Remaining() != nil {
+		t.Error("expected a nil set to have no sockets")
+	}
+}
+
+func TestEnv(t *testing.T) {
+	env := Env([]string{"PATH=/usr/bin", "LISTEN_PID=10", "LISTEN_FDS=1", "LISTEN_FDNAMES=old", "NOTIFY_SOCKET=/run/notify"}, []string{"http", "dns"})
+	want := []string{"PATH=/usr/bin", "NOTIFY_SOCKET=/run/notify", "LISTEN_FDS=2", "LISTEN_FDNAMES=http:dns"}
+
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("Env() = %v, want %v", env, want)
+	}
+}
+
+func TestListenEnv(t *testing.T) {
+	defer os.Unsetenv(ENV_LISTEN_PID)
+	defer os.Unsetenv(ENV_LISTEN_FDS)
+	defer os.Unsetenv(ENV_LISTEN_FDNAMES)
+
+	tests := []struct {
+		name      string
+		pid       string
+		fds       string
+		wantN     int
+		wantNames []string
+		wantErr   bool
+	}{
+		{name: "not set"},
+		{name: "systemd", pid: strconv.Itoa(os.Getpid()), fds: "2", wantN: 2, wantNames: []string{"http", "dns"}},
+		{name: "upgrade", fds: "2", wantN: 2, wantNames: []string{"http", "dns"}},
+		{name: "another process", pid: strconv.Itoa(os.Getpid() + 1), fds: "2"},
+		{name: "invalid", fds: "two", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(ENV_LISTEN_PID, tt.pid)
+			os.Setenv(ENV_LISTEN_FDS, tt.fds)
+			os.Setenv(ENV_LISTEN_FDNAMES, "http:dns")
+
+			if tt.pid == "" {
+				os.Unsetenv(ENV_LISTEN_PID)
+			}
+
+			n, names, err := listenEnv()
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("listenEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if n != tt.wantN || !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("listenEnv() = %v, %v, want %v, %v", n, names, tt.wantN, tt.wantNames)
+			}
+
+			if _, ok := os.LookupEnv(ENV_LISTEN_FDS); ok {
+				t.Error("expected the variables to be unset")
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+// +build !windows
+
+package activation
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Inherited returns the sockets passed to the process by systemd socket activation, or by the process it replaced
+// during an upgrade
+func Inherited() (*Sockets, error) {
+	n, names, err := listenEnv()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var sockets []*Socket
+
+	for i := 0; i < n; i++ {
+		fd := LISTEN_FDS_START + i
+
+		syscall.CloseOnExec(fd)
+
+		sock := &Socket{Name: "unknown"}
+
+		if i < len(names) && names[i] != "" {
+			sock.Name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), sock.Name)
+
+		// net.FileListener and net.FilePacketConn use a copy of the file descriptor
+		if sock.Listener, err = net.FileListener(f); err != nil {
+			if sock.PacketConn, err = net.FilePacketConn(f); err != nil {
+				f.Close()
+				return nil, errors.New("file descriptor " + sock.Name + " isn't a socket: " + err.Error())
+			}
+		}
+
+		f.Close()
+
+		sockets = append(sockets, sock)
+	}
+
+	return NewSockets(sockets), nil
+}
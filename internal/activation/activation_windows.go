@@ -0,0 +1,10 @@
+// +build windows
+
+package activation
+
+// Inherited returns no sockets, sockets can't be passed to processes on windows
+func Inherited() (*Sockets, error) {
+	_, _, err := listenEnv()
+
+	return nil, err
+}
@@ -0,0 +1,223 @@
+package arp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_ARP_FILE = "/proc/net/arp"
+
+	// ATF_COM, the entry is complete (the MAC address is known)
+	ARP_FLAG_COMPLETE = 0x2
+)
+
+// the command that lists the kernel's IPv6 neighbour table (IPv6 has no ARP table)
+var DEFAULT_NEIGH_COMMAND = []string{"ip", "-6", "neigh", "show"}
+
+// Table maps IP addresses to MAC addresses using the kernel's ARP table (`/proc/net/arp` on Linux) for IPv4, and its
+// neighbour table (`ip -6 neigh`) for IPv6.  The tables are read again when the cached copy is older than the cache time
+type Table struct {
+	path         string
+	neighCommand []string
+	cacheTime    time.Duration
+	mu           sync.Mutex
+	entries      map[string]string
+	neighEntries map[string]string
+	loaded       time.Time
+	neighLoaded  time.Time
+	err          error
+	neighErr     error
+	now          func() time.Time
+}
+
+func New(path string, cacheTime time.Duration) *Table {
+	return newTable(path, cacheTime, time.Now)
+}
+
+func newTable(path string, cacheTime time.Duration, now func() time.Time) *Table {
+	if path == "" {
+		path = DEFAULT_ARP_FILE
+	}
+
+	return &Table{
+		path:         path,
+		neighCommand: DEFAULT_NEIGH_COMMAND,
+		cacheTime:    cacheTime,
+		now:          now,
+	}
+}
+
+// Lookup returns the MAC address of the IP address (an error is returned when the ARP or neighbour table can't be read)
+func (t *Table) Lookup(ip string) (string, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// link local addresses have the interface as their zone (`fe80::1%eth0`)
+	if i := strings.IndexByte(ip, '%'); i >= 0 {
+		ip = ip[:i]
+	}
+
+	addr := net.ParseIP(ip)
+
+	if addr != nil && addr.To4() == nil {
+		if t.neighEntries == nil || t.now().Sub(t.neighLoaded) >= t.cacheTime {
+			t.loadNeigh()
+		}
+
+		mac, ok := t.neighEntries[addr.String()]
+
+		return mac, ok, t.neighErr
+	}
+
+	if addr != nil {
+		// IPv4 clients of a dual stack listener (`::ffff:192.168.1.10`)
+		ip = addr.String()
+	}
+
+	if t.entries == nil || t.now().Sub(t.loaded) >= t.cacheTime {
+		t.load()
+	}
+
+	mac, ok := t.entries[ip]
+
+	return mac, ok, t.err
+}
+
+func (t *Table) load() {
+	t.loaded = t.now()
+
+	f, err := os.Open(t.path)
+
+	if err != nil {
+		t.entries, t.err = map[string]string{}, err
+		return
+	}
+
+	defer f.Close()
+
+	entries, err := Parse(f)
+
+	if err != nil {
+		t.entries, t.err = map[string]string{}, err
+		return
+	}
+
+	t.entries, t.err = entries, nil
+}
+
+func (t *Table) loadNeigh() {
+	t.neighLoaded = t.now()
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(t.neighCommand[0], t.neighCommand[1:]...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+
+	if err != nil {
+		t.neighEntries, t.neighErr = map[string]string{}, errors.New("error reading the neighbour table: "+err.Error()+" "+strings.TrimSpace(stderr.String()))
+		return
+	}
+
+	entries, err := ParseNeigh(bytes.NewReader(out))
+
+	if err != nil {
+		t.neighEntries, t.neighErr = map[string]string{}, err
+		return
+	}
+
+	t.neighEntries, t.neighErr = entries, nil
+}
+
+// Parse reads the `/proc/net/arp` format (a header line, then `IP address, HW type, Flags, HW address, Mask, Device` columns)
+func Parse(r io.Reader) (map[string]string, error) {
+	entries := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+
+	// skip the header
+	scanner.Scan()
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) < 4 {
+			continue
+		}
+
+		flags, err := strconv.ParseInt(fields[2], 0, 64)
+
+		if err != nil || flags&ARP_FLAG_COMPLETE == 0 {
+			// incomplete entry
+			continue
+		}
+
+		mac, err := net.ParseMAC(fields[3])
+
+		if err != nil || isZero(mac) {
+			continue
+		}
+
+		entries[fields[0]] = mac.String()
+	}
+
+	return entries, scanner.Err()
+}
+
+// ParseNeigh reads the output of `ip neigh` (`<address> dev <device> lladdr <MAC address> [router] <state>`).  Entries
+// without a MAC address (incomplete or failed) are skipped
+func ParseNeigh(r io.Reader) (map[string]string, error) {
+	entries := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		state := fields[len(fields)-1]
+
+		if ip == nil || state == "FAILED" || state == "INCOMPLETE" {
+			continue
+		}
+
+		for i := 1; i+1 < len(fields); i++ {
+			if fields[i] != "lladdr" {
+				continue
+			}
+
+			if mac, err := net.ParseMAC(fields[i+1]); err == nil && !isZero(mac) {
+				entries[ip.String()] = mac.String()
+			}
+
+			break
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+func isZero(mac net.HardwareAddr) bool {
+	for _, b := range mac {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
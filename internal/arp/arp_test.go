@@ -0,0 +1,113 @@
+package arp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTable_Lookup(t *testing.T) {
+	tests := map[string]string{
+		"192.168.1.10": "aa:bb:cc:dd:ee:01",
+		"192.168.1.11": "aa:bb:cc:dd:ee:02",
+		"192.168.1.12": "", // incomplete
+		"192.168.1.13": "aa:bb:cc:dd:ee:03",
+		"192.168.1.14": "",
+	}
+
+	table := New(filepath.Join("..", "..", "test", "arp"), time.Second*30)
+
+	for ip, want := range tests {
+		mac, ok, err := table.Lookup(ip)
+
+		if err != nil {
+			t.Fatalf("Lookup() error = %v", err)
+		}
+
+		if mac != want || ok != (want != "") {
+			t.Errorf("Lookup(%v) = %v, %v, want %v", ip, mac, ok, want)
+		}
+	}
+}
+
+func TestTable_Lookup_IPv6(t *testing.T) {
+	tests := map[string]string{
+		"fe80::1%eth0":                   "aa:bb:cc:dd:ee:01",
+		"2001:db8:0::10":                 "aa:bb:cc:dd:ee:02",
+		"2001:db8::11":                   "", // failed
+		"2001:db8::12":                   "", // incomplete
+		"2001:db8::13":                   "",
+		"::ffff:192.168.1.10":            "aa:bb:cc:dd:ee:01", // an IPv4 client of a dual stack listener
+		"2001:0db8:0000:0000:0000::0010": "aa:bb:cc:dd:ee:02",
+	}
+
+	table := New(filepath.Join("..", "..", "test", "arp"), time.Second*30)
+	table.neighCommand = []string{"cat", filepath.Join("..", "..", "test", "neigh")}
+
+	for ip, want := range tests {
+		mac, ok, err := table.Lookup(ip)
+
+		if err != nil {
+			t.Fatalf("Lookup() error = %v", err)
+		}
+
+		if mac != want || ok != (want != "") {
+			t.Errorf("Lookup(%v) = %v, %v, want %v", ip, mac, ok, want)
+		}
+	}
+
+	table = New(filepath.Join("..", "..", "test", "arp"), time.Second*30)
+	table.neighCommand = []string{"pc-proxy-missing-command"}
+
+	if _, ok, err := table.Lookup("2001:db8::10"); ok || err == nil {
+		t.Error("expected an error when the neighbour table can't be read")
+	}
+
+	if _, ok, err := table.Lookup("192.168.1.10"); !ok || err != nil {
+		t.Errorf("expected IPv4 lookups to work without the neighbour table, got %v, %v", ok, err)
+	}
+}
+
+func TestTable_Lookup_Cache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pc-proxy-arp")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "arp")
+	header := "IP address       HW type     Flags       HW address            Mask     Device\n"
+
+	_ = ioutil.WriteFile(path, []byte(header+"10.0.0.1 0x1 0x2 aa:bb:cc:dd:ee:01 * eth0\n"), 0644)
+
+	now := time.Now()
+	table := newTable(path, time.Second*30, func() time.Time { return now })
+
+	if mac, _, _ := table.Lookup("10.0.0.1"); mac != "aa:bb:cc:dd:ee:01" {
+		t.Fatalf("expected the MAC address to be found, got %v", mac)
+	}
+
+	// the address moved to another device
+	_ = ioutil.WriteFile(path, []byte(header+"10.0.0.1 0x1 0x2 aa:bb:cc:dd:ee:02 * eth0\n"), 0644)
+
+	if mac, _, _ := table.Lookup("10.0.0.1"); mac != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("expected the cached MAC address, got %v", mac)
+	}
+
+	now = now.Add(time.Second * 30)
+
+	if mac, _, _ := table.Lookup("10.0.0.1"); mac != "aa:bb:cc:dd:ee:02" {
+		t.Errorf("expected the table to be read again, got %v", mac)
+	}
+
+	_ = os.Remove(path)
+	now = now.Add(time.Second * 30)
+
+	if _, ok, err := table.Lookup("10.0.0.1"); ok || err == nil {
+		t.Error("expected an error when the table can't be read")
+	}
+}
@@ -0,0 +1,185 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	AUDIT_FILE_PERMS = 0600
+
+	EVENT_CHALLENGE = "challenge"
+	EVENT_UNLOCK    = "unlock"
+	EVENT_FAILURE   = "failure"
+	EVENT_LOCKOUT   = "lockout"
+	EVENT_EXPIRY    = "expiry"
+	EVENT_APPROVE   = "approve"
+	EVENT_DENY      = "deny"
+)
+
+// Entry is one line of the audit file
+type Entry struct {
+	Time       time.Time  `json:"time"`
+	Event      string     `json:"event"`
+	Client     string     `json:"client"`
+	Name       string     `json:"name,omitempty"` // the client's host name
+	Host       string     `json:"host,omitempty"`
+	Rule       string     `json:"rule,omitempty"`
+	Key        string     `json:"key,omitempty"`        // the bypass grant key
+	Credential string     `json:"credential,omitempty"` // the credential (or admin) that unlocked the rule
+	Expires    *time.Time `json:"expires,omitempty"`    // when the bypass grant expires
+	Until      *time.Time `json:"until,omitempty"`      // when the lockout ends
+	URL        string     `json:"url,omitempty"`        // the url of an access request
+}
+
+// Log is an append-only JSON lines file.  When the file grows past the max size it is rotated (`file.1`, `file.2`, ...)
+type Log struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	mu         sync.Mutex
+	file       *os.File
+	size       int64
+	now        func() time.Time
+}
+
+// Open opens (or creates) the audit file.  A `maxSize` of 0 disables rotation, a `maxBackups` of 0 keeps every rotated file
+func Open(path string, maxSize int64, maxBackups int) (*Log, error) {
+	l := &Log{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		now:        time.Now,
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *Log) Path() string {
+	return l.path
+}
+
+// Write appends the entry to the file (setting its time if it isn't set)
+func (l *Log) Write(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = l.now()
+	}
+
+	line, err := json.Marshal(e)
+
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return os.ErrClosed
+	}
+
+	var rotateErr error
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if rotateErr = l.rotate(); rotateErr != nil && l.file == nil {
+			// keep appending to the current file
+			if err := l.open(); err != nil {
+				return err
+			}
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+
+	if err != nil {
+		return err
+	}
+
+	return rotateErr
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+
+	return err
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, AUDIT_FILE_PERMS)
+
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	l.file = f
+	l.size = info.Size()
+
+	return nil
+}
+
+// rotate renames the current file to `file.1` (shifting older backups up, and removing the oldest when there are more than
+// `maxBackups`) and starts a new file
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	l.file = nil
+
+	backups := l.maxBackups
+
+	if backups > 0 {
+		_ = os.Remove(l.backup(backups))
+	} else {
+		// keep every backup
+		for backups = 1; fileExists(l.backup(backups)); backups++ {
+		}
+	}
+
+	for i := backups - 1; i > 0; i-- {
+		if err := os.Rename(l.backup(i), l.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := os.Rename(l.path, l.backup(1)); err != nil {
+		return err
+	}
+
+	return l.open()
+}
+
+func (l *Log) backup(n int) string {
+	return l.path + "." + strconv.Itoa(n)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+
+	return err == nil
+}
@@ -0,0 +1,120 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLog_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pc-proxy-audit")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.jsonl")
+	expires := time.Now().Add(time.Hour).Round(time.Second)
+
+	l, err := Open(path, 0, 0)
+
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	_ = l.Write(Entry{Event: EVENT_CHALLENGE, Client: "10.0.0.1", Rule: "youtube\\.com"})
+	_ = l.Write(Entry{Event: EVENT_UNLOCK, Client: "10.0.0.1", Rule: "youtube\\.com", Credential: "parent", Expires: &expires})
+	_ = l.Close()
+
+	// reopening appends to the file
+	l, _ = Open(path, 0, 0)
+	_ = l.Write(Entry{Event: EVENT_EXPIRY, Client: "10.0.0.1", Key: "youtube\\.com"})
+	_ = l.Close()
+
+	entries := readEntries(t, path)
+
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %v", len(entries))
+	}
+
+	if e := entries[1]; e.Event != EVENT_UNLOCK || e.Credential != "parent" || e.Expires == nil || !e.Expires.Equal(expires) || e.Time.IsZero() {
+		t.Errorf("unexpected unlock entry: %v", e)
+	}
+
+	if entries[2].Event != EVENT_EXPIRY {
+		t.Errorf("expected the expiry to be appended, got %v", entries[2])
+	}
+
+	if err := l.Write(Entry{Event: EVENT_FAILURE}); err == nil {
+		t.Error("expected an error writing to a closed log")
+	}
+}
+
+func TestLog_Rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pc-proxy-audit")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.jsonl")
+
+	// room for one entry per file
+	l, err := Open(path, 150, 2)
+
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	defer l.Close()
+
+	for _, client := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		if err := l.Write(Entry{Event: EVENT_FAILURE, Client: client, Rule: "youtube\\.com"}); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	for file, client := range map[string]string{path: "10.0.0.4", path + ".1": "10.0.0.3", path + ".2": "10.0.0.2"} {
+		if entries := readEntries(t, file); len(entries) != 1 || entries[0].Client != client {
+			t.Errorf("expected %v to contain %v, got %v", file, client, entries)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("expected the oldest file to be removed")
+	}
+}
+
+func readEntries(t *testing.T, path string) []Entry {
+	var entries []Entry
+
+	f, err := os.Open(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		var e Entry
+
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid audit line %q: %v", scanner.Text(), err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries
+}
@@ -0,0 +1,117 @@
+package bypass
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Grant allows a client to bypass the blocks covered by `Key` until `Expires`
+type Grant struct {
+	Client  string    `json:"client"`
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+}
+
+// MemoryStore is an in-memory bypass store that is safe for concurrent use
+type MemoryStore struct {
+	mu     sync.RWMutex
+	grants map[string]map[string]time.Time
+	now    func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return newMemoryStore(time.Now)
+}
+
+func newMemoryStore(now func() time.Time) *MemoryStore {
+	return &MemoryStore{
+		grants: map[string]map[string]time.Time{},
+		now:    now,
+	}
+}
+
+// Active returns true when the client has an unexpired grant for the key
+func (s *MemoryStore) Active(client string, key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	expires, ok := s.grants[client][key]
+
+	return ok && s.now().Before(expires)
+}
+
+// Grant adds (or replaces) a grant.  Grants that have already expired are ignored
+func (s *MemoryStore) Grant(client string, key string, expires time.Time) {
+	if !s.now().Before(expires) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.grants[client]; !ok {
+		s.grants[client] = map[string]time.Time{}
+	}
+
+	s.grants[client][key] = expires
+}
+
+// Purge removes the expired grants and returns them
+func (s *MemoryStore) Purge() []Grant {
+	var expired []Grant
+
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for client, keys := range s.grants {
+		for key, expires := range keys {
+			if !now.Before(expires) {
+				expired = append(expired, Grant{Client: client, Key: key, Expires: expires})
+				delete(keys, key)
+			}
+		}
+
+		if len(keys) < 1 {
+			delete(s.grants, client)
+		}
+	}
+
+	sortGrants(expired)
+
+	return expired
+}
+
+// Grants returns a snapshot of the active grants
+func (s *MemoryStore) Grants() []Grant {
+	var grants []Grant
+
+	now := s.now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for client, keys := range s.grants {
+		for key, expires := range keys {
+			if now.Before(expires) {
+				grants = append(grants, Grant{Client: client, Key: key, Expires: expires})
+			}
+		}
+	}
+
+	sortGrants(grants)
+
+	return grants
+}
+
+func sortGrants(grants []Grant) {
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].Client != grants[j].Client {
+			return grants[i].Client < grants[j].Client
+		}
+
+		return grants[i].Key < grants[j].Key
+	})
+}
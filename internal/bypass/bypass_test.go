@@ -0,0 +1,117 @@
+package bypass
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.t
+}
+
+func (c *fakeClock) add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.t = c.t.Add(d)
+}
+
+func TestMemoryStore_Active(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	s := newMemoryStore(clock.now)
+
+	s.Grant("10.0.0.1", "youtube", clock.now().Add(time.Minute))
+
+	if !s.Active("10.0.0.1", "youtube") {
+		t.Error("expected the grant to be active")
+	}
+
+	if s.Active("10.0.0.1", "games") || s.Active("10.0.0.2", "youtube") {
+		t.Error("expected grants to be scoped to the client and key")
+	}
+
+	clock.add(time.Minute)
+
+	if s.Active("10.0.0.1", "youtube") {
+		t.Error("expected the grant to expire")
+	}
+}
+
+func TestMemoryStore_Grant(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	s := newMemoryStore(clock.now)
+
+	s.Grant("10.0.0.1", "youtube", clock.now().Add(-time.Second))
+
+	if len(s.Grants()) != 0 {
+		t.Error("expected an expired grant to be ignored")
+	}
+
+	s.Grant("10.0.0.1", "youtube", clock.now().Add(time.Minute))
+	s.Grant("10.0.0.1", "youtube", clock.now().Add(time.Hour))
+
+	grants := s.Grants()
+
+	if len(grants) != 1 || !grants[0].Expires.Equal(clock.now().Add(time.Hour)) {
+		t.Errorf("expected the grant to be replaced, got %v", grants)
+	}
+}
+
+func TestMemoryStore_Purge(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	s := newMemoryStore(clock.now)
+
+	s.Grant("10.0.0.1", "youtube", clock.now().Add(time.Minute))
+	s.Grant("10.0.0.1", "*", clock.now().Add(time.Hour))
+	s.Grant("10.0.0.2", "youtube", clock.now().Add(time.Minute))
+
+	clock.add(time.Minute)
+
+	expired := s.Purge()
+
+	if len(expired) != 2 || expired[0].Client != "10.0.0.1" || expired[1].Client != "10.0.0.2" {
+		t.Errorf("expected 2 expired grants, got %v", expired)
+	}
+
+	if grants := s.Grants(); len(grants) != 1 || grants[0].Key != "*" {
+		t.Errorf("expected 1 active grant, got %v", grants)
+	}
+
+	if _, ok := s.grants["10.0.0.2"]; ok {
+		t.Error("expected clients without grants to be removed")
+	}
+}
+
+func TestMemoryStore_Concurrent(t *testing.T) {
+	s := NewMemoryStore()
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			client := "10.0.0." + strconv.Itoa(i)
+
+			for j := 0; j < 100; j++ {
+				s.Grant(client, "youtube", time.Now().Add(time.Millisecond))
+				s.Active(client, "youtube")
+				s.Purge()
+				s.Grants()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
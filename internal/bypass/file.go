@@ -0,0 +1,202 @@
+package bypass
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// how long after a change the grants are saved (changes made in the meantime are saved together)
+	DEFAULT_SAVE_DELAY = time.Second
+)
+
+// FileStore is a MemoryStore that saves its grants to a state file when they change, so they survive restarts.  Changes
+// are saved in the background shortly after they are made (call `Save` before exiting).  Until `Open` is called it only
+// keeps the grants in memory
+type FileStore struct {
+	*MemoryStore
+	saveMu    sync.Mutex // held while the state file is written
+	mu        sync.Mutex
+	path      string
+	dirty     bool
+	closed    bool // the grants aren't saved anymore
+	saveTimer *time.Timer
+	delay     time.Duration
+	onError   func(err error)
+}
+
+type state struct {
+	Grants []Grant `json:"grants"`
+}
+
+// NewFileStore creates a store.  `onError` is called when saving the state file fails
+func NewFileStore(onError func(err error)) *FileStore {
+	return &FileStore{
+		MemoryStore: NewMemoryStore(),
+		delay:       DEFAULT_SAVE_DELAY,
+		onError:     onError,
+	}
+}
+
+// Open loads the grants from the state file (dropping those that expired) and saves all future changes to it
+func (s *FileStore) Open(path string) error {
+	grants, err := Load(path)
+
+	if err != nil {
+		return err
+	}
+
+	for _, g := range grants {
+		s.MemoryStore.Grant(g.Client, g.Key, g.Expires)
+	}
+
+	s.mu.Lock()
+	s.path = path
+	s.mu.Unlock()
+
+	return s.Save()
+}
+
+func (s *FileStore) Grant(client string, key string, expires time.Time) {
+	s.MemoryStore.Grant(client, key, expires)
+
+	s.changed()
+}
+
+func (s *FileStore) Purge() []Grant {
+	expired := s.MemoryStore.Purge()
+
+	if len(expired) > 0 {
+		s.changed()
+	}
+
+	return expired
+}
+
+// Save writes the active grants to the state file now (a pending background save isn't needed anymore)
+func (s *FileStore) Save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	path := s.path
+	closed := s.closed
+	s.dirty = false
+
+	if s.saveTimer != nil {
+		s.saveTimer.Stop()
+		s.saveTimer = nil
+	}
+
+	s.mu.Unlock()
+
+	if path == "" || closed {
+		return nil
+	}
+
+	return Save(path, s.Grants())
+}
+
+// Close stops saving the grants (a pending background save is cancelled).  The grants are still kept in memory
+func (s *FileStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.dirty = false
+
+	if s.saveTimer != nil {
+		s.saveTimer.Stop()
+		s.saveTimer = nil
+	}
+}
+
+// changed marks the grants as changed, and schedules a background save when none is pending
+func (s *FileStore) changed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.dirty = true
+
+	if s.saveTimer == nil {
+		s.saveTimer = time.AfterFunc(s.delay, s.saveChanges)
+	}
+}
+
+// saveChanges saves the grants when they changed since the last save
+func (s *FileStore) saveChanges() {
+	s.mu.Lock()
+	dirty := s.dirty
+	s.mu.Unlock()
+
+	if !dirty {
+		return
+	}
+
+	if err := s.Save(); err != nil && s.onError != nil {
+		s.onError(err)
+	}
+}
+
+// Load reads grants from a state file.  A missing state file has no grants
+func Load(path string) ([]Grant, error) {
+	contents, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var st state
+
+	if err := json.Unmarshal(contents, &st); err != nil {
+		return nil, err
+	}
+
+	return st.Grants, nil
+}
+
+// Save atomically replaces the state file by writing to a temp file (only readable by the owner) in the same directory and renaming it
+func Save(path string, grants []Grant) error {
+	contents, err := json.MarshalIndent(state{Grants: grants}, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	// clean up the temp file if anything fails before the rename
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(contents); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
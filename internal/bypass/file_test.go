@@ -0,0 +1,190 @@
+package bypass
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSave_Load(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pc-proxy-bypass")
+
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bypass.json")
+
+	if grants, err := Load(path); err != nil || len(grants) != 0 {
+		t.Errorf("expected a missing state file to have no grants, got %v (%v)", grants, err)
+	}
+
+	expires := time.Now().Add(time.Hour).Round(time.Second)
+
+	if err := Save(path, []Grant{{Client: "10.0.0.1", Key: "*", Expires: expires}}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	grants, err := Load(path)
+
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if len(grants) != 1 || grants[0].Client != "10.0.0.1" || grants[0].Key != "*" || !grants[0].Expires.Equal(expires) {
+		t.Errorf("expected the saved grant, got %v", grants)
+	}
+
+	// only the state file should remain (no temp files)
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected 1 file in the data directory, got %v", len(files))
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the state file to only be readable by the owner, got %v (%v)", info.Mode().Perm(), err)
+	}
+}
+
+func TestFileStore_Open(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pc-proxy-bypass")
+
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bypass.json")
+
+	// one grant expired while the proxy was down
+	err = Save(path, []Grant{
+		{Client: "10.0.0.1", Key: "youtube", Expires: time.Now().Add(-time.Minute)},
+		{Client: "10.0.0.1", Key: "*", Expires: time.Now().Add(time.Hour)},
+	})
+
+	if err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	var saveErr error
+
+	s := NewFileStore(func(err error) {
+		saveErr = err
+	})
+
+	if err := s.Open(path); err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	if s.Active("10.0.0.1", "youtube") {
+		t.Error("expected the expired grant to be dropped")
+	}
+
+	if !s.Active("10.0.0.1", "*") {
+		t.Error("expected the active grant to be restored")
+	}
+
+	s.Grant("10.0.0.2", "games", time.Now().Add(time.Hour))
+
+	// the change is saved in the background
+	if grants, _ := Load(path); len(grants) != 1 {
+		t.Errorf("expected the grant to not be saved right away, got %v", grants)
+	}
+
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	if grants, _ := Load(path); len(grants) != 2 {
+		t.Errorf("expected Save to save the change, got %v", grants)
+	}
+
+	s.delay = time.Millisecond * 10
+	s.Grant("10.0.0.3", "games", time.Now().Add(time.Hour))
+	s.Grant("10.0.0.4", "games", time.Now().Add(time.Hour))
+
+	var grants []Grant
+
+	for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+		if grants, _ = Load(path); len(grants) == 4 {
+			break
+		}
+	}
+
+	if len(grants) != 4 {
+		t.Errorf("expected grants to be saved when they change, got %v", grants)
+	}
+
+	s.mu.Lock()
+	pending := s.dirty || s.saveTimer != nil
+	s.mu.Unlock()
+
+	if pending {
+		t.Error("expected no save to be pending after the changes were saved")
+	}
+
+	if saveErr != nil {
+		t.Errorf("unexpected save error: %v", saveErr)
+	}
+}
+
+func TestFileStore_Close(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pc-proxy-bypass")
+
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bypass.json")
+
+	s := NewFileStore(nil)
+
+	if err := s.Open(path); err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	s.delay = time.Millisecond * 10
+	s.Grant("10.0.0.1", "games", time.Now().Add(time.Hour))
+
+	// the pending save is cancelled
+	s.Close()
+	time.Sleep(time.Millisecond * 50)
+
+	s.Grant("10.0.0.2", "games", time.Now().Add(time.Hour))
+
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	if grants, _ := Load(path); len(grants) != 0 {
+		t.Errorf("expected no grants to be saved after Close, got %v", grants)
+	}
+
+	if !s.Active("10.0.0.2", "games") {
+		t.Error("expected the grants to be kept in memory after Close")
+	}
+}
+
+func TestFileStore_Open_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pc-proxy-bypass")
+
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bypass.json")
+
+	_ = ioutil.WriteFile(path, []byte("not json"), 0600)
+
+	if err := NewFileStore(nil).Open(path); err == nil {
+		t.Error("expected an error for an invalid state file")
+	}
+}
@@ -0,0 +1,243 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// prefix of user selectors and of the keys of authenticated users
+	USER_PREFIX = "user:"
+	// prefix of MAC address selectors and of the keys of clients with a known MAC address
+	MAC_PREFIX = "mac:"
+	// prefix of host name selectors
+	NAME_PREFIX = "name:"
+)
+
+type Identity struct {
+	IP   string
+	MAC  string // set when the client's MAC address is known (from the ARP table)
+	User string // set when the client authenticated with the proxy
+	Name string // set when the client's host name is known (from the DHCP leases).  Names are chosen by the client, so they aren't used as keys
+}
+
+type identityContextKey struct{}
+
+// Selector matches client identities.  Selectors are written as an IP address (`192.168.1.10`), a CIDR (`192.168.1.0/24`),
+// a MAC address (`mac:aa:bb:cc:dd:ee:ff`), a host name (`name:kids-laptop`), or a user name (`user:alice`)
+type Selector interface {
+	Matches(id Identity) bool
+	String() string
+}
+
+type Group struct {
+	Name      string
+	Selectors []Selector
+}
+
+type ipSelector struct {
+	ip net.IP
+}
+
+type cidrSelector struct {
+	network *net.IPNet
+}
+
+type userSelector struct {
+	user string
+}
+
+type macSelector struct {
+	mac string
+}
+
+type nameSelector struct {
+	name string
+}
+
+// WithIdentity returns a copy of the context that carries the client's identity
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, id)
+}
+
+// IdentityFromRequest returns the identity attached to the request's context, or the identity of the client's address
+func IdentityFromRequest(req *http.Request) Identity {
+	if id, ok := req.Context().Value(identityContextKey{}).(Identity); ok {
+		return id
+	}
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+
+	if err != nil {
+		// RemoteAddr without a port
+		ip = req.RemoteAddr
+	}
+
+	return Identity{
+		IP: ip,
+	}
+}
+
+// Key is the value used to track state (rate limits, bypass grants, etc.) for the client.  Users are preferred over MAC
+// addresses, which are preferred over IP addresses
+func (i Identity) Key() string {
+	return i.Keys()[0]
+}
+
+// AddressKey is the key of the client's device (its MAC address, or its IP address) without the user.  Lockouts are
+// tracked by it, so the logins and bypass passwords tried from a device count against the same limit
+func (i Identity) AddressKey() string {
+	if i.MAC != "" {
+		return MAC_PREFIX + i.MAC
+	}
+
+	return i.IP
+}
+
+// Keys returns every key the client's state could be stored under, most specific first
+func (i Identity) Keys() []string {
+	var keys []string
+
+	if i.User != "" {
+		keys = append(keys, USER_PREFIX+i.User)
+	}
+
+	if i.MAC != "" {
+		keys = append(keys, MAC_PREFIX+i.MAC)
+	}
+
+	return append(keys, i.IP)
+}
+
+func ParseSelector(s string) (Selector, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.HasPrefix(s, USER_PREFIX) {
+		user := strings.TrimPrefix(s, USER_PREFIX)
+
+		if user == "" {
+			return nil, errors.New("invalid client selector (" + s + ").  Missing the user name")
+		}
+
+		return userSelector{user: user}, nil
+	}
+
+	if strings.HasPrefix(s, MAC_PREFIX) {
+		mac, err := net.ParseMAC(strings.TrimPrefix(s, MAC_PREFIX))
+
+		if err != nil {
+			return nil, errors.New("invalid client selector (" + s + "): " + err.Error())
+		}
+
+		return macSelector{mac: mac.String()}, nil
+	}
+
+	if strings.HasPrefix(s, NAME_PREFIX) {
+		name := strings.TrimPrefix(s, NAME_PREFIX)
+
+		if name == "" {
+			return nil, errors.New("invalid client selector (" + s + ").  Missing the host name")
+		}
+
+		return nameSelector{name: name}, nil
+	}
+
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return cidrSelector{network: network}, nil
+	}
+
+	ip := net.ParseIP(s)
+
+	if ip == nil {
+		return nil, errors.New("invalid client selector (" + s + ").  Must be an IP address, CIDR, MAC address, host name, or user")
+	}
+
+	return ipSelector{ip: ip}, nil
+}
+
+func ParseSelectors(clients []string) ([]Selector, error) {
+	var selectors []Selector
+
+	for _, c := range clients {
+		s, err := ParseSelector(c)
+
+		if err != nil {
+			return nil, err
+		}
+
+		selectors = append(selectors, s)
+	}
+
+	return selectors, nil
+}
+
+func NewGroup(name string, clients []string) (Group, error) {
+	selectors, err := ParseSelectors(clients)
+
+	return Group{
+		Name:      name,
+		Selectors: selectors,
+	}, err
+}
+
+func (g Group) Matches(id Identity) bool {
+	for _, s := range g.Selectors {
+		if s.Matches(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s ipSelector) Matches(id Identity) bool {
+	return s.ip.Equal(net.ParseIP(id.IP))
+}
+
+func (s ipSelector) String() string {
+	return s.ip.String()
+}
+
+func (s cidrSelector) Matches(id Identity) bool {
+	ip := net.ParseIP(id.IP)
+
+	return ip != nil && s.network.Contains(ip)
+}
+
+func (s cidrSelector) String() string {
+	return s.network.String()
+}
+
+func (s userSelector) Matches(id Identity) bool {
+	return id.User == s.user
+}
+
+func (s userSelector) String() string {
+	return USER_PREFIX + s.user
+}
+
+func (s macSelector) Matches(id Identity) bool {
+	return id.MAC == s.mac
+}
+
+func (s macSelector) String() string {
+	return MAC_PREFIX + s.mac
+}
+
+// host names are case insensitive
+func (s nameSelector) Matches(id Identity) bool {
+	return id.Name != "" && strings.EqualFold(id.Name, s.name)
+}
+
+func (s nameSelector) String() string {
+	return NAME_PREFIX + s.name
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIdentityFromRequest(t *testing.T) {
+	req := httptest.NewRequest("CONNECT", "http://example.com:443", nil)
+	req.RemoteAddr = "192.168.1.10:54321"
+
+	id := IdentityFromRequest(req)
+
+	if id.IP != "192.168.1.10" {
+		t.Errorf("expected %v, got %v", "192.168.1.10", id.IP)
+	}
+
+	if id.Key() != "192.168.1.10" {
+		t.Errorf("expected %v, got %v", "192.168.1.10", id.Key())
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	if _, err := ParseSelector("not an address"); err == nil {
+		t.Error("expected an error for an invalid selector")
+	}
+
+	if _, err := ParseSelector("192.168.1.0/33"); err == nil {
+		t.Error("expected an error for an invalid CIDR")
+	}
+}
+
+func TestGroup_Matches(t *testing.T) {
+	g, err := NewGroup("kids", []string{"192.168.1.10", "10.0.0.0/24", "fd00::/8"})
+
+	if err != nil {
+		t.Fatalf("NewGroup() error = %v", err)
+	}
+
+	tests := map[string]bool{
+		"192.168.1.10": true,
+		"192.168.1.11": false,
+		"10.0.0.200":   true,
+		"10.0.1.1":     false,
+		"fd00::1":      true,
+		"":             false,
+	}
+
+	for ip, want := range tests {
+		if got := g.Matches(Identity{IP: ip}); got != want {
+			t.Errorf("Matches(%v) = %v, wanted %v", ip, got, want)
+		}
+	}
+}
+
+func TestIdentity_User(t *testing.T) {
+	req := httptest.NewRequest("CONNECT", "http://example.com:443", nil)
+	req.RemoteAddr = "192.168.1.10:54321"
+	req = req.WithContext(WithIdentity(req.Context(), Identity{IP: "192.168.1.10", User: "alice"}))
+
+	id := IdentityFromRequest(req)
+
+	if id.Key() != "user:alice" {
+		t.Errorf("expected the user to be the key, got %v", id.Key())
+	}
+
+	if keys := id.Keys(); len(keys) != 2 || keys[1] != "192.168.1.10" {
+		t.Errorf("expected the address to be a fallback key, got %v", keys)
+	}
+
+	g, err := NewGroup("kids", []string{"user:alice"})
+
+	if err != nil {
+		t.Fatalf("NewGroup() error = %v", err)
+	}
+
+	if !g.Matches(id) || g.Matches(Identity{IP: "192.168.1.10"}) {
+		t.Error("expected the group to only match the user")
+	}
+
+	if _, err := ParseSelector("user:"); err == nil {
+		t.Error("expected an error for a user selector without a name")
+	}
+}
+
+func TestIdentity_MAC(t *testing.T) {
+	id := Identity{IP: "192.168.1.10", MAC: "aa:bb:cc:dd:ee:ff"}
+
+	if id.Key() != "mac:aa:bb:cc:dd:ee:ff" {
+		t.Errorf("expected the MAC address to be the key, got %v", id.Key())
+	}
+
+	id.User = "alice"
+
+	if keys := id.Keys(); len(keys) != 3 || keys[0] != "user:alice" || keys[1] != "mac:aa:bb:cc:dd:ee:ff" || keys[2] != "192.168.1.10" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	// the device is locked out, whoever is logged in
+	if id.AddressKey() != "mac:aa:bb:cc:dd:ee:ff" || (Identity{IP: "192.168.1.10", User: "alice"}).AddressKey() != "192.168.1.10" {
+		t.Errorf("expected the address key to ignore the user, got %v", id.AddressKey())
+	}
+
+	// MAC addresses are compared in their canonical form
+	g, err := NewGroup("kids", []string{"mac:AA-BB-CC-DD-EE-FF"})
+
+	if err != nil {
+		t.Fatalf("NewGroup() error = %v", err)
+	}
+
+	if !g.Matches(id) || g.Matches(Identity{IP: "192.168.1.10"}) {
+		t.Error("expected the group to only match the MAC address")
+	}
+
+	if _, err := ParseSelector("mac:not a mac"); err == nil {
+		t.Error("expected an error for an invalid MAC address")
+	}
+}
+
+func TestIdentity_Name(t *testing.T) {
+	id := Identity{IP: "192.168.1.10", Name: "Kids-Laptop"}
+
+	if id.Key() != "192.168.1.10" {
+		t.Errorf("expected the host name not to be a key, got %v", id.Key())
+	}
+
+	g, err := NewGroup("kids", []string{"name:kids-laptop"})
+
+	if err != nil {
+		t.Fatalf("NewGroup() error = %v", err)
+	}
+
+	if !g.Matches(id) || g.Matches(Identity{IP: "192.168.1.10"}) {
+		t.Error("expected the group to only match the host name")
+	}
+
+	if _, err := ParseSelector("name:"); err == nil {
+		t.Error("expected an error for a name selector without a name")
+	}
+}
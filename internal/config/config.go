@@ -1,5 +1,9 @@
 package config
 
+import (
+	"time"
+)
+
 const (
 	DEFAULT_LOGGING_LEVEL    = "info"
 	DEFAULT_LOGGING_ENCODING = "console"
@@ -8,14 +12,92 @@ const (
 	DEFAULT_LISTEN_PORT     = 80
 	DEFAULT_LISTEN_TLS_PORT = 443
 
+	// transparent listeners are disabled when 0
+	DEFAULT_LISTEN_TRANSPARENT_PORT     = 0
+	DEFAULT_LISTEN_TRANSPARENT_TLS_PORT = 0
+	DEFAULT_LISTEN_SOCKS_PORT           = 0
+
 	DEFAULT_TLS_CIPHERS = "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"
+
+	// a value of 0 disables the limit
+	DEFAULT_RATE_LIMIT_REQUESTS_PER_SECOND = 0
+	DEFAULT_RATE_LIMIT_BURST               = 0
+	DEFAULT_RATE_LIMIT_MAX_CONNECTIONS     = 0
+
+	DEFAULT_BYPASS_DURATION = time.Hour * 20
+	DEFAULT_BYPASS_SCOPE    = "rule"
+	DEFAULT_BYPASS_SCHEME   = "basic"
+
+	// a value of 0 for max failures disables lockouts
+	DEFAULT_BYPASS_MAX_FAILURES         = 5
+	DEFAULT_BYPASS_FAILURE_WINDOW       = time.Minute * 10
+	DEFAULT_BYPASS_LOCKOUT_DURATION     = time.Minute
+	DEFAULT_BYPASS_MAX_LOCKOUT_DURATION = time.Hour
+
+	DEFAULT_ACCESS_REQUESTS_ENABLED     = false
+	DEFAULT_ACCESS_REQUESTS_MAX_PENDING = 5
+
+	DEFAULT_PROXY_AUTH_ENABLED       = false
+	DEFAULT_PROXY_AUTH_SCHEME        = "basic"
+	DEFAULT_PROXY_AUTH_HTPASSWD_FILE = ""
+	DEFAULT_PROXY_AUTH_HTDIGEST_FILE = ""
+
+	DEFAULT_ARP_ENABLED    = false
+	DEFAULT_ARP_FILE       = "/proc/net/arp"
+	DEFAULT_ARP_CACHE_TIME = time.Second * 30
+
+	DEFAULT_LEASES_ENABLED = false
+	DEFAULT_LEASES_FILE    = "/var/lib/misc/dnsmasq.leases"
+	DEFAULT_LEASES_FORMAT  = "dnsmasq"
+
+	DEFAULT_PAC_ENABLED    = false
+	DEFAULT_PAC_PORT       = 0 // the PAC file is only served on the proxy's listener when 0
+	DEFAULT_PAC_PROXY_HOST = ""
+
+	DEFAULT_UPSTREAM_ENABLED = false
+	DEFAULT_UPSTREAM_ADDRESS = ""
+	DEFAULT_UPSTREAM_USER    = ""
+	DEFAULT_UPSTREAM_ROUTE   = "upstream"
+
+	// the CA is saved in the data dir when the files are empty
+	DEFAULT_INTERCEPT_ENABLED    = false
+	DEFAULT_INTERCEPT_CA_CERT    = ""
+	DEFAULT_INTERCEPT_CA_KEY     = ""
+	DEFAULT_INTERCEPT_BLOCK_PAGE = false
+
+	DEFAULT_DNS_ENABLED  = false
+	DEFAULT_DNS_PORT     = 53
+	DEFAULT_DNS_UPSTREAM = ""
+	DEFAULT_DNS_SINKHOLE = "" // blocked names are answered with NXDOMAIN when empty
+
+	// the audit file is not written when empty
+	DEFAULT_AUDIT_FILE        = ""
+	DEFAULT_AUDIT_MAX_SIZE    = 10 // megabytes
+	DEFAULT_AUDIT_MAX_BACKUPS = 5
+
+	// state (like bypass grants) is not persisted when empty
+	DEFAULT_DATA_DIR = ""
 )
 
 type Config struct {
-	Rules   []map[string]interface{}
-	TLS     TLSConfig
-	Logging LoggingConfig
-	Listen  ListenConfig
+	Rules          []map[string]interface{}
+	TLS            TLSConfig
+	Logging        LoggingConfig
+	Listen         ListenConfig
+	RateLimit      RateLimitConfig
+	ClientGroups   []ClientGroupConfig
+	Credentials    []CredentialConfig
+	Bypass         BypassConfig
+	DataDir        string
+	AccessRequests AccessRequestsConfig
+	ProxyAuth      ProxyAuthConfig
+	Audit          AuditConfig
+	Arp            ArpConfig
+	Leases         LeasesConfig
+	Pac            PacConfig
+	Upstream       UpstreamConfig
+	Intercept      InterceptConfig
+	Dns            DnsConfig
 }
 
 type TLSConfig struct {
@@ -30,10 +112,144 @@ type LoggingConfig struct {
 	Encoding string
 }
 
+// ListenConfig `Listeners` are the addresses the proxy accepts clients on.  `Port` and `TlsPort` (on `Host`) are used
+// when no listeners are configured.  `TransparentPort` and `TransparentTlsPort` accept HTTP and HTTPS connections
+// redirected to the proxy by iptables (linux only).  `SocksPort` accepts SOCKS5 clients
 type ListenConfig struct {
-	Host    string
-	Port    int
-	TlsPort int
+	Host               string
+	Port               int
+	TlsPort            int
+	Listeners          []ListenerConfig
+	TransparentPort    int
+	TransparentTlsPort int
+	SocksPort          int
+}
+
+// ListenerConfig `Address` is "host:port" (IPv6 hosts in brackets, "[::]:3128").  `Protocol` is "http" or "tls"
+type ListenerConfig struct {
+	Address  string
+	Protocol string
+}
+
+type RateLimitConfig struct {
+	RequestsPerSecond float64
+	Burst             int
+	MaxConnections    int
+}
+
+// ClientGroupConfig limit values of 0 fall back to the global RateLimitConfig
+type ClientGroupConfig struct {
+	Name              string
+	Clients           []string
+	RequestsPerSecond float64
+	Burst             int
+	MaxConnections    int
+}
+
+// BypassConfig `Scope` can be: "rule" (only the matched rule), "host" (all rules for the requested host), or "all" (all rules).
+// `Scheme` is the auth scheme used to ask for the password: "basic" or "digest"
+type BypassConfig struct {
+	Duration           time.Duration
+	Scope              string
+	Scheme             string
+	MaxFailures        int
+	FailureWindow      time.Duration
+	LockoutDuration    time.Duration
+	MaxLockoutDuration time.Duration
+}
+
+// AccessRequestsConfig `MaxPending` is the number of pending requests each client can have (0 is unlimited)
+type AccessRequestsConfig struct {
+	Enabled    bool
+	MaxPending int
+}
+
+// ProxyAuthConfig requires clients to authenticate with a user from `HtpasswdFile` (bcrypt entries, "basic" `Scheme`) or
+// `HtdigestFile` ("digest" `Scheme`) when `Enabled`
+type ProxyAuthConfig struct {
+	Enabled      bool
+	Scheme       string
+	HtpasswdFile string
+	HtdigestFile string
+}
+
+// AuditConfig `MaxSize` is the size (in megabytes) at which the audit file is rotated (0 never rotates), `MaxBackups` is
+// the number of rotated files that are kept (0 keeps all of them)
+type AuditConfig struct {
+	File       string
+	MaxSize    int
+	MaxBackups int
+}
+
+// ArpConfig identifies clients by the MAC address of their IP address in the kernel's ARP table (`File`, IPv4) or
+// neighbour table (`ip -6 neigh`, IPv6) when `Enabled`
+type ArpConfig struct {
+	Enabled   bool
+	File      string
+	CacheTime time.Duration
+}
+
+// LeasesConfig names clients using a DHCP server's lease file (`File`) when `Enabled`.  `Format` is "dnsmasq" or "isc"
+type LeasesConfig struct {
+	Enabled bool
+	File    string
+	Format  string
+}
+
+// PacConfig serves a proxy auto-config file (`/proxy.pac` and `/wpad.dat`) when `Enabled`.  `ProxyHost` is the proxy host
+// name used in the file (the listen host, or the host the file was requested from, when empty).  Requests to the
+// `DirectHosts` don't use the proxy
+type PacConfig struct {
+	Enabled     bool
+	Port        int
+	ProxyHost   string
+	DirectHosts []string
+}
+
+// UpstreamConfig forwards allowed CONNECT requests through a parent proxy (`Address` is host:port) when `Enabled`.  `User`
+// is sent with Basic authentication (the password is read from the environment).  `Route` is the default for requests:
+// "upstream" or "direct".  Requests to the `DirectHosts` and `UpstreamHosts` (host patterns, like host rules) override the
+// default, and the `route` of the matching rule overrides both
+type UpstreamConfig struct {
+	Enabled       bool
+	Address       string
+	User          string
+	Route         string
+	DirectHosts   []string
+	UpstreamHosts []string
+}
+
+// InterceptConfig decrypts the CONNECT requests of rules with `intercept` when `Enabled`, so every rule applies to the
+// requests inside them.  Certificates are minted with the CA in `CaCert` and `CaKey` (generated when both files are
+// missing).  Requests to the `DoNotIntercept` hosts (host patterns, like host rules) are never decrypted.  `BlockPage`
+// serves the block page over TLS for blocked CONNECT requests (it doesn't need `Enabled`)
+type InterceptConfig struct {
+	Enabled        bool
+	CaCert         string
+	CaKey          string
+	DoNotIntercept []string
+	BlockPage      bool
+}
+
+// DnsConfig runs a DNS server (UDP and TCP on `Port` of the listener hosts) when `Enabled`.  Queries are forwarded to the
+// `Upstream` resolver (host:port), except names blocked by host rules, which are answered with NXDOMAIN or the `Sinkhole`
+// address
+type DnsConfig struct {
+	Enabled  bool
+	Port     int
+	Upstream string
+	Sinkhole string
+}
+
+// CredentialConfig is a named bypass password.  Exactly one of `Hash`, `HashFile` (a file containing the hash), or `TotpSecrets` must be set
+type CredentialConfig struct {
+	Name        string
+	Hash        string
+	HashFile    string
+	TotpSecrets []string
+	Tags        []string
+	MaxDuration time.Duration
+	Admin       bool
 }
 
 var conf Config = Config{
@@ -46,9 +262,82 @@ var conf Config = Config{
 		Encoding: DEFAULT_LOGGING_ENCODING,
 	},
 	Listen: ListenConfig{
-		Host:    DEFAULT_LISTEN_HOST,
-		Port:    DEFAULT_LISTEN_PORT,
-		TlsPort: DEFAULT_LISTEN_TLS_PORT,
+		Host:               DEFAULT_LISTEN_HOST,
+		Port:               DEFAULT_LISTEN_PORT,
+		TlsPort:            DEFAULT_LISTEN_TLS_PORT,
+		Listeners:          nil,
+		TransparentPort:    DEFAULT_LISTEN_TRANSPARENT_PORT,
+		TransparentTlsPort: DEFAULT_LISTEN_TRANSPARENT_TLS_PORT,
+		SocksPort:          DEFAULT_LISTEN_SOCKS_PORT,
+	},
+	RateLimit: RateLimitConfig{
+		RequestsPerSecond: DEFAULT_RATE_LIMIT_REQUESTS_PER_SECOND,
+		Burst:             DEFAULT_RATE_LIMIT_BURST,
+		MaxConnections:    DEFAULT_RATE_LIMIT_MAX_CONNECTIONS,
+	},
+	ClientGroups: nil,
+	Credentials:  nil,
+	Bypass: BypassConfig{
+		Duration:           DEFAULT_BYPASS_DURATION,
+		Scope:              DEFAULT_BYPASS_SCOPE,
+		Scheme:             DEFAULT_BYPASS_SCHEME,
+		MaxFailures:        DEFAULT_BYPASS_MAX_FAILURES,
+		FailureWindow:      DEFAULT_BYPASS_FAILURE_WINDOW,
+		LockoutDuration:    DEFAULT_BYPASS_LOCKOUT_DURATION,
+		MaxLockoutDuration: DEFAULT_BYPASS_MAX_LOCKOUT_DURATION,
+	},
+	DataDir: DEFAULT_DATA_DIR,
+	AccessRequests: AccessRequestsConfig{
+		Enabled:    DEFAULT_ACCESS_REQUESTS_ENABLED,
+		MaxPending: DEFAULT_ACCESS_REQUESTS_MAX_PENDING,
+	},
+	ProxyAuth: ProxyAuthConfig{
+		Enabled:      DEFAULT_PROXY_AUTH_ENABLED,
+		Scheme:       DEFAULT_PROXY_AUTH_SCHEME,
+		HtpasswdFile: DEFAULT_PROXY_AUTH_HTPASSWD_FILE,
+		HtdigestFile: DEFAULT_PROXY_AUTH_HTDIGEST_FILE,
+	},
+	Audit: AuditConfig{
+		File:       DEFAULT_AUDIT_FILE,
+		MaxSize:    DEFAULT_AUDIT_MAX_SIZE,
+		MaxBackups: DEFAULT_AUDIT_MAX_BACKUPS,
+	},
+	Arp: ArpConfig{
+		Enabled:   DEFAULT_ARP_ENABLED,
+		File:      DEFAULT_ARP_FILE,
+		CacheTime: DEFAULT_ARP_CACHE_TIME,
+	},
+	Leases: LeasesConfig{
+		Enabled: DEFAULT_LEASES_ENABLED,
+		File:    DEFAULT_LEASES_FILE,
+		Format:  DEFAULT_LEASES_FORMAT,
+	},
+	Pac: PacConfig{
+		Enabled:     DEFAULT_PAC_ENABLED,
+		Port:        DEFAULT_PAC_PORT,
+		ProxyHost:   DEFAULT_PAC_PROXY_HOST,
+		DirectHosts: nil,
+	},
+	Upstream: UpstreamConfig{
+		Enabled:       DEFAULT_UPSTREAM_ENABLED,
+		Address:       DEFAULT_UPSTREAM_ADDRESS,
+		User:          DEFAULT_UPSTREAM_USER,
+		Route:         DEFAULT_UPSTREAM_ROUTE,
+		DirectHosts:   nil,
+		UpstreamHosts: nil,
+	},
+	Intercept: InterceptConfig{
+		Enabled:        DEFAULT_INTERCEPT_ENABLED,
+		CaCert:         DEFAULT_INTERCEPT_CA_CERT,
+		CaKey:          DEFAULT_INTERCEPT_CA_KEY,
+		DoNotIntercept: nil,
+		BlockPage:      DEFAULT_INTERCEPT_BLOCK_PAGE,
+	},
+	Dns: DnsConfig{
+		Enabled:  DEFAULT_DNS_ENABLED,
+		Port:     DEFAULT_DNS_PORT,
+		Upstream: DEFAULT_DNS_UPSTREAM,
+		Sinkhole: DEFAULT_DNS_SINKHOLE,
 	},
 }
 
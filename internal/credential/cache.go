@@ -0,0 +1,92 @@
+package credential
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache remembers successful password checks for a while, so the password hashes (made slow on purpose) aren't checked
+// for every request.  Entries are keyed by an HMAC of the check, the passwords aren't kept.  Safe for concurrent use
+type Cache struct {
+	ttl     time.Duration
+	key     []byte
+	mu      sync.Mutex
+	entries map[string]time.Time // expiry of each check
+	now     func() time.Time
+}
+
+func NewCache(ttl time.Duration) *Cache {
+	key := make([]byte, sha256.Size)
+
+	// crypto/rand only fails when the OS can't provide randomness
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+
+	return &Cache{
+		ttl:     ttl,
+		key:     key,
+		entries: make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+// Check returns true when the check (the client, user, password, etc.) succeeded within the ttl.  Using an entry extends
+// it, so a client that keeps sending the same credentials isn't checked again
+func (c *Cache) Check(parts ...string) bool {
+	k := c.entryKey(parts)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires, ok := c.entries[k]
+
+	if !ok || c.now().After(expires) {
+		return false
+	}
+
+	c.entries[k] = c.now().Add(c.ttl)
+
+	return true
+}
+
+// Add records a successful check
+func (c *Cache) Add(parts ...string) {
+	k := c.entryKey(parts)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[k] = c.now().Add(c.ttl)
+}
+
+// Clear removes every entry (when the passwords change)
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]time.Time)
+}
+
+// Prune removes the expired entries
+func (c *Cache) Prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, expires := range c.entries {
+		if c.now().After(expires) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+func (c *Cache) entryKey(parts []string) string {
+	m := hmac.New(sha256.New, c.key)
+	m.Write([]byte(strings.Join(parts, "\x00")))
+
+	return string(m.Sum(nil))
+}
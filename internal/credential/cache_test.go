@@ -0,0 +1,55 @@
+package credential
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	now := time.Now()
+
+	c := NewCache(time.Minute)
+	c.now = func() time.Time { return now }
+
+	if c.Check("10.0.0.1", "alice", "alicepw") {
+		t.Error("expected an unknown check to miss")
+	}
+
+	c.Add("10.0.0.1", "alice", "alicepw")
+
+	if !c.Check("10.0.0.1", "alice", "alicepw") {
+		t.Error("expected the check to be cached")
+	}
+
+	// the parts are joined with a separator that can't be in them
+	if c.Check("10.0.0.1", "alicealicepw") || c.Check("10.0.0.2", "alice", "alicepw") || c.Check("10.0.0.1", "alice", "wrong") {
+		t.Error("expected a different check to miss")
+	}
+
+	// using the entry extends it
+	now = now.Add(time.Second * 50)
+
+	if !c.Check("10.0.0.1", "alice", "alicepw") {
+		t.Error("expected the check to be cached within the ttl")
+	}
+
+	now = now.Add(time.Second * 50)
+
+	if !c.Check("10.0.0.1", "alice", "alicepw") {
+		t.Error("expected the entry to be extended when it is used")
+	}
+
+	now = now.Add(time.Minute * 2)
+	c.Prune()
+
+	if len(c.entries) != 0 || c.Check("10.0.0.1", "alice", "alicepw") {
+		t.Error("expected the entry to expire")
+	}
+
+	c.Add("10.0.0.1", "alice", "alicepw")
+	c.Clear()
+
+	if c.Check("10.0.0.1", "alice", "alicepw") {
+		t.Error("expected the cache to be cleared")
+	}
+}
@@ -0,0 +1,315 @@
+package credential
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/cthayer/pc-proxy/internal/digest"
+)
+
+const (
+	DEFAULT_BCRYPT_COST = bcrypt.DefaultCost
+)
+
+// Credential is a named bypass password.  Passwords are stored as bcrypt or argon2id hashes, or are TOTP codes
+type Credential struct {
+	Name        string
+	Tags        []string      // the rule tags this credential can bypass (empty allows all rules)
+	MaxDuration time.Duration // the longest bypass this credential can grant (0 is unlimited)
+	Admin       bool          // can approve access requests
+	hash        string
+	password    string
+	totp        [][]byte         // totp secrets (a TOTP credential has no hash or password)
+	totpUsed    *totpState       // the time steps of the codes already used
+	now         func() time.Time // clock used to check totp codes
+}
+
+type Set struct {
+	credentials []Credential
+}
+
+type argon2Hash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func New(name string, hash string, tags []string, maxDuration time.Duration) (Credential, error) {
+	hash = strings.TrimSpace(hash)
+
+	c := Credential{
+		Name:        name,
+		Tags:        tags,
+		MaxDuration: maxDuration,
+		hash:        hash,
+	}
+
+	switch {
+	case isBcrypt(hash):
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return c, errors.New("invalid bcrypt hash for credential (" + name + "): " + err.Error())
+		}
+	case strings.HasPrefix(hash, "$argon2id$"):
+		if _, err := parseArgon2(hash); err != nil {
+			return c, errors.New("invalid argon2id hash for credential (" + name + "): " + err.Error())
+		}
+	default:
+		return c, errors.New("unsupported hash for credential (" + name + ").  Must be a bcrypt or argon2id hash")
+	}
+
+	return c, nil
+}
+
+// NewPlaintext creates a credential from a password that isn't hashed (the BYPASS_PASSWORD env var)
+func NewPlaintext(name string, password string) Credential {
+	return Credential{
+		Name:     name,
+		password: password,
+	}
+}
+
+// Hash creates a bcrypt hash of the password that can be used in the configuration file
+func Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), DEFAULT_BCRYPT_COST)
+
+	return string(hash), err
+}
+
+func (c Credential) Verify(password string) bool {
+	switch {
+	case len(c.totp) > 0:
+		return c.verifyTOTP(password)
+	case c.hash == "":
+		return c.password != "" && subtle.ConstantTimeCompare([]byte(c.password), []byte(password)) == 1
+	case isBcrypt(c.hash):
+		return bcrypt.CompareHashAndPassword([]byte(c.hash), []byte(password)) == nil
+	default:
+		h, err := parseArgon2(c.hash)
+
+		if err != nil {
+			return false
+		}
+
+		key := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+
+		return subtle.ConstantTimeCompare(key, h.key) == 1
+	}
+}
+
+// VerifyDigest returns true when a digest auth response was created with the credential's password (or a current TOTP code)
+func (c Credential) VerifyDigest(r digest.Response, method string) bool {
+	switch {
+	case len(c.totp) > 0:
+		var matched *totpCode
+
+		for _, code := range c.totpCodes(c.now()) {
+			if r.VerifyPassword(method, code.code) && matched == nil {
+				code := code
+				matched = &code
+			}
+		}
+
+		return matched != nil && c.useTOTP(*matched)
+	case c.hash == "":
+		return r.VerifyPassword(method, c.password)
+	default:
+		// a hashed password can't be used to check a digest response
+		return false
+	}
+}
+
+// SupportsDigest returns false for credentials that are stored as hashes (they can only be used with basic auth)
+func (c Credential) SupportsDigest() bool {
+	return c.hash == ""
+}
+
+// Allows returns true when the credential can bypass a rule with the given tags
+func (c Credential) Allows(ruleTags []string) bool {
+	if len(c.Tags) == 0 {
+		return true
+	}
+
+	for _, t := range c.Tags {
+		for _, rt := range ruleTags {
+			if t == rt {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Duration limits the requested bypass duration to the credential's MaxDuration
+func (c Credential) Duration(d time.Duration) time.Duration {
+	if c.MaxDuration > 0 && c.MaxDuration < d {
+		return c.MaxDuration
+	}
+
+	return d
+}
+
+func NewSet(credentials ...Credential) *Set {
+	return &Set{
+		credentials: credentials,
+	}
+}
+
+func (s *Set) Len() int {
+	if s == nil {
+		return 0
+	}
+
+	return len(s.credentials)
+}
+
+// Verify returns true when any credential matches the password
+func (s *Set) Verify(password string) bool {
+	if s == nil {
+		return false
+	}
+
+	for _, c := range s.credentials {
+		if c.Verify(password) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AuthenticateAdmin returns the first admin credential that matches the password
+func (s *Set) AuthenticateAdmin(password string) (Credential, bool) {
+	if s == nil {
+		return Credential{}, false
+	}
+
+	for _, c := range s.credentials {
+		if c.Admin && c.Verify(password) {
+			return c, true
+		}
+	}
+
+	return Credential{}, false
+}
+
+// Authenticate returns the first credential that matches the password and is allowed to bypass a rule with the given tags
+func (s *Set) Authenticate(password string, ruleTags []string) (Credential, bool) {
+	if s == nil {
+		return Credential{}, false
+	}
+
+	for _, c := range s.credentials {
+		if c.Allows(ruleTags) && c.Verify(password) {
+			return c, true
+		}
+	}
+
+	return Credential{}, false
+}
+
+// AuthenticateDigest returns the first credential that matches a digest auth response and is allowed to bypass a rule
+// with the given tags
+func (s *Set) AuthenticateDigest(r digest.Response, method string, ruleTags []string) (Credential, bool) {
+	if s == nil {
+		return Credential{}, false
+	}
+
+	for _, c := range s.credentials {
+		if c.Allows(ruleTags) && c.VerifyDigest(r, method) {
+			return c, true
+		}
+	}
+
+	return Credential{}, false
+}
+
+// VerifyDigest returns true when any credential matches a digest auth response
+func (s *Set) VerifyDigest(r digest.Response, method string) bool {
+	if s == nil {
+		return false
+	}
+
+	for _, c := range s.credentials {
+		if c.VerifyDigest(r, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Replace returns a copy of the set where the credentials with the given name are replaced by `c` (which is checked first)
+func (s *Set) Replace(name string, c Credential) *Set {
+	credentials := []Credential{c}
+
+	for _, existing := range s.Credentials() {
+		if existing.Name != name {
+			credentials = append(credentials, existing)
+		}
+	}
+
+	return NewSet(credentials...)
+}
+
+// Credentials returns the credentials in the set
+func (s *Set) Credentials() []Credential {
+	if s == nil {
+		return nil
+	}
+
+	return s.credentials
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// parseArgon2 parses the PHC string format: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func parseArgon2(hash string) (argon2Hash, error) {
+	var h argon2Hash
+	var version int
+
+	parts := strings.Split(hash, "$")
+
+	if len(parts) != 6 {
+		return h, errors.New("malformed hash")
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return h, err
+	}
+
+	if version != argon2.Version {
+		return h, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return h, err
+	}
+
+	var err error
+
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return h, err
+	}
+
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return h, err
+	}
+
+	if len(h.key) == 0 {
+		return h, errors.New("empty key")
+	}
+
+	return h, nil
+}
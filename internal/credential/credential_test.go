@@ -0,0 +1,166 @@
+package credential
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestNew(t *testing.T) {
+	if _, err := New("plain", "not a hash", nil, 0); err == nil {
+		t.Error("expected an error for an unsupported hash")
+	}
+
+	if _, err := New("bcrypt", "$2a$10$tooshort", nil, 0); err == nil {
+		t.Error("expected an error for a malformed bcrypt hash")
+	}
+
+	if _, err := New("argon2", "$argon2id$v=19$m=65536$salt$key", nil, 0); err == nil {
+		t.Error("expected an error for a malformed argon2id hash")
+	}
+}
+
+func TestCredential_Verify(t *testing.T) {
+	hash, err := Hash("correct horse")
+
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte("battery staple"), salt, 1, 1024, 1, 32)
+	argonHash := fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	tests := []struct {
+		hash     string
+		password string
+		want     bool
+	}{
+		{hash, "correct horse", true},
+		{hash, "wrong", false},
+		{argonHash, "battery staple", true},
+		{argonHash, "wrong", false},
+	}
+
+	for _, tt := range tests {
+		c, err := New("test", tt.hash, nil, 0)
+
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+
+		if got := c.Verify(tt.password); got != tt.want {
+			t.Errorf("Verify(%q) = %v, wanted %v", tt.password, got, tt.want)
+		}
+	}
+
+	plain := NewPlaintext("env", "secret")
+
+	if !plain.Verify("secret") || plain.Verify("Secret") {
+		t.Error("expected plaintext credential to only match its password")
+	}
+
+	if NewPlaintext("empty", "").Verify("") {
+		t.Error("expected an empty plaintext password to never match")
+	}
+}
+
+func TestCredential_Allows(t *testing.T) {
+	c := NewPlaintext("kid", "homework")
+
+	if !c.Allows(nil) {
+		t.Error("expected a credential without tags to allow all rules")
+	}
+
+	c.Tags = []string{"games", "video"}
+
+	if !c.Allows([]string{"video"}) {
+		t.Error("expected a credential to allow rules with a matching tag")
+	}
+
+	if c.Allows([]string{"social"}) || c.Allows(nil) {
+		t.Error("expected a credential to reject rules without a matching tag")
+	}
+}
+
+func TestCredential_Duration(t *testing.T) {
+	c := NewPlaintext("kid", "homework")
+
+	if d := c.Duration(time.Hour); d != time.Hour {
+		t.Errorf("expected %v, got %v", time.Hour, d)
+	}
+
+	c.MaxDuration = time.Minute * 15
+
+	if d := c.Duration(time.Hour); d != time.Minute*15 {
+		t.Errorf("expected %v, got %v", time.Minute*15, d)
+	}
+}
+
+func TestSet_Authenticate(t *testing.T) {
+	kid := NewPlaintext("kid", "homework")
+	kid.Tags = []string{"games"}
+
+	s := NewSet(NewPlaintext("parent", "secret"), kid)
+
+	if c, ok := s.Authenticate("secret", nil); !ok || c.Name != "parent" {
+		t.Errorf("expected the parent credential, got %v (%v)", c.Name, ok)
+	}
+
+	if c, ok := s.Authenticate("homework", []string{"games"}); !ok || c.Name != "kid" {
+		t.Errorf("expected the kid credential, got %v (%v)", c.Name, ok)
+	}
+
+	if _, ok := s.Authenticate("homework", []string{"social"}); ok {
+		t.Error("expected the kid credential to be rejected for an untagged rule")
+	}
+
+	var empty *Set
+
+	if _, ok := empty.Authenticate("secret", nil); ok {
+		t.Error("expected a nil set to reject all passwords")
+	}
+}
+
+func TestSet_AuthenticateAdmin(t *testing.T) {
+	parent := NewPlaintext("parent", "secret")
+	parent.Admin = true
+
+	s := NewSet(NewPlaintext("kid", "homework"), parent)
+
+	if c, ok := s.AuthenticateAdmin("secret"); !ok || c.Name != "parent" {
+		t.Errorf("expected the parent credential, got %v (%v)", c.Name, ok)
+	}
+
+	if _, ok := s.AuthenticateAdmin("homework"); ok {
+		t.Error("expected credentials that aren't admins to be rejected")
+	}
+}
+
+func TestSet_Replace(t *testing.T) {
+	s := NewSet(NewPlaintext("parent", "secret"), NewPlaintext("grandparent", "cookies"))
+	r := s.Replace("parent", NewPlaintext("homework", "homework"))
+
+	if _, ok := r.Authenticate("secret", nil); ok {
+		t.Error("expected the replaced credential to be rejected")
+	}
+
+	for _, pw := range []string{"homework", "cookies"} {
+		if _, ok := r.Authenticate(pw, nil); !ok {
+			t.Errorf("expected %v to be accepted", pw)
+		}
+	}
+
+	if _, ok := s.Authenticate("secret", nil); !ok || s.Len() != 2 {
+		t.Error("expected the original set to be unchanged")
+	}
+
+	var empty *Set
+
+	if r := empty.Replace("parent", NewPlaintext("homework", "homework")); r.Len() != 1 {
+		t.Errorf("expected a set with only the new credential, got %v", r.Len())
+	}
+}
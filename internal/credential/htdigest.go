@@ -0,0 +1,131 @@
+package credential
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cthayer/pc-proxy/internal/digest"
+)
+
+// Htdigest is a user database in the htdigest format (`user:realm:HA1` per line).  The HA1 can be an MD5 hash (as created
+// by `htdigest`) or a SHA-256 hash of `user:realm:password`
+type Htdigest struct {
+	users map[string]map[string]string // user -> realm -> HA1
+}
+
+func LoadHtdigest(path string) (*Htdigest, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return ParseHtdigest(f)
+}
+
+func ParseHtdigest(r io.Reader) (*Htdigest, error) {
+	h := &Htdigest{
+		users: make(map[string]map[string]string),
+	}
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Split(line, ":")
+
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, errors.New("malformed htdigest entry on line " + strconv.Itoa(lineNum))
+		}
+
+		ha1 := strings.ToLower(parts[2])
+
+		if _, err := hex.DecodeString(ha1); err != nil || ha1Algorithm(ha1) == "" {
+			return nil, errors.New("invalid hash for user (" + parts[0] + ").  Must be a hex encoded MD5 or SHA-256 hash")
+		}
+
+		if h.users[parts[0]] == nil {
+			h.users[parts[0]] = make(map[string]string)
+		}
+
+		h.users[parts[0]][parts[1]] = ha1
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (h *Htdigest) Len() int {
+	if h == nil {
+		return 0
+	}
+
+	return len(h.users)
+}
+
+func (h *Htdigest) Exists(user string) bool {
+	if h == nil {
+		return false
+	}
+
+	_, ok := h.users[user]
+
+	return ok
+}
+
+// VerifyDigest returns true when the response was created with the user's password
+func (h *Htdigest) VerifyDigest(r digest.Response, method string) bool {
+	if h == nil {
+		return false
+	}
+
+	ha1, ok := h.users[r.Username][r.Realm]
+
+	return ok && strings.EqualFold(ha1Algorithm(ha1), r.Algorithm) && r.Verify(method, ha1)
+}
+
+// Authenticate returns true when the password is the user's password in the realm (for clients that send the password
+// itself, like SOCKS clients)
+func (h *Htdigest) Authenticate(user string, realm string, password string) bool {
+	if h == nil {
+		return false
+	}
+
+	ha1, ok := h.users[user][realm]
+
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(ha1), []byte(digest.HA1(ha1Algorithm(ha1), user, realm, password))) == 1
+}
+
+func ha1Algorithm(ha1 string) string {
+	switch len(ha1) {
+	case 32:
+		return digest.ALGORITHM_MD5
+	case 64:
+		return digest.ALGORITHM_SHA256
+	}
+
+	return ""
+}
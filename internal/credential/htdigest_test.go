@@ -0,0 +1,92 @@
+package credential
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cthayer/pc-proxy/internal/digest"
+)
+
+func TestParseHtdigest(t *testing.T) {
+	sha := digest.HA1(digest.ALGORITHM_SHA256, "alice", "pc-proxy", "alicepw")
+	md := digest.HA1(digest.ALGORITHM_MD5, "bob", "pc-proxy", "bobpw")
+
+	h, err := ParseHtdigest(strings.NewReader("# comment\nalice:pc-proxy:" + sha + "\nbob:pc-proxy:" + md + "\n"))
+
+	if err != nil {
+		t.Fatalf("ParseHtdigest() error = %v", err)
+	}
+
+	if h.Len() != 2 || !h.Exists("alice") || h.Exists("mallory") {
+		t.Error("expected alice and bob to exist")
+	}
+
+	tests := []struct {
+		user      string
+		realm     string
+		algorithm string
+		password  string
+		want      bool
+	}{
+		{"alice", "pc-proxy", digest.ALGORITHM_SHA256, "alicepw", true},
+		{"alice", "pc-proxy", digest.ALGORITHM_SHA256, "wrong", false},
+		{"alice", "other realm", digest.ALGORITHM_SHA256, "alicepw", false},
+		{"alice", "pc-proxy", digest.ALGORITHM_MD5, "alicepw", false}, // only a SHA-256 hash is stored
+		{"bob", "pc-proxy", digest.ALGORITHM_MD5, "bobpw", true},
+	}
+
+	for _, tt := range tests {
+		r := digestResponse(tt.algorithm, tt.user, tt.realm, tt.password)
+
+		if got := h.VerifyDigest(r, "CONNECT"); got != tt.want {
+			t.Errorf("VerifyDigest(%v, %v, %v) = %v, want %v", tt.user, tt.realm, tt.algorithm, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		user     string
+		password string
+		want     bool
+	}{
+		{"alice", "alicepw", true},
+		{"bob", "bobpw", true},
+		{"bob", "alicepw", false},
+		{"mallory", "", false},
+	} {
+		if got := h.Authenticate(tt.user, "pc-proxy", tt.password); got != tt.want {
+			t.Errorf("Authenticate(%v, %v) = %v, want %v", tt.user, tt.password, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{"alice:" + sha, "alice:pc-proxy:nothex", "alice:pc-proxy:abcd"} {
+		if _, err := ParseHtdigest(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected an error for %v", invalid)
+		}
+	}
+}
+
+// digestResponse creates a digest auth response (the way a browser would)
+func digestResponse(algorithm string, user string, realm string, password string) digest.Response {
+	h := func(s string) string {
+		if algorithm == digest.ALGORITHM_MD5 {
+			return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+		}
+
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+	}
+
+	return digest.Response{
+		Username:  user,
+		Realm:     realm,
+		Nonce:     "nonce",
+		URI:       "example.com:443",
+		Algorithm: algorithm,
+		QOP:       digest.QOP_AUTH,
+		NC:        "00000001",
+		CNonce:    "cnonce",
+		Response:  h(h(user+":"+realm+":"+password) + ":nonce:00000001:cnonce:auth:" + h("CONNECT:example.com:443")),
+	}
+}
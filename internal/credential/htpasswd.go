@@ -0,0 +1,99 @@
+package credential
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd is a user database in the htpasswd format (`user:hash` per line).  Only bcrypt hashes are supported
+type Htpasswd struct {
+	users map[string]string
+}
+
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return ParseHtpasswd(f)
+}
+
+func ParseHtpasswd(r io.Reader) (*Htpasswd, error) {
+	h := &Htpasswd{
+		users: make(map[string]string),
+	}
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("malformed htpasswd entry on line " + strconv.Itoa(lineNum))
+		}
+
+		if !isBcrypt(parts[1]) {
+			return nil, errors.New("unsupported hash for user (" + parts[0] + ").  Must be a bcrypt hash (htpasswd -B)")
+		}
+
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, errors.New("invalid bcrypt hash for user (" + parts[0] + "): " + err.Error())
+		}
+
+		h.users[parts[0]] = parts[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (h *Htpasswd) Len() int {
+	if h == nil {
+		return 0
+	}
+
+	return len(h.users)
+}
+
+func (h *Htpasswd) Exists(user string) bool {
+	if h == nil {
+		return false
+	}
+
+	_, ok := h.users[user]
+
+	return ok
+}
+
+// Authenticate returns true when the password matches the user's hash
+func (h *Htpasswd) Authenticate(user string, password string) bool {
+	if h == nil {
+		return false
+	}
+
+	hash, ok := h.users[user]
+
+	return ok && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
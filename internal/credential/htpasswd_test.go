@@ -0,0 +1,47 @@
+package credential
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseHtpasswd(t *testing.T) {
+	hash, err := Hash("alicepw")
+
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+
+	h, err := ParseHtpasswd(strings.NewReader("# comment\n\nalice:" + hash + "\n"))
+
+	if err != nil {
+		t.Fatalf("ParseHtpasswd() error = %v", err)
+	}
+
+	if h.Len() != 1 || !h.Exists("alice") || h.Exists("bob") {
+		t.Errorf("expected only alice to exist")
+	}
+
+	tests := []struct {
+		user     string
+		password string
+		want     bool
+	}{
+		{"alice", "alicepw", true},
+		{"alice", "wrong", false},
+		{"bob", "alicepw", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := h.Authenticate(tt.user, tt.password); got != tt.want {
+			t.Errorf("Authenticate(%v, %v) = %v, want %v", tt.user, tt.password, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{"no separator", "md5:$apr1$salt$hash", "sha:{SHA}hash", "short:$2y$10$short"} {
+		if _, err := ParseHtpasswd(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected an error for %v", invalid)
+		}
+	}
+}
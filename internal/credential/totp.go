@@ -0,0 +1,218 @@
+package credential
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TOTP_PERIOD      = 30 * time.Second
+	TOTP_DIGITS      = 6
+	TOTP_SECRET_SIZE = 20 // bytes (160 bits, as recommended by RFC 4226)
+
+	// number of periods before and after the current one that are also accepted (allows for clock drift)
+	TOTP_SKEW = 1
+
+	DEFAULT_TOTP_ISSUER = "pc-proxy"
+)
+
+// totpState records the last time step accepted for each secret, so a code can't be used again (the state is shared by
+// the copies of the credential)
+type totpState struct {
+	mu   sync.Mutex
+	last []int64
+}
+
+// totpCode is a code the credential accepts, and the secret and time step it was generated for
+type totpCode struct {
+	key  int
+	step int64
+	code string
+}
+
+// NewTOTP creates a credential that accepts RFC 6238 time-based one-time codes generated from any of the base32 secrets.
+// Each code is only accepted once
+func NewTOTP(name string, secrets []string, tags []string, maxDuration time.Duration) (Credential, error) {
+	c := Credential{
+		Name:        name,
+		Tags:        tags,
+		MaxDuration: maxDuration,
+		now:         time.Now,
+	}
+
+	if len(secrets) == 0 {
+		return c, errors.New("no totp secrets for credential (" + name + ")")
+	}
+
+	for _, s := range secrets {
+		key, err := DecodeTOTPSecret(s)
+
+		if err != nil {
+			return c, errors.New("invalid totp secret for credential (" + name + "): " + err.Error())
+		}
+
+		c.totp = append(c.totp, key)
+	}
+
+	c.totpUsed = &totpState{last: make([]int64, len(c.totp))}
+
+	return c, nil
+}
+
+// GenerateTOTPSecret returns a new random base32 encoded secret
+func GenerateTOTPSecret() (string, error) {
+	key := make([]byte, TOTP_SECRET_SIZE)
+
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key), nil
+}
+
+// DecodeTOTPSecret decodes a base32 secret.  Spaces, padding and lower case letters are allowed
+func DecodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Join(strings.Fields(secret), ""))
+	secret = strings.TrimRight(secret, "=")
+
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) == 0 {
+		return nil, errors.New("empty secret")
+	}
+
+	return key, nil
+}
+
+// TOTPURI returns the otpauth:// URI used to enroll the secret in an authenticator app
+func TOTPURI(secret string, account string, issuer string) string {
+	if issuer == "" {
+		issuer = DEFAULT_TOTP_ISSUER
+	}
+
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(TOTP_DIGITS))
+	params.Set("period", strconv.Itoa(int(TOTP_PERIOD.Seconds())))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: params.Encode(),
+	}
+
+	return u.String()
+}
+
+// KeepState carries the used time steps over from `old` (the credential before a config reload) for the secrets both
+// credentials have, so a code accepted before the reload can't be used again after it
+func (c Credential) KeepState(old Credential) {
+	if c.totpUsed == nil || old.totpUsed == nil || c.totpUsed == old.totpUsed {
+		return
+	}
+
+	old.totpUsed.mu.Lock()
+	defer old.totpUsed.mu.Unlock()
+
+	c.totpUsed.mu.Lock()
+	defer c.totpUsed.mu.Unlock()
+
+	for k, key := range c.totp {
+		for j, oldKey := range old.totp {
+			if hmac.Equal(key, oldKey) && old.totpUsed.last[j] > c.totpUsed.last[k] {
+				c.totpUsed.last[k] = old.totpUsed.last[j]
+			}
+		}
+	}
+}
+
+// totpCodes returns the codes the credential accepts at time `t` (the current code, and the codes either side of it)
+func (c Credential) totpCodes(t time.Time) []totpCode {
+	var codes []totpCode
+
+	counter := t.Unix() / int64(TOTP_PERIOD.Seconds())
+
+	for k, key := range c.totp {
+		for i := int64(-TOTP_SKEW); i <= TOTP_SKEW; i++ {
+			codes = append(codes, totpCode{key: k, step: counter + i, code: hotp(key, uint64(counter+i), TOTP_DIGITS)})
+		}
+	}
+
+	return codes
+}
+
+func (c Credential) verifyTOTP(code string) bool {
+	code = strings.TrimSpace(code)
+
+	if len(code) != TOTP_DIGITS {
+		return false
+	}
+
+	var matched *totpCode
+
+	// check every code so the time taken doesn't depend on which one matched
+	for _, expected := range c.totpCodes(c.now()) {
+		if subtle.ConstantTimeCompare([]byte(expected.code), []byte(code)) == 1 && matched == nil {
+			expected := expected
+			matched = &expected
+		}
+	}
+
+	return matched != nil && c.useTOTP(*matched)
+}
+
+// useTOTP records that a code was accepted.  Returns false when the code's time step (or a later one) was already used,
+// so a code seen by someone else can't be replayed while it is still current
+func (c Credential) useTOTP(code totpCode) bool {
+	c.totpUsed.mu.Lock()
+	defer c.totpUsed.mu.Unlock()
+
+	if code.step <= c.totpUsed.last[code.key] {
+		return false
+	}
+
+	c.totpUsed.last[code.key] = code.step
+
+	return true
+}
+
+// hotp generates an RFC 4226 HMAC-based one-time code
+func hotp(key []byte, counter uint64, digits int) string {
+	var msg [8]byte
+
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
@@ -0,0 +1,179 @@
+package credential
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cthayer/pc-proxy/internal/digest"
+)
+
+func TestHotp(t *testing.T) {
+	// RFC 6238 appendix B test vectors (SHA1)
+	key := []byte("12345678901234567890")
+
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, tt := range tests {
+		if got := hotp(key, uint64(tt.unix/30), 8); got != tt.want {
+			t.Errorf("hotp() at %v = %v, want %v", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestCredential_Verify_TOTP(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	c, err := NewTOTP("babysitter", []string{"JBSWY3DPEHPK3PXP", secret}, nil, time.Hour)
+
+	if err != nil {
+		t.Fatalf("NewTOTP() error = %v", err)
+	}
+
+	now := time.Unix(1111111111, 0)
+	c.now = func() time.Time { return now }
+
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"081804", true},  // previous period (clock drift)
+		{"050471", true},  // current period
+		{"050471", false}, // a code can only be used once
+		{"081804", false}, // nor can an earlier one after a later code is used
+		{"005924", false}, // a code from years ago
+		{"14050471", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := c.Verify(tt.code); got != tt.want {
+			t.Errorf("Verify(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+
+	// the code expires
+	now = now.Add(TOTP_PERIOD * 3)
+
+	if c.Verify("050471") {
+		t.Error("expected an old code to be rejected")
+	}
+
+	// the copies of a credential share the used codes
+	d, _ := NewTOTP("babysitter", []string{secret}, nil, time.Hour)
+	d.now = func() time.Time { return time.Unix(1111111111, 0) }
+	copied := d
+
+	if !d.Verify("050471") || copied.Verify("050471") {
+		t.Error("expected a code used with one copy of the credential to be rejected by another")
+	}
+}
+
+func TestCredential_KeepState(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := func() time.Time { return time.Unix(1111111111, 0) }
+
+	old, _ := NewTOTP("babysitter", []string{secret}, nil, time.Hour)
+	old.now = now
+
+	if !old.Verify("050471") {
+		t.Fatal("expected the current code to be accepted")
+	}
+
+	// the reloaded credential has another secret first
+	reloaded, _ := NewTOTP("babysitter", []string{"JBSWY3DPEHPK3PXP", secret}, nil, time.Hour)
+	reloaded.now = now
+	reloaded.KeepState(old)
+
+	if reloaded.Verify("050471") {
+		t.Error("expected a code used before the reload to be rejected")
+	}
+
+	fresh, _ := NewTOTP("babysitter", []string{secret}, nil, time.Hour)
+	fresh.now = now
+
+	if !fresh.Verify("050471") {
+		t.Error("expected a credential without the old state to accept the code")
+	}
+}
+
+func TestNewTOTP(t *testing.T) {
+	if _, err := NewTOTP("none", nil, nil, 0); err == nil {
+		t.Error("expected an error without secrets")
+	}
+
+	if _, err := NewTOTP("invalid", []string{"not base32!"}, nil, 0); err == nil {
+		t.Error("expected an error for an invalid secret")
+	}
+
+	if _, err := NewTOTP("spaces", []string{"jbsw y3dp ehpk 3pxp"}, nil, 0); err != nil {
+		t.Errorf("expected lower case secrets with spaces to be accepted, got %v", err)
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+
+	if err != nil {
+		t.Fatalf("GenerateTOTPSecret() error = %v", err)
+	}
+
+	if key, err := DecodeTOTPSecret(secret); err != nil || len(key) != TOTP_SECRET_SIZE {
+		t.Errorf("expected a %v byte secret, got %v (%v)", TOTP_SECRET_SIZE, len(key), err)
+	}
+
+	u, err := url.Parse(TOTPURI(secret, "babysitter", ""))
+
+	if err != nil {
+		t.Fatalf("TOTPURI() returned an invalid URI: %v", err)
+	}
+
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/pc-proxy:babysitter" || u.Query().Get("secret") != secret || u.Query().Get("issuer") != "pc-proxy" {
+		t.Errorf("unexpected URI: %v", u)
+	}
+}
+
+func TestCredential_VerifyDigest(t *testing.T) {
+	totp, _ := NewTOTP("babysitter", []string{base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))}, nil, 0)
+	totp.now = func() time.Time { return time.Unix(1111111111, 0) }
+
+	hash, _ := Hash("secret")
+	hashed, _ := New("hashed", hash, nil, 0)
+
+	tests := []struct {
+		c        Credential
+		password string
+		want     bool
+	}{
+		{NewPlaintext("parent", "secret"), "secret", true},
+		{NewPlaintext("parent", "secret"), "wrong", false},
+		{totp, "050471", true},
+		{totp, "005924", false},
+		{hashed, "secret", false}, // hashes can't be used with digest auth
+	}
+
+	for _, tt := range tests {
+		if got := tt.c.VerifyDigest(digestResponse(digest.ALGORITHM_SHA256, "user", "realm", tt.password), "CONNECT"); got != tt.want {
+			t.Errorf("%v: VerifyDigest(%v) = %v, want %v", tt.c.Name, tt.password, got, tt.want)
+		}
+	}
+
+	if totp.VerifyDigest(digestResponse(digest.ALGORITHM_SHA256, "user", "realm", "050471"), "CONNECT") {
+		t.Error("expected a used totp code to be rejected")
+	}
+
+	if hashed.SupportsDigest() || !totp.SupportsDigest() {
+		t.Error("expected only hashed credentials to not support digest auth")
+	}
+}
@@ -0,0 +1,394 @@
+package digest
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ALGORITHM_SHA256 = "SHA-256"
+	ALGORITHM_MD5    = "MD5"
+
+	QOP_AUTH = "auth"
+
+	// how long a nonce can be used before the client is asked to use a new one
+	DEFAULT_NONCE_LIFETIME = time.Minute * 5
+
+	// how far behind the highest nonce count a response can be (clients with requests in flight on several connections
+	// don't use the counts in order)
+	NONCE_COUNT_WINDOW = 64
+
+	nonceRandomSize = 8
+	nonceMacSize    = 16
+)
+
+// algorithms in order of preference (MD5 is offered for older clients)
+var algorithms = []string{ALGORITHM_SHA256, ALGORITHM_MD5}
+
+// Response is a parsed `Digest` (Proxy-)Authorization header (RFC 7616)
+type Response struct {
+	Username  string
+	Realm     string
+	Nonce     string
+	URI       string
+	Algorithm string
+	QOP       string
+	NC        string
+	CNonce    string
+	Response  string
+}
+
+// Server issues nonces and checks that they are used no more than once per nonce count
+type Server struct {
+	key      []byte
+	lifetime time.Duration
+	mu       sync.Mutex
+	counts   map[string]*nonceCounts // the nonce counts used for each nonce
+	now      func() time.Time
+}
+
+// nonceCounts records the highest nonce count used, and which of the counts below it were used
+type nonceCounts struct {
+	issued time.Time
+	max    uint64
+	seen   uint64 // bit `i` is set when the count `max - i` was used
+}
+
+func NewServer() *Server {
+	return newServer(DEFAULT_NONCE_LIFETIME, time.Now)
+}
+
+func newServer(lifetime time.Duration, now func() time.Time) *Server {
+	key := make([]byte, sha256.Size)
+
+	// crypto/rand only fails when the OS can't provide randomness
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+
+	return &Server{
+		key:      key,
+		lifetime: lifetime,
+		counts:   make(map[string]*nonceCounts),
+		now:      now,
+	}
+}
+
+// Challenges returns the `Proxy-Authenticate` header values for the realm.  `stale` tells the client that its
+// credentials were correct but it must retry with the new nonce
+func (s *Server) Challenges(realm string, stale bool) []string {
+	var ret []string
+
+	nonce := s.nonce(realm)
+
+	for _, a := range algorithms {
+		c := "Digest realm=\"" + realm + "\", qop=\"" + QOP_AUTH + "\", algorithm=" + a + ", nonce=\"" + nonce + "\""
+
+		if stale {
+			c += ", stale=true"
+		}
+
+		ret = append(ret, c)
+	}
+
+	return ret
+}
+
+// Use checks that the response's nonce was issued by this server for the response's realm, hasn't expired, and that the
+// nonce count hasn't been used before.  The nonce count is recorded, so a response can only be used once
+func (s *Server) Use(r Response) (ok bool, stale bool) {
+	issued, ok := s.verifyNonce(r.Nonce, r.Realm)
+
+	if !ok {
+		return false, false
+	}
+
+	if s.now().Sub(issued) > s.lifetime {
+		return false, true
+	}
+
+	nc, err := strconv.ParseUint(r.NC, 16, 64)
+
+	if err != nil || nc == 0 {
+		return false, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.counts[r.Nonce]
+
+	if c == nil {
+		c = &nonceCounts{issued: issued}
+		s.counts[r.Nonce] = c
+	}
+
+	switch {
+	case nc > c.max:
+		if shift := nc - c.max; shift < NONCE_COUNT_WINDOW {
+			c.seen <<= shift
+		} else {
+			c.seen = 0
+		}
+
+		c.seen |= 1
+		c.max = nc
+	case c.max-nc >= NONCE_COUNT_WINDOW:
+		// too old to tell if it was used
+		return false, false
+	default:
+		bit := uint64(1) << (c.max - nc)
+
+		if c.seen&bit != 0 {
+			// replayed response
+			return false, false
+		}
+
+		c.seen |= bit
+	}
+
+	return true, false
+}
+
+// Prune removes the nonce counts of expired nonces
+func (s *Server) Prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for nonce, c := range s.counts {
+		if s.now().Sub(c.issued) > s.lifetime {
+			delete(s.counts, nonce)
+		}
+	}
+}
+
+// nonce is the issue time and some random bytes, signed by the server with the realm (so no state is kept until the
+// nonce is used)
+func (s *Server) nonce(realm string) string {
+	b := make([]byte, 8+nonceRandomSize)
+
+	binary.BigEndian.PutUint64(b, uint64(s.now().UnixNano()))
+
+	if _, err := rand.Read(b[8:]); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(append(b, s.mac(b, realm)...))
+}
+
+func (s *Server) verifyNonce(nonce string, realm string) (time.Time, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+
+	if err != nil || len(b) != 8+nonceRandomSize+nonceMacSize {
+		return time.Time{}, false
+	}
+
+	data, mac := b[:8+nonceRandomSize], b[8+nonceRandomSize:]
+
+	if !hmac.Equal(mac, s.mac(data, realm)) {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, int64(binary.BigEndian.Uint64(data))), true
+}
+
+func (s *Server) mac(data []byte, realm string) []byte {
+	m := hmac.New(sha256.New, s.key)
+	m.Write(data)
+	m.Write([]byte(realm))
+
+	return m.Sum(nil)[:nonceMacSize]
+}
+
+// Parse parses the value of a `Digest` (Proxy-)Authorization header
+func Parse(header string) (Response, error) {
+	var r Response
+
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Digest ") {
+		return r, errors.New("not a digest authorization")
+	}
+
+	params, err := parseParams(header[7:])
+
+	if err != nil {
+		return r, err
+	}
+
+	r = Response{
+		Username:  params["username"],
+		Realm:     params["realm"],
+		Nonce:     params["nonce"],
+		URI:       params["uri"],
+		Algorithm: params["algorithm"],
+		QOP:       params["qop"],
+		NC:        params["nc"],
+		CNonce:    params["cnonce"],
+		Response:  params["response"],
+	}
+
+	if r.Algorithm == "" {
+		r.Algorithm = ALGORITHM_MD5
+	}
+
+	if r.Username == "" || r.Nonce == "" || r.Response == "" || r.QOP != QOP_AUTH || r.NC == "" || r.CNonce == "" {
+		return r, errors.New("incomplete digest authorization")
+	}
+
+	if newHash(r.Algorithm) == nil {
+		return r, errors.New("unsupported digest algorithm (" + r.Algorithm + ")")
+	}
+
+	return r, nil
+}
+
+// HA1 returns the hash of the user's credentials.  Returns "" for an unsupported algorithm
+func HA1(algorithm string, username string, realm string, password string) string {
+	return hashHex(algorithm, username+":"+realm+":"+password)
+}
+
+// Verify returns true when the response was created with the credentials hashed in `ha1`
+func (r Response) Verify(method string, ha1 string) bool {
+	ha2 := hashHex(r.Algorithm, method+":"+r.URI)
+	expected := hashHex(r.Algorithm, ha1+":"+r.Nonce+":"+r.NC+":"+r.CNonce+":"+r.QOP+":"+ha2)
+
+	return ha1 != "" && expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(r.Response))) == 1
+}
+
+// VerifyPassword returns true when the response was created with the password
+func (r Response) VerifyPassword(method string, password string) bool {
+	return password != "" && r.Verify(method, HA1(r.Algorithm, r.Username, r.Realm, password))
+}
+
+// Authorization returns the `Digest` (Proxy-)Authorization header value a client would send in reply to the challenge
+// (with a nonce count of 1).  Returns "" for an invalid challenge or an unsupported algorithm
+func Authorization(challenge string, method string, uri string, username string, password string) string {
+	if len(challenge) < 7 || !strings.EqualFold(challenge[:7], "Digest ") {
+		return ""
+	}
+
+	params, err := parseParams(challenge[7:])
+
+	if err != nil {
+		return ""
+	}
+
+	algorithm := params["algorithm"]
+
+	if algorithm == "" {
+		algorithm = ALGORITHM_MD5
+	}
+
+	r := Response{
+		Username:  username,
+		Realm:     params["realm"],
+		Nonce:     params["nonce"],
+		URI:       uri,
+		Algorithm: algorithm,
+		QOP:       QOP_AUTH,
+		NC:        "00000001",
+		CNonce:    "cnonce",
+	}
+
+	ha1 := HA1(r.Algorithm, r.Username, r.Realm, password)
+	ha2 := hashHex(r.Algorithm, method+":"+r.URI)
+
+	if ha1 == "" {
+		return ""
+	}
+
+	r.Response = hashHex(r.Algorithm, ha1+":"+r.Nonce+":"+r.NC+":"+r.CNonce+":"+r.QOP+":"+ha2)
+
+	return "Digest username=\"" + r.Username + "\", realm=\"" + r.Realm + "\", uri=\"" + r.URI + "\", algorithm=" + r.Algorithm +
+		", nonce=\"" + r.Nonce + "\", nc=" + r.NC + ", cnonce=\"" + r.CNonce + "\", qop=" + r.QOP + ", response=\"" + r.Response + "\""
+}
+
+func newHash(algorithm string) hash.Hash {
+	switch strings.ToUpper(algorithm) {
+	case ALGORITHM_SHA256:
+		return sha256.New()
+	case ALGORITHM_MD5:
+		return md5.New()
+	}
+
+	return nil
+}
+
+func hashHex(algorithm string, s string) string {
+	h := newHash(algorithm)
+
+	if h == nil {
+		return ""
+	}
+
+	h.Write([]byte(s))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// parseParams parses a comma separated list of `key=value` or `key="quoted value"` pairs
+func parseParams(s string) (map[string]string, error) {
+	params := make(map[string]string)
+
+	for {
+		s = strings.TrimLeft(s, " \t,")
+
+		if s == "" {
+			return params, nil
+		}
+
+		eq := strings.IndexByte(s, '=')
+
+		if eq <= 0 {
+			return nil, errors.New("malformed digest parameter")
+		}
+
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var value string
+
+		if strings.HasPrefix(s, "\"") {
+			var b strings.Builder
+
+			i := 1
+
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+
+				b.WriteByte(s[i])
+			}
+
+			if i >= len(s) {
+				return nil, errors.New("unterminated quoted digest parameter")
+			}
+
+			value = b.String()
+			s = s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+
+			if end < 0 {
+				end = len(s)
+			}
+
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+
+		params[key] = value
+	}
+}
@@ -0,0 +1,164 @@
+package digest
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 7616 section 3.9.1
+const exampleHeader = `Digest username="Mufasa", realm="http-auth@example.org", uri="/dir/index.html", algorithm=%s, ` +
+	`nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", nc=00000001, cnonce="f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", ` +
+	`qop=auth, response="%s", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`
+
+func TestResponse_Verify(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		response  string
+	}{
+		{ALGORITHM_SHA256, "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+		{ALGORITHM_MD5, "8ca523f5e9506fed4657c9700eebdbec"},
+	}
+
+	for _, tt := range tests {
+		r, err := Parse(strings.Replace(strings.Replace(exampleHeader, "%s", tt.algorithm, 1), "%s", tt.response, 1))
+
+		if err != nil {
+			t.Fatalf("Parse() error = %v", err)
+		}
+
+		if r.Username != "Mufasa" || r.URI != "/dir/index.html" || r.NC != "00000001" {
+			t.Errorf("unexpected parsed response: %v", r)
+		}
+
+		if !r.VerifyPassword("GET", "Circle of Life") {
+			t.Errorf("%v: expected the password to match", tt.algorithm)
+		}
+
+		if r.VerifyPassword("GET", "Circle of Death") || r.VerifyPassword("POST", "Circle of Life") || r.VerifyPassword("GET", "") {
+			t.Errorf("%v: expected a wrong password or method to be rejected", tt.algorithm)
+		}
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	s := NewServer()
+
+	// a new nonce for each algorithm, as the challenges for a realm share one
+	for i := range algorithms {
+		challenge := s.Challenges("pc-proxy", true)[i]
+		r, err := Parse(Authorization(challenge, "CONNECT", "example.com:443", "alice", "secret"))
+
+		if err != nil {
+			t.Fatalf("Parse() error = %v", err)
+		}
+
+		if ok, _ := s.Use(r); !ok || r.Username != "alice" || r.Realm != "pc-proxy" {
+			t.Errorf("expected the authorization to answer the challenge, got %v", r)
+		}
+
+		if !r.VerifyPassword("CONNECT", "secret") || r.VerifyPassword("CONNECT", "guess") {
+			t.Errorf("expected the authorization to be created with the password, got %v", r)
+		}
+	}
+
+	if a := Authorization(`Basic realm="pc-proxy"`, "CONNECT", "example.com:443", "alice", "secret"); a != "" {
+		t.Errorf("expected no authorization for a basic challenge, got %v", a)
+	}
+}
+
+func TestParse(t *testing.T) {
+	invalid := []string{
+		"Basic dXNlcjpwYXNz",
+		`Digest username="a", nonce="n", nc=00000001, cnonce="c", response="r"`,                           // missing qop
+		`Digest username="a", nonce="n", nc=00000001, cnonce="c", qop=auth, response="r", algorithm=SHA1`, // unsupported algorithm
+		`Digest username="a, nonce="n"`,
+	}
+
+	for _, h := range invalid {
+		if _, err := Parse(h); err == nil {
+			t.Errorf("expected an error for %v", h)
+		}
+	}
+
+	r, err := Parse(`Digest username="a \"quoted\" name", nonce="n", nc=00000001, cnonce="c", qop=auth, response="r"`)
+
+	if err != nil || r.Username != `a "quoted" name` || r.Algorithm != ALGORITHM_MD5 {
+		t.Errorf("unexpected parsed response: %v (%v)", r, err)
+	}
+}
+
+func TestServer_Use(t *testing.T) {
+	now := time.Now()
+	s := newServer(time.Minute, func() time.Time { return now })
+
+	challenges := s.Challenges("pc-proxy", false)
+
+	if len(challenges) != 2 || !strings.Contains(challenges[0], "algorithm=SHA-256") || !strings.Contains(challenges[1], "algorithm=MD5") {
+		t.Fatalf("expected a SHA-256 and an MD5 challenge, got %v", challenges)
+	}
+
+	nonce := strings.TrimSuffix(challenges[0][strings.Index(challenges[0], `nonce="`)+7:], `"`)
+
+	use := func(nonce string, nc string) bool {
+		ok, _ := s.Use(Response{Realm: "pc-proxy", Nonce: nonce, NC: nc})
+		return ok
+	}
+
+	if !use(nonce, "00000001") {
+		t.Error("expected the nonce to be accepted")
+	}
+
+	if use(nonce, "00000001") {
+		t.Error("expected a replayed nonce count to be rejected")
+	}
+
+	if ok, _ := s.Use(Response{Realm: "other", Nonce: nonce, NC: "00000002"}); ok {
+		t.Error("expected the nonce to be rejected for a realm it wasn't issued for")
+	}
+
+	if !use(nonce, "00000003") {
+		t.Error("expected a later nonce count to be accepted")
+	}
+
+	// requests on other connections can arrive out of order
+	if !use(nonce, "00000002") {
+		t.Error("expected an unused earlier nonce count to be accepted")
+	}
+
+	if use(nonce, "00000002") || use(nonce, "00000003") {
+		t.Error("expected replayed nonce counts to be rejected")
+	}
+
+	if use("forged"+nonce[6:], "00000004") {
+		t.Error("expected a forged nonce to be rejected")
+	}
+
+	if !use(nonce, "00000100") {
+		t.Error("expected the nonce to be accepted")
+	}
+
+	if use(nonce, "00000004") {
+		t.Error("expected a nonce count outside the window to be rejected")
+	}
+
+	if !use(nonce, "000000ff") {
+		t.Error("expected a nonce count inside the window to be accepted")
+	}
+
+	now = now.Add(time.Minute * 2)
+
+	if ok, stale := s.Use(Response{Realm: "pc-proxy", Nonce: nonce, NC: "00000101"}); ok || !stale {
+		t.Error("expected an expired nonce to be stale")
+	}
+
+	s.Prune()
+
+	if len(s.counts) != 0 {
+		t.Errorf("expected expired nonces to be pruned, got %v", s.counts)
+	}
+
+	if !strings.Contains(s.Challenges("pc-proxy", true)[0], "stale=true") {
+		t.Error("expected a stale challenge")
+	}
+}
@@ -0,0 +1,374 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	TYPE_A    = 1
+	TYPE_SOA  = 6
+	TYPE_AAAA = 28
+
+	CLASS_IN = 1
+
+	RCODE_NOERROR  = 0
+	RCODE_FORMERR  = 1
+	RCODE_SERVFAIL = 2
+	RCODE_NXDOMAIN = 3
+
+	HEADER_LEN = 12
+
+	// the largest message (over TCP, or UDP with EDNS)
+	MAX_MESSAGE_LEN = 65535
+
+	flagResponse           = 0x8000
+	flagRecursionDesired   = 0x0100
+	flagRecursionAvailable = 0x0080
+	maskOpcode             = 0x7800
+
+	// the most compression pointers followed in a name (pointers can loop forever)
+	maxPointers = 64
+)
+
+var (
+	ErrShortMessage = errors.New("DNS message is too short")
+	ErrNoQuestion   = errors.New("DNS message has no question")
+	ErrName         = errors.New("invalid name in DNS message")
+	errIdMismatch   = errors.New("DNS response doesn't match the query")
+)
+
+// Question is the first question of a query
+type Question struct {
+	Name  string // lower case, without the trailing dot
+	Type  uint16
+	Class uint16
+	end   int // the offset of the end of the question in the message
+}
+
+// Handler answers a query.  A nil response drops the query
+type Handler func(query []byte, remote net.Addr, tcp bool) []byte
+
+// ParseQuestion returns the first question of a query
+func ParseQuestion(msg []byte) (Question, error) {
+	var q Question
+
+	if len(msg) < HEADER_LEN {
+		return q, ErrShortMessage
+	}
+
+	if binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return q, ErrNoQuestion
+	}
+
+	name, offset, err := readName(msg, HEADER_LEN)
+
+	if err != nil {
+		return q, err
+	}
+
+	if offset+4 > len(msg) {
+		return q, ErrShortMessage
+	}
+
+	q.Name = name
+	q.Type = binary.BigEndian.Uint16(msg[offset : offset+2])
+	q.Class = binary.BigEndian.Uint16(msg[offset+2 : offset+4])
+	q.end = offset + 4
+
+	return q, nil
+}
+
+// Response returns the answer to a query with the rcode and the addresses (only the addresses of the question's type are
+// included, so a query for another type gets an empty answer)
+func Response(query []byte, q Question, rcode int, addrs []net.IP, ttl time.Duration) []byte {
+	flags := binary.BigEndian.Uint16(query[2:4])
+	flags = flagResponse | flags&(maskOpcode|flagRecursionDesired) | flagRecursionAvailable | uint16(rcode&0x0f)
+
+	var answers [][]byte
+
+	for _, ip := range addrs {
+		var data []byte
+
+		switch {
+		case q.Type == TYPE_A && ip.To4() != nil:
+			data = ip.To4()
+		case q.Type == TYPE_AAAA && ip.To4() == nil && ip.To16() != nil:
+			data = ip.To16()
+		default:
+			continue
+		}
+
+		// the name is a pointer to the question's name
+		answer := []byte{0xc0, HEADER_LEN}
+		answer = appendUint16(answer, q.Type)
+		answer = appendUint16(answer, CLASS_IN)
+		answer = appendUint32(answer, uint32(ttl/time.Second))
+		answer = appendUint16(answer, uint16(len(data)))
+		answer = append(answer, data...)
+
+		answers = append(answers, answer)
+	}
+
+	msg := append([]byte{}, query[0:2]...)
+	msg = appendUint16(msg, flags)
+	msg = appendUint16(msg, 1)
+	msg = appendUint16(msg, uint16(len(answers)))
+	msg = appendUint16(msg, 0)
+	msg = appendUint16(msg, 0)
+	msg = append(msg, query[HEADER_LEN:q.end]...)
+
+	for _, answer := range answers {
+		msg = append(msg, answer...)
+	}
+
+	return msg
+}
+
+// NegativeResponse returns an answer without addresses (NXDOMAIN, or an empty NOERROR answer) with an SOA record for the
+// question's name in the authority section.  Resolvers only cache negative answers with an SOA record, for the SOA's TTL
+// (RFC 2308)
+func NegativeResponse(query []byte, q Question, rcode int, ttl time.Duration) []byte {
+	msg := Response(query, q, rcode, nil, 0)
+
+	// NSCOUNT
+	binary.BigEndian.PutUint16(msg[8:10], 1)
+
+	secs := uint32(ttl / time.Second)
+
+	// the owner and the primary name server are pointers to the question's name
+	soa := []byte{0xc0, HEADER_LEN}
+	soa = appendUint16(soa, TYPE_SOA)
+	soa = appendUint16(soa, CLASS_IN)
+	soa = appendUint32(soa, secs)
+
+	rdata := []byte{0xc0, HEADER_LEN}
+	rdata = append(append(rdata, byte(len("hostmaster"))), "hostmaster"...)
+	rdata = append(rdata, 0xc0, HEADER_LEN)
+	rdata = appendUint32(rdata, 1)    // serial
+	rdata = appendUint32(rdata, secs) // refresh
+	rdata = appendUint32(rdata, secs) // retry
+	rdata = appendUint32(rdata, secs) // expire
+	rdata = appendUint32(rdata, secs) // minimum (the negative caching TTL)
+
+	soa = appendUint16(soa, uint16(len(rdata)))
+	soa = append(soa, rdata...)
+
+	return append(msg, soa...)
+}
+
+// ErrorResponse returns an empty answer with the rcode, for queries that can't be answered
+func ErrorResponse(query []byte, rcode int) []byte {
+	if len(query) < HEADER_LEN {
+		return nil
+	}
+
+	if q, err := ParseQuestion(query); err == nil {
+		return Response(query, q, rcode, nil, 0)
+	}
+
+	flags := binary.BigEndian.Uint16(query[2:4])
+	flags = flagResponse | flags&(maskOpcode|flagRecursionDesired) | flagRecursionAvailable | uint16(rcode&0x0f)
+
+	msg := append([]byte{}, query[0:2]...)
+	msg = appendUint16(msg, flags)
+
+	return append(msg, make([]byte, 8)...)
+}
+
+// Forward sends the query to the upstream resolver (host:port) and returns its response
+func Forward(query []byte, upstream string, tcp bool, timeout time.Duration) ([]byte, error) {
+	network := "udp"
+
+	if tcp {
+		network = "tcp"
+	}
+
+	conn, err := net.DialTimeout(network, upstream, timeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	var resp []byte
+
+	if tcp {
+		if err := WriteTCP(conn, query); err != nil {
+			return nil, err
+		}
+
+		if resp, err = ReadTCP(conn); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, MAX_MESSAGE_LEN)
+
+		n, err := conn.Read(buf)
+
+		if err != nil {
+			return nil, err
+		}
+
+		resp = buf[:n]
+	}
+
+	if len(resp) < HEADER_LEN || resp[0] != query[0] || resp[1] != query[1] {
+		return nil, errIdMismatch
+	}
+
+	return resp, nil
+}
+
+// ReadTCP reads a length prefixed message
+func ReadTCP(r io.Reader) ([]byte, error) {
+	length := make([]byte, 2)
+
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(length))
+
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// WriteTCP writes a length prefixed message
+func WriteTCP(w io.Writer, msg []byte) error {
+	_, err := w.Write(append(appendUint16(nil, uint16(len(msg))), msg...))
+
+	return err
+}
+
+// ServeUDP answers the queries received on the connection until it is closed
+func ServeUDP(conn net.PacketConn, handler Handler) {
+	buf := make([]byte, MAX_MESSAGE_LEN)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+
+			return
+		}
+
+		query := append([]byte{}, buf[:n]...)
+
+		go func() {
+			if resp := handler(query, addr, false); resp != nil {
+				_, _ = conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+// ServeTCP answers the queries of the connections accepted by the listener until it is closed.  Connections are closed
+// when they are idle for `idleTimeout`
+func ServeTCP(l net.Listener, handler Handler, idleTimeout time.Duration) {
+	for {
+		conn, err := l.Accept()
+
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(time.Millisecond * 100)
+				continue
+			}
+
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			for {
+				_ = conn.SetDeadline(time.Now().Add(idleTimeout))
+
+				query, err := ReadTCP(conn)
+
+				if err != nil {
+					return
+				}
+
+				resp := handler(query, conn.RemoteAddr(), true)
+
+				if resp == nil || WriteTCP(conn, resp) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// readName reads a (possibly compressed) name, returning it and the offset after it
+func readName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+
+	end := -1
+	pointers := 0
+
+	for {
+		if offset >= len(msg) {
+			return "", 0, ErrShortMessage
+		}
+
+		length := int(msg[offset])
+
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+
+			return strings.ToLower(strings.Join(labels, ".")), end, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) {
+				return "", 0, ErrShortMessage
+			}
+
+			if pointers++; pointers > maxPointers {
+				return "", 0, ErrName
+			}
+
+			if end < 0 {
+				end = offset + 2
+			}
+
+			offset = int(binary.BigEndian.Uint16(msg[offset:offset+2]) & 0x3fff)
+		case length&0xc0 != 0:
+			return "", 0, ErrName
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, ErrShortMessage
+			}
+
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
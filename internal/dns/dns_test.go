@@ -0,0 +1,160 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// query returns a query for the name with the ID 0x1234 and recursion desired
+func TestNegativeResponse(t *testing.T) {
+	msg := query("blocked.example.com", TYPE_A)
+	q, _ := ParseQuestion(msg)
+
+	resp := NegativeResponse(msg, q, RCODE_NXDOMAIN, time.Minute)
+
+	if flags := binary.BigEndian.Uint16(resp[2:4]); int(flags&0x0f) != RCODE_NXDOMAIN {
+		t.Errorf("flags = %016b, want rcode %v", flags, RCODE_NXDOMAIN)
+	}
+
+	if answers, authority := binary.BigEndian.Uint16(resp[6:8]), binary.BigEndian.Uint16(resp[8:10]); answers != 0 || authority != 1 {
+		t.Fatalf("answers = %v, authority = %v, want 0 and 1", answers, authority)
+	}
+
+	soa := resp[q.end:]
+
+	if !bytes.HasPrefix(soa, []byte{0xc0, HEADER_LEN, 0, TYPE_SOA, 0, CLASS_IN, 0, 0, 0, 60}) {
+		t.Errorf("authority = %x, want an SOA record for the question's name with a TTL of 60", soa)
+	}
+
+	if rdlen := int(binary.BigEndian.Uint16(soa[10:12])); rdlen != len(soa)-12 || !bytes.HasSuffix(soa, []byte{0, 0, 0, 60}) {
+		t.Errorf("authority = %x, want an SOA record with a minimum TTL of 60", soa)
+	}
+}
+
+func query(name string, qtype uint16) []byte {
+	msg := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+
+	for _, label := range strings.Split(name, ".") {
+		msg = append(append(msg, byte(len(label))), label...)
+	}
+
+	msg = append(msg, 0)
+	msg = appendUint16(msg, qtype)
+
+	return appendUint16(msg, CLASS_IN)
+}
+
+func TestParseQuestion(t *testing.T) {
+	q, err := ParseQuestion(query("WWW.Example.com", TYPE_AAAA))
+
+	if err != nil {
+		t.Fatalf("ParseQuestion() error = %v", err)
+	}
+
+	if q.Name != "www.example.com" || q.Type != TYPE_AAAA || q.Class != CLASS_IN {
+		t.Errorf("ParseQuestion() = %+v, want www.example.com AAAA IN", q)
+	}
+
+	loop := []byte{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, HEADER_LEN, 0, 1, 0, 1}
+
+	for name, msg := range map[string][]byte{"short": {0, 1, 0}, "truncated": query("example.com", TYPE_A)[:20], "pointer loop": loop} {
+		if _, err := ParseQuestion(msg); err == nil {
+			t.Errorf("%v: ParseQuestion() error = nil, want an error", name)
+		}
+	}
+}
+
+func TestResponse(t *testing.T) {
+	sinkhole := []net.IP{net.ParseIP("10.0.0.1")}
+
+	tests := []struct {
+		name        string
+		qtype       uint16
+		rcode       int
+		wantAnswers uint16
+	}{
+		{name: "nxdomain", qtype: TYPE_A, rcode: RCODE_NXDOMAIN},
+		{name: "sinkhole", qtype: TYPE_A, rcode: RCODE_NOERROR, wantAnswers: 1},
+		{name: "sinkhole other type", qtype: TYPE_AAAA, rcode: RCODE_NOERROR},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := query("blocked.example.com", tt.qtype)
+			q, _ := ParseQuestion(msg)
+
+			var addrs []net.IP
+
+			if tt.rcode == RCODE_NOERROR {
+				addrs = sinkhole
+			}
+
+			resp := Response(msg, q, tt.rcode, addrs, time.Minute)
+
+			if resp[0] != 0x12 || resp[1] != 0x34 {
+				t.Errorf("ID = %x, want 1234", resp[0:2])
+			}
+
+			flags := binary.BigEndian.Uint16(resp[2:4])
+
+			if flags&flagResponse == 0 || flags&flagRecursionDesired == 0 || int(flags&0x0f) != tt.rcode {
+				t.Errorf("flags = %016b, want a response with rcode %v", flags, tt.rcode)
+			}
+
+			if answers := binary.BigEndian.Uint16(resp[6:8]); answers != tt.wantAnswers {
+				t.Fatalf("answers = %v, want %v", answers, tt.wantAnswers)
+			}
+
+			if rq, err := ParseQuestion(resp); err != nil || rq.Name != "blocked.example.com" {
+				t.Errorf("question = %+v, %v, want the query's question", rq, err)
+			}
+
+			if tt.wantAnswers > 0 && !bytes.HasSuffix(resp, []byte{0, 0, 0, 60, 0, 4, 10, 0, 0, 1}) {
+				t.Errorf("answer = %x, want 10.0.0.1 with a TTL of 60", resp[q.end:])
+			}
+		})
+	}
+}
+
+func TestForward(t *testing.T) {
+	// a stub resolver that answers every query with NXDOMAIN
+	handler := func(query []byte, remote net.Addr, tcp bool) []byte {
+		return ErrorResponse(query, RCODE_NXDOMAIN)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+
+	defer pc.Close()
+
+	go ServeUDP(pc, handler)
+
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	defer l.Close()
+
+	go ServeTCP(l, handler, time.Second*5)
+
+	for _, tcp := range []bool{false, true} {
+		resp, err := Forward(query("example.com", TYPE_A), pc.LocalAddr().String(), tcp, time.Second*5)
+
+		if err != nil {
+			t.Fatalf("tcp %v: Forward() error = %v", tcp, err)
+		}
+
+		if rcode := binary.BigEndian.Uint16(resp[2:4]) & 0x0f; rcode != RCODE_NXDOMAIN {
+			t.Errorf("tcp %v: rcode = %v, want %v", tcp, rcode, RCODE_NXDOMAIN)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package lease
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FORMAT_DNSMASQ = "dnsmasq"
+	FORMAT_ISC     = "isc"
+
+	DEFAULT_LEASE_FILE = "/var/lib/misc/dnsmasq.leases"
+
+	// how often the lease file is checked for changes
+	LEASE_CHECK_INTERVAL = time.Second * 5
+)
+
+// Lease is a DHCP lease with a host name
+type Lease struct {
+	IP       string
+	MAC      string
+	Hostname string
+}
+
+// Table maps IP and MAC addresses to host names using a DHCP server's lease file.  The file is read again when it changes
+type Table struct {
+	path    string
+	format  string
+	mu      sync.Mutex
+	byIP    map[string]string
+	byMAC   map[string]string
+	modTime time.Time
+	size    int64
+	checked time.Time
+	err     error
+	now     func() time.Time
+}
+
+func New(path string, format string) (*Table, error) {
+	return newTable(path, format, time.Now)
+}
+
+func newTable(path string, format string, now func() time.Time) (*Table, error) {
+	if format != FORMAT_DNSMASQ && format != FORMAT_ISC {
+		return nil, errors.New("unsupported lease file format (" + format + ").  Must be \"" + FORMAT_DNSMASQ + "\" or \"" + FORMAT_ISC + "\"")
+	}
+
+	if path == "" {
+		path = DEFAULT_LEASE_FILE
+	}
+
+	return &Table{
+		path:   path,
+		format: format,
+		now:    now,
+	}, nil
+}
+
+// Lookup returns the host name of the client, by MAC address (which changes less often) and then by IP address.  An error
+// is returned when the lease file can't be read
+func (t *Table) Lookup(ip string, mac string) (string, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.byIP == nil || t.now().Sub(t.checked) >= LEASE_CHECK_INTERVAL {
+		t.refresh()
+	}
+
+	if name, ok := t.byMAC[mac]; ok && mac != "" {
+		return name, true, t.err
+	}
+
+	name, ok := t.byIP[ip]
+
+	return name, ok, t.err
+}
+
+// refresh reads the lease file when it changed since it was last read
+func (t *Table) refresh() {
+	t.checked = t.now()
+
+	info, err := os.Stat(t.path)
+
+	if err != nil {
+		t.byIP, t.byMAC, t.err = map[string]string{}, map[string]string{}, err
+		return
+	}
+
+	if t.byIP != nil && t.err == nil && info.ModTime().Equal(t.modTime) && info.Size() == t.size {
+		return
+	}
+
+	f, err := os.Open(t.path)
+
+	if err != nil {
+		t.byIP, t.byMAC, t.err = map[string]string{}, map[string]string{}, err
+		return
+	}
+
+	defer f.Close()
+
+	var leases []Lease
+
+	if t.format == FORMAT_ISC {
+		leases, err = ParseISC(f)
+	} else {
+		leases, err = ParseDnsmasq(f)
+	}
+
+	if err != nil {
+		t.byIP, t.byMAC, t.err = map[string]string{}, map[string]string{}, err
+		return
+	}
+
+	t.byIP, t.byMAC, t.err = make(map[string]string), make(map[string]string), nil
+	t.modTime, t.size = info.ModTime(), info.Size()
+
+	for _, l := range leases {
+		t.byIP[l.IP] = l.Hostname
+
+		if l.MAC != "" {
+			t.byMAC[l.MAC] = l.Hostname
+		}
+	}
+}
+
+// ParseDnsmasq reads the dnsmasq format: `<expiry> <mac> <ip> <hostname> <client id>` (the hostname is `*` when unknown)
+func ParseDnsmasq(r io.Reader) ([]Lease, error) {
+	var leases []Lease
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) < 4 || fields[3] == "*" || net.ParseIP(fields[2]) == nil {
+			continue
+		}
+
+		leases = append(leases, Lease{IP: fields[2], MAC: normalizeMAC(fields[1]), Hostname: fields[3]})
+	}
+
+	return leases, scanner.Err()
+}
+
+// ParseISC reads the ISC dhcpd `dhcpd.leases` format.  Later leases for an address replace earlier ones, free leases are ignored
+// (and remove the earlier leases of their address)
+func ParseISC(r io.Reader) ([]Lease, error) {
+	var ips []string
+	var current *Lease
+
+	latest := make(map[string]*Lease)
+
+	free := false
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case strings.HasPrefix(line, "lease ") && strings.HasSuffix(line, "{"):
+			fields := strings.Fields(line)
+			current = &Lease{IP: fields[1]}
+			free = false
+		case current == nil:
+			continue
+		case line == "}":
+			if net.ParseIP(current.IP) != nil {
+				if _, ok := latest[current.IP]; !ok {
+					ips = append(ips, current.IP)
+				}
+
+				if current.Hostname != "" && !free {
+					latest[current.IP] = current
+				} else {
+					latest[current.IP] = nil
+				}
+			}
+
+			current = nil
+		case strings.HasPrefix(line, "binding state "):
+			free = strings.TrimSuffix(strings.TrimPrefix(line, "binding state "), ";") != "active"
+		case strings.HasPrefix(line, "hardware ethernet "):
+			current.MAC = normalizeMAC(strings.TrimSuffix(strings.TrimPrefix(line, "hardware ethernet "), ";"))
+		case strings.HasPrefix(line, "client-hostname "):
+			current.Hostname = strings.Trim(strings.TrimSuffix(strings.TrimPrefix(line, "client-hostname "), ";"), "\"")
+		}
+	}
+
+	var leases []Lease
+
+	for _, ip := range ips {
+		if l := latest[ip]; l != nil {
+			leases = append(leases, *l)
+		}
+	}
+
+	return leases, scanner.Err()
+}
+
+func normalizeMAC(s string) string {
+	mac, err := net.ParseMAC(s)
+
+	if err != nil {
+		return ""
+	}
+
+	return mac.String()
+}
@@ -0,0 +1,96 @@
+package lease
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTable_Lookup(t *testing.T) {
+	tests := []struct {
+		ip   string
+		mac  string
+		want string
+	}{
+		{"192.168.1.10", "", "kids-laptop"},
+		{"192.168.1.11", "", ""}, // no host name (dnsmasq) or a free lease (isc)
+		{"192.168.1.20", "", "tablet"},
+		{"192.168.1.30", "", ""}, // the lease was released (isc)
+		{"192.168.1.30", "aa:bb:cc:dd:ee:05", ""},
+		{"192.168.1.99", "aa:bb:cc:dd:ee:04", "tablet"}, // the MAC address is preferred
+		{"192.168.1.99", "", ""},
+	}
+
+	for _, format := range []string{FORMAT_DNSMASQ, FORMAT_ISC} {
+		path := filepath.Join("..", "..", "test", "dnsmasq.leases")
+
+		if format == FORMAT_ISC {
+			path = filepath.Join("..", "..", "test", "dhcpd.leases")
+		}
+
+		table, err := New(path, format)
+
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+
+		for _, tt := range tests {
+			name, ok, err := table.Lookup(tt.ip, tt.mac)
+
+			if err != nil {
+				t.Fatalf("%v: Lookup() error = %v", format, err)
+			}
+
+			if name != tt.want || ok != (tt.want != "") {
+				t.Errorf("%v: Lookup(%v, %v) = %v, %v, want %v", format, tt.ip, tt.mac, name, ok, tt.want)
+			}
+		}
+	}
+
+	if _, err := New("", "bind"); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
+
+func TestTable_Lookup_Changed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pc-proxy-lease")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dnsmasq.leases")
+
+	_ = ioutil.WriteFile(path, []byte("0 aa:bb:cc:dd:ee:01 10.0.0.1 laptop *\n"), 0644)
+
+	now := time.Now()
+	table, _ := newTable(path, FORMAT_DNSMASQ, func() time.Time { return now })
+
+	if name, _, _ := table.Lookup("10.0.0.1", ""); name != "laptop" {
+		t.Fatalf("expected the host name to be found, got %v", name)
+	}
+
+	// the device was renamed
+	_ = ioutil.WriteFile(path, []byte("0 aa:bb:cc:dd:ee:01 10.0.0.1 kids-laptop *\n"), 0644)
+
+	if name, _, _ := table.Lookup("10.0.0.1", ""); name != "laptop" {
+		t.Errorf("expected the file not to be checked again yet, got %v", name)
+	}
+
+	now = now.Add(LEASE_CHECK_INTERVAL)
+
+	if name, _, _ := table.Lookup("10.0.0.1", ""); name != "kids-laptop" {
+		t.Errorf("expected the changed file to be read again, got %v", name)
+	}
+
+	_ = os.Remove(path)
+	now = now.Add(LEASE_CHECK_INTERVAL)
+
+	if _, ok, err := table.Lookup("10.0.0.1", ""); ok || err == nil {
+		t.Error("expected an error when the lease file can't be read")
+	}
+}
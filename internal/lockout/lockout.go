@@ -0,0 +1,161 @@
+package lockout
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Config a `MaxFailures` of 0 disables lockouts
+type Config struct {
+	MaxFailures int           // failures allowed within `Window` before the client is locked out
+	Window      time.Duration // how long failures are remembered
+	Duration    time.Duration // length of the first lockout.  Each following lockout is twice as long
+	MaxDuration time.Duration // the longest lockout
+}
+
+// Tracker counts failed attempts per client and locks clients out with exponential backoff
+type Tracker struct {
+	mu      sync.Mutex
+	conf    Config
+	clients map[string]*clientState
+	now     func() time.Time
+}
+
+type clientState struct {
+	failures    []time.Time
+	lockouts    uint
+	lockedUntil time.Time
+	lastFailure time.Time
+}
+
+func New(conf Config) *Tracker {
+	return newTracker(conf, time.Now)
+}
+
+func newTracker(conf Config, now func() time.Time) *Tracker {
+	return &Tracker{
+		conf:    conf,
+		clients: map[string]*clientState{},
+		now:     now,
+	}
+}
+
+func (t *Tracker) SetConfig(conf Config) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.conf = conf
+}
+
+// LockedOut returns true (and when the lockout ends) while the client is locked out
+func (t *Tracker) LockedOut(client string) (bool, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.clients[client]
+
+	if !ok || !t.now().Before(c.lockedUntil) {
+		return false, time.Time{}
+	}
+
+	return true, c.lockedUntil
+}
+
+// Failure records a failed attempt.  It returns true (and when the lockout ends) when the failure locked the client out
+func (t *Tracker) Failure(client string) (bool, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conf.MaxFailures <= 0 {
+		return false, time.Time{}
+	}
+
+	now := t.now()
+	c, ok := t.clients[client]
+
+	if !ok {
+		c = &clientState{}
+		t.clients[client] = c
+	}
+
+	// forget the previous lockouts when the client has been quiet for longer than the longest lockout
+	if !c.lastFailure.IsZero() && now.Sub(c.lastFailure) > t.conf.Window+t.conf.MaxDuration {
+		c.lockouts = 0
+	}
+
+	c.lastFailure = now
+	c.failures = append(t.recentFailures(c, now), now)
+
+	if len(c.failures) < t.conf.MaxFailures {
+		return false, time.Time{}
+	}
+
+	c.lockedUntil = now.Add(t.lockoutDuration(c.lockouts))
+	c.lockouts++
+	c.failures = nil
+
+	return true, c.lockedUntil
+}
+
+// Success forgets the client's failures and lockouts
+func (t *Tracker) Success(client string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.clients, client)
+}
+
+// Prune forgets clients that are not locked out and haven't failed recently
+func (t *Tracker) Prune() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+
+	for client, c := range t.clients {
+		if now.Before(c.lockedUntil) {
+			continue
+		}
+
+		if now.Sub(c.lastFailure) > t.conf.Window+t.conf.MaxDuration {
+			delete(t.clients, client)
+		}
+	}
+}
+
+func (t *Tracker) recentFailures(c *clientState, now time.Time) []time.Time {
+	var recent []time.Time
+
+	for _, f := range c.failures {
+		if now.Sub(f) < t.conf.Window {
+			recent = append(recent, f)
+		}
+	}
+
+	return recent
+}
+
+func (t *Tracker) lockoutDuration(lockouts uint) time.Duration {
+	d := t.conf.Duration
+
+	for i := uint(0); i < lockouts; i++ {
+		if d > math.MaxInt64/2 {
+			// without a MaxDuration the lockout would overflow (a negative lockout would end right away)
+			d = math.MaxInt64
+			break
+		}
+
+		d *= 2
+
+		if t.conf.MaxDuration > 0 && d >= t.conf.MaxDuration {
+			break
+		}
+	}
+
+	if t.conf.MaxDuration > 0 && d > t.conf.MaxDuration {
+		return t.conf.MaxDuration
+	}
+
+	return d
+}
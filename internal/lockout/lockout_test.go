@@ -0,0 +1,143 @@
+package lockout
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestTracker_Failure(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	tr := newTracker(Config{MaxFailures: 3, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Minute * 3}, clock.now)
+
+	for i := 0; i < 2; i++ {
+		if locked, _ := tr.Failure("10.0.0.1"); locked {
+			t.Fatalf("failure %v: expected the client not to be locked out yet", i+1)
+		}
+	}
+
+	locked, until := tr.Failure("10.0.0.1")
+
+	if !locked || !until.Equal(clock.t.Add(time.Minute)) {
+		t.Fatalf("expected a 1 minute lockout, got %v until %v", locked, until)
+	}
+
+	if locked, _ := tr.LockedOut("10.0.0.1"); !locked {
+		t.Error("expected the client to be locked out")
+	}
+
+	if locked, _ := tr.LockedOut("10.0.0.2"); locked {
+		t.Error("expected other clients not to be locked out")
+	}
+
+	// each following lockout is twice as long, up to MaxDuration
+	for _, want := range []time.Duration{time.Minute * 2, time.Minute * 3, time.Minute * 3} {
+		clock.t = until
+
+		if locked, _ := tr.LockedOut("10.0.0.1"); locked {
+			t.Fatal("expected the lockout to end")
+		}
+
+		for i := 0; i < 3; i++ {
+			locked, until = tr.Failure("10.0.0.1")
+		}
+
+		if !locked || !until.Equal(clock.t.Add(want)) {
+			t.Errorf("expected a %v lockout, got %v", want, until.Sub(clock.t))
+		}
+	}
+}
+
+func TestTracker_Failure_Unlimited(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	tr := newTracker(Config{MaxFailures: 1, Window: time.Minute, Duration: time.Minute}, clock.now)
+
+	// without a MaxDuration the lockouts keep doubling, without overflowing
+	last := time.Duration(0)
+
+	for lockouts := uint(0); lockouts < 100; lockouts++ {
+		d := tr.lockoutDuration(lockouts)
+
+		if d < last {
+			t.Fatalf("lockout %v: expected %v to be at least %v", lockouts, d, last)
+		}
+
+		last = d
+	}
+
+	if last != math.MaxInt64 {
+		t.Errorf("expected the lockout to saturate, got %v", last)
+	}
+
+	// the client keeps failing (within the window, so the lockouts aren't forgotten)
+	for i := 0; i < 100; i++ {
+		if locked, until := tr.Failure("10.0.0.1"); !locked || !until.After(clock.t) {
+			t.Fatalf("lockout %v: expected the client to be locked out, got until %v", i+1, until)
+		}
+
+		clock.t = clock.t.Add(time.Second * 30)
+	}
+}
+
+func TestTracker_Failure_Window(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	tr := newTracker(Config{MaxFailures: 2, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Hour}, clock.now)
+
+	tr.Failure("10.0.0.1")
+
+	clock.t = clock.t.Add(time.Minute)
+
+	if locked, _ := tr.Failure("10.0.0.1"); locked {
+		t.Error("expected failures outside of the window to be forgotten")
+	}
+}
+
+func TestTracker_Success(t *testing.T) {
+	tr := New(Config{MaxFailures: 2, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Hour})
+
+	tr.Failure("10.0.0.1")
+	tr.Success("10.0.0.1")
+
+	if locked, _ := tr.Failure("10.0.0.1"); locked {
+		t.Error("expected a success to reset the failures")
+	}
+}
+
+func TestTracker_Disabled(t *testing.T) {
+	tr := New(Config{})
+
+	for i := 0; i < 100; i++ {
+		if locked, _ := tr.Failure("10.0.0.1"); locked {
+			t.Fatal("expected lockouts to be disabled")
+		}
+	}
+}
+
+func TestTracker_Prune(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	tr := newTracker(Config{MaxFailures: 1, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Hour}, clock.now)
+
+	tr.Failure("10.0.0.1")
+
+	tr.Prune()
+
+	if len(tr.clients) != 1 {
+		t.Error("expected locked out clients to be kept")
+	}
+
+	clock.t = clock.t.Add(time.Hour * 2)
+
+	tr.Prune()
+
+	if len(tr.clients) != 0 {
+		t.Error("expected quiet clients to be forgotten")
+	}
+}
@@ -0,0 +1,265 @@
+package mitm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	CA_COMMON_NAME = "pc-proxy local CA"
+	CA_VALIDITY    = time.Hour * 24 * 365 * 10
+
+	// browsers refuse leaf certificates valid for more than 398 days
+	LEAF_VALIDITY = time.Hour * 24 * 30
+	// leaf certificates are minted again when they expire within this time
+	LEAF_RENEW_BEFORE = time.Hour * 24
+
+	// the number of leaf certificates kept in memory
+	LEAF_CACHE_SIZE = 1024
+
+	CERT_FILE_PERMS = 0644
+	KEY_FILE_PERMS  = 0600
+)
+
+// CA mints leaf certificates for intercepted hosts.  Leaf certificates are cached by host name
+type CA struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+	mu      sync.Mutex
+	leaves  map[string]*tls.Certificate
+	now     func() time.Time
+}
+
+// LoadOrCreate loads the CA certificate and key (PEM files), generating them when both files are missing
+func LoadOrCreate(certFile string, keyFile string) (*CA, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		certPEM, keyPEM, err := Generate(CA_COMMON_NAME)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := ioutil.WriteFile(keyFile, keyPEM, KEY_FILE_PERMS); err != nil {
+			return nil, errors.New("error writing the CA key: " + err.Error())
+		}
+
+		if err := ioutil.WriteFile(certFile, certPEM, CERT_FILE_PERMS); err != nil {
+			return nil, errors.New("error writing the CA certificate: " + err.Error())
+		}
+
+		return New(certPEM, keyPEM)
+	}
+
+	certPEM, err := ioutil.ReadFile(certFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return New(certPEM, keyPEM)
+}
+
+// Generate returns a new self-signed CA certificate and its key (PEM encoded)
+func Generate(commonName string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := serialNumber()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(CA_VALIDITY),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+func New(certPEM []byte, keyPEM []byte) (*CA, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !cert.IsCA {
+		return nil, errors.New("the certificate is not a CA certificate")
+	}
+
+	key, ok := pair.PrivateKey.(crypto.Signer)
+
+	if !ok {
+		return nil, errors.New("unsupported CA key type")
+	}
+
+	return &CA{
+		cert:    cert,
+		certPEM: certPEM,
+		key:     key,
+		leaves:  make(map[string]*tls.Certificate),
+		now:     time.Now,
+	}, nil
+}
+
+// CertPEM returns the CA certificate, for clients to install
+func (ca *CA) CertPEM() []byte {
+	return ca.certPEM
+}
+
+// Certificate returns a leaf certificate for the host (a host name or an IP address)
+func (ca *CA) Certificate(host string) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	now := ca.now()
+
+	if leaf, ok := ca.leaves[host]; ok && now.Add(LEAF_RENEW_BEFORE).Before(leaf.Leaf.NotAfter) {
+		return leaf, nil
+	}
+
+	leaf, err := ca.mint(host, now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ca.leaves) >= LEAF_CACHE_SIZE {
+		// drop any certificate, they are cheap to mint again
+		for h := range ca.leaves {
+			delete(ca.leaves, h)
+			break
+		}
+	}
+
+	ca.leaves[host] = leaf
+
+	return leaf, nil
+}
+
+// TLSConfig returns the server config of intercepted connections.  Certificates are minted for the server name the
+// client sent, or for `host` when it didn't send one
+func (ca *CA) TLSConfig(host string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return ca.Certificate(hello.ServerName)
+			}
+
+			return ca.Certificate(host)
+		},
+		// intercepted requests are served by an HTTP/1.1 server
+		NextProtos: []string{"http/1.1"},
+	}
+}
+
+func (ca *CA) mint(host string, now time.Time) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := serialNumber()
+
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := now.Add(LEAF_VALIDITY)
+
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
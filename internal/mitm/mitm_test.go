@@ -0,0 +1,94 @@
+package mitm
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadOrCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mitm")
+
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "ca.pem")
+	keyFile := filepath.Join(dir, "ca-key.pem")
+
+	created, err := LoadOrCreate(certFile, keyFile)
+
+	if err != nil {
+		t.Fatalf("LoadOrCreate() error = %v", err)
+	}
+
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != KEY_FILE_PERMS {
+		t.Errorf("key file = %v, %v, want mode %v", info, err, os.FileMode(KEY_FILE_PERMS))
+	}
+
+	loaded, err := LoadOrCreate(certFile, keyFile)
+
+	if err != nil {
+		t.Fatalf("LoadOrCreate() error = %v", err)
+	}
+
+	if string(loaded.CertPEM()) != string(created.CertPEM()) {
+		t.Error("expected the saved CA to be loaded")
+	}
+
+	// a missing key isn't replaced, the certificate installed on clients would stop working
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadOrCreate(certFile, keyFile); err == nil {
+		t.Error("LoadOrCreate() error = nil, want an error for a missing key")
+	}
+}
+
+func TestCA_Certificate(t *testing.T) {
+	certPEM, keyPEM, err := Generate(CA_COMMON_NAME)
+
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	ca, err := New(certPEM, keyPEM)
+
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	for _, host := range []string{"www.example.com", "192.168.1.1"} {
+		leaf, err := ca.Certificate(host)
+
+		if err != nil {
+			t.Fatalf("Certificate(%v) error = %v", host, err)
+		}
+
+		if _, err := leaf.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("Verify(%v) error = %v", host, err)
+		}
+	}
+
+	first, _ := ca.Certificate("www.example.com")
+
+	if again, _ := ca.Certificate("www.example.com"); again != first {
+		t.Error("expected the cached certificate")
+	}
+
+	// certificates close to expiring are minted again
+	ca.now = func() time.Time { return time.Now().Add(LEAF_VALIDITY) }
+
+	if renewed, _ := ca.Certificate("www.example.com"); renewed == first {
+		t.Error("expected a new certificate")
+	}
+}
@@ -0,0 +1,56 @@
+package pac
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	CONTENT_TYPE = "application/x-ns-proxy-autoconfig"
+)
+
+// Generate creates a proxy auto-config file that sends every request to the proxy at `proxyAddr` (`host:port`), except
+// requests to the direct hosts.  Direct hosts are IPv4 CIDRs (`192.168.0.0/16`) or shell expressions matched against the
+// host (`localhost`, `*.lan`, `192.168.1.1`).  There is no fallback to a direct connection when the proxy is down
+func Generate(proxyAddr string, direct []string) (string, error) {
+	var conditions []string
+
+	for _, d := range direct {
+		d = strings.TrimSpace(d)
+
+		if d == "" {
+			continue
+		}
+
+		if !strings.Contains(d, "/") {
+			conditions = append(conditions, "shExpMatch(host, "+strconv.Quote(d)+")")
+			continue
+		}
+
+		ip, network, err := net.ParseCIDR(d)
+
+		if err != nil {
+			return "", errors.New("invalid direct host (" + d + "): " + err.Error())
+		}
+
+		if ip.To4() == nil {
+			return "", errors.New("invalid direct host (" + d + ").  Only IPv4 networks are supported")
+		}
+
+		conditions = append(conditions, "isInNet(host, "+strconv.Quote(network.IP.String())+", "+strconv.Quote(net.IP(network.Mask).String())+")")
+	}
+
+	var b strings.Builder
+
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+
+	for _, c := range conditions {
+		b.WriteString("  if (" + c + ") {\n    return \"DIRECT\";\n  }\n\n")
+	}
+
+	b.WriteString("  return " + strconv.Quote("PROXY "+proxyAddr) + ";\n}\n")
+
+	return b.String(), nil
+}
@@ -0,0 +1,44 @@
+package pac
+
+import (
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	got, err := Generate("proxy.lan:3128", []string{"localhost", "*.lan", "192.168.0.0/16"})
+
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	want := `function FindProxyForURL(url, host) {
+  if (shExpMatch(host, "localhost")) {
+    return "DIRECT";
+  }
+
+  if (shExpMatch(host, "*.lan")) {
+    return "DIRECT";
+  }
+
+  if (isInNet(host, "192.168.0.0", "255.255.0.0")) {
+    return "DIRECT";
+  }
+
+  return "PROXY proxy.lan:3128";
+}
+`
+
+	if got != want {
+		t.Errorf("Generate() =\n%v\nwant\n%v", got, want)
+	}
+
+	if got, _ := Generate("10.0.0.1:80", nil); got != "function FindProxyForURL(url, host) {\n  return \"PROXY 10.0.0.1:80\";\n}\n" {
+		t.Errorf("unexpected file without direct hosts:\n%v", got)
+	}
+
+	for _, d := range []string{"192.168.0.0/33", "fd00::/8"} {
+		if _, err := Generate("10.0.0.1:80", []string{d}); err == nil {
+			t.Errorf("expected an error for %v", d)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/cthayer/pc-proxy/internal/activation"
+)
+
+const (
+	// how often Drain checks for open connections
+	DRAIN_POLL_INTERVAL = time.Millisecond * 500
+)
+
+// socketFile is implemented by the listening sockets (*net.TCPListener, *net.UDPConn)
+type socketFile interface {
+	File() (*os.File, error)
+}
+
+// UseSockets sets the sockets passed to the process (systemd socket activation, or an upgrade).  Listeners use the
+// socket with their address instead of opening one
+func (p *Proxy) UseSockets(sockets *activation.Sockets) {
+	p.sockets = sockets
+}
+
+// listenTCP returns the stream socket passed to the process for the address, or listens on the address
+func (p *Proxy) listenTCP(address string) (net.Listener, error) {
+	if l := p.sockets.Listener(address); l != nil {
+		p.logger.Debug("using a passed socket", zap.String("listen address", address))
+		return l, nil
+	}
+
+	return net.Listen("tcp", address)
+}
+
+// listenUDP returns the datagram socket passed to the process for the address, or listens on the address
+func (p *Proxy) listenUDP(address string) (net.PacketConn, error) {
+	if conn := p.sockets.PacketConn(address); conn != nil {
+		p.logger.Debug("using a passed socket", zap.String("listen address", address))
+		return conn, nil
+	}
+
+	return net.ListenPacket("udp", address)
+}
+
+// Files returns copies of the listening sockets and their names, to pass them to a new process.  The sockets passed to
+// this process that aren't used are included, so the new process can use them when the config changes
+func (p *Proxy) Files() ([]*os.File, []string, error) {
+	var files []*os.File
+	var names []string
+
+	add := func(name string, socket interface{}) error {
+		if socket == nil {
+			return nil
+		}
+
+		sf, ok := socket.(socketFile)
+
+		if !ok {
+			return errors.New("the " + name + " socket can't be passed to another process")
+		}
+
+		f, err := sf.File()
+
+		if err != nil {
+			return errors.New("error copying the " + name + " socket: " + err.Error())
+		}
+
+		files = append(files, f)
+		names = append(names, name)
+
+		return nil
+	}
+
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	p.listenLock.Lock()
+
+	for _, l := range p.listeners {
+		if err := add(l.conf.Protocol, l.socket); err != nil {
+			p.listenLock.Unlock()
+			closeFiles()
+			return nil, nil, err
+		}
+	}
+
+	p.listenLock.Unlock()
+
+	sockets := map[string]interface{}{
+		"transparent":    p.transparentListener,
+		"transparentTls": p.transparentTlsListener,
+		"socks":          p.socksListener,
+		"pac":            p.pacNetListener,
+	}
+
+	for i := range p.dnsConns {
+		if err := add("dns", p.dnsConns[i]); err != nil {
+			closeFiles()
+			return nil, nil, err
+		}
+
+		if err := add("dns", p.dnsListeners[i]); err != nil {
+			closeFiles()
+			return nil, nil, err
+		}
+	}
+
+	for name, socket := range sockets {
+		// a nil listener stored in the interface
+		if l, ok := socket.(net.Listener); !ok || l == nil {
+			continue
+		}
+
+		if err := add(name, socket); err != nil {
+			closeFiles()
+			return nil, nil, err
+		}
+	}
+
+	for _, sock := range p.sockets.Remaining() {
+		var socket interface{} = sock.Listener
+
+		if sock.Listener == nil {
+			socket = sock.PacketConn
+		}
+
+		if err := add(sock.Name, socket); err != nil {
+			closeFiles()
+			return nil, nil, err
+		}
+	}
+
+	return files, names, nil
+}
+
+// trackConn counts an open connection until the returned function is called.  Connections hijacked from the servers
+// (CONNECT tunnels) and SOCKS connections aren't tracked by the servers
+func (p *Proxy) trackConn() func() {
+	atomic.AddInt64(&p.openConns, 1)
+
+	return func() {
+		atomic.AddInt64(&p.openConns, -1)
+	}
+}
+
+// SaveState saves the bypass grants now, so a new process started during an upgrade loads them
+func (p *Proxy) SaveState() error {
+	return p.bypassStore.Save()
+}
+
+// Drain stops the proxy like Stop, then waits for the open connections (including CONNECT tunnels) to close, for up to
+// `timeout`.  The bypass state isn't saved anymore (call SaveState before starting the new process), the new process
+// owns the state file after an upgrade
+func (p *Proxy) Drain(timeout time.Duration) []error {
+	errs := p.shutdown()
+
+	p.stopManagers()
+	p.bypassStore.Close()
+
+	deadline := time.Now().Add(timeout)
+
+	for open := atomic.LoadInt64(&p.openConns); open > 0; open = atomic.LoadInt64(&p.openConns) {
+		if time.Now().After(deadline) {
+			p.logger.Warn("closing connections that are still open", zap.Int64("connections", open))
+			break
+		}
+
+		p.logger.Debug("waiting for connections to close", zap.Int64("connections", open))
+
+		time.Sleep(DRAIN_POLL_INTERVAL)
+	}
+
+	if err := p.closeAudit(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cthayer/pc-proxy/internal/activation"
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/logger"
+)
+
+func TestProxy_Start_PassedSockets(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	passed, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	defer unused.Close()
+
+	httpListener := config.ListenerConfig{Address: passed.Addr().String(), Protocol: "http"}
+
+	conf := *config.GetConfig()
+	conf.Listen = config.ListenConfig{Host: "127.0.0.1", Listeners: []config.ListenerConfig{httpListener}, SocksPort: 0}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+	pxy.UseSockets(activation.NewSockets([]*activation.Socket{{Name: "http", Listener: passed}, {Name: "admin", Listener: unused}}))
+
+	if err := pxy.Start(); err != nil {
+		t.Fatalf("Error starting proxy: %v", err)
+	}
+
+	if pxy.listeners[httpListener].socket != passed {
+		t.Error("expected the listener to use the passed socket")
+	}
+
+	files, names, err := pxy.Files()
+
+	if err != nil {
+		t.Fatalf("Files() error = %v", err)
+	}
+
+	for _, f := range files {
+		f.Close()
+	}
+
+	sort.Strings(names)
+
+	if strings.Join(names, ",") != "admin,http" {
+		t.Errorf("Files() names = %v, want the http listener and the unused socket", names)
+	}
+
+	// an open tunnel keeps Drain waiting
+	done := pxy.trackConn()
+
+	go func() {
+		time.Sleep(DRAIN_POLL_INTERVAL)
+		done()
+	}()
+
+	start := time.Now()
+
+	if errs := pxy.Drain(time.Second * 10); len(errs) > 0 {
+		t.Fatalf("Errors draining proxy: %v", errs)
+	}
+
+	if time.Since(start) < DRAIN_POLL_INTERVAL {
+		t.Error("expected Drain to wait for the open connection")
+	}
+
+	// the new process owns the bypass state
+	select {
+	case <-pxy.stop:
+	default:
+		t.Error("expected Drain to stop the bypass store manager")
+	}
+}
@@ -0,0 +1,464 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/cthayer/pc-proxy/internal/access"
+	"github.com/cthayer/pc-proxy/internal/audit"
+	"github.com/cthayer/pc-proxy/internal/client"
+	"github.com/cthayer/pc-proxy/internal/rule"
+)
+
+const (
+	ACCESS_REQUEST_PATH = "/access/request"
+	ACCESS_STATUS_PATH  = "/access/status"
+	ADMIN_PATH          = "/admin"
+	ADMIN_APPROVE_PATH  = "/admin/approve"
+	ADMIN_DENY_PATH     = "/admin/deny"
+
+	ADMIN_BASIC_AUTH_REALM = "pc-proxy: Enter the parent password"
+
+	// name of the admin forms' CSRF token field
+	CSRF_TOKEN_FIELD = "csrf"
+
+	// longest reason a client can give for an access request
+	ACCESS_REQUEST_MAX_REASON = 500
+)
+
+var (
+	// durations a parent can choose from when approving an access request (the bypass duration is added to the list)
+	accessApprovalDurations = []time.Duration{time.Minute * 15, time.Hour, time.Hour * 4}
+
+	pageTemplate = template.Must(template.New("page").Funcs(template.FuncMap{"duration": formatDuration}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>pc-proxy: {{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 48em; margin: 2em auto; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; }
+td, th { border-bottom: 1px solid #ccc; padding: 0.5em; text-align: left; vertical-align: top; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if eq .Page "request"}}
+<form method="post" action="` + ACCESS_REQUEST_PATH + `">
+<p><label>Website<br><input type="url" name="url" value="{{.URL}}" size="60" required></label></p>
+<p><label>Why do you need it? (optional)<br><textarea name="reason" rows="3" cols="60" maxlength="500"></textarea></label></p>
+<p><button type="submit">Ask for access</button></p>
+</form>
+{{else if eq .Page "status"}}
+<p>Website: {{.Request.URL}}</p>
+<p>Status: <strong>{{.Request.Status}}</strong>{{if eq .Request.Status "approved"}} for {{duration .Request.Duration}}{{end}}</p>
+{{if eq .Request.Status "pending"}}<p><a href="` + ACCESS_STATUS_PATH + `?id={{.Request.ID}}">Check again</a></p>{{end}}
+{{else if eq .Page "blocked"}}
+<p>{{.URL}} is blocked by the proxy.</p>
+{{if .AccessURL}}<p><a href="{{.AccessURL}}">Ask for access</a></p>{{end}}
+{{else if eq .Page "admin"}}
+{{if .Requests}}
+<table>
+<tr><th>Requested</th><th>Client</th><th>Website</th><th>Reason</th><th></th></tr>
+{{range .Requests}}
+<tr>
+<td>{{.Created.Format "Jan 2 15:04"}}</td>
+<td>{{.Client}}</td>
+<td>{{.URL}}<br><small>rule: {{.Rule}}</small></td>
+<td>{{.Reason}}</td>
+<td>
+<form method="post" action="` + ADMIN_APPROVE_PATH + `">
+<input type="hidden" name="id" value="{{.ID}}">
+<input type="hidden" name="` + CSRF_TOKEN_FIELD + `" value="{{$.CSRFToken}}">
+<select name="duration">{{range $.Durations}}<option value="{{.}}">{{duration .}}</option>{{end}}</select>
+<button type="submit">Approve</button>
+</form>
+<form method="post" action="` + ADMIN_DENY_PATH + `">
+<input type="hidden" name="id" value="{{.ID}}">
+<input type="hidden" name="` + CSRF_TOKEN_FIELD + `" value="{{$.CSRFToken}}">
+<button type="submit">Deny</button>
+</form>
+</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>There are no pending access requests.</p>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+)
+
+type page struct {
+	Page      string
+	Title     string
+	Error     string
+	Message   string
+	URL       string
+	AccessURL string
+	Request   access.Request
+	Requests  []access.Request
+	Durations []time.Duration
+	CSRFToken string
+}
+
+func (p *Proxy) newLocalMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(ACCESS_REQUEST_PATH, p.accessRequestsEnabled(p.handleAccessRequest))
+	mux.HandleFunc(ACCESS_STATUS_PATH, p.accessRequestsEnabled(p.handleAccessStatus))
+	mux.HandleFunc(ADMIN_PATH, p.accessRequestsEnabled(p.requireAdmin(p.handleAdmin)))
+	mux.HandleFunc(ADMIN_APPROVE_PATH, p.accessRequestsEnabled(p.requireAdmin(p.handleAdminDecision)))
+	mux.HandleFunc(ADMIN_DENY_PATH, p.accessRequestsEnabled(p.requireAdmin(p.handleAdminDecision)))
+	mux.Handle(PAC_PATH, p.pacMux)
+	mux.Handle(WPAD_PATH, p.pacMux)
+	mux.HandleFunc(CA_CERT_PATH, p.handleCaCert)
+
+	return mux
+}
+
+// isLocalRequest returns true for requests made to the proxy itself (instead of through it).  Browsers that use the proxy
+// send the links to it (the access request link on the block page) as proxy requests for the proxy's own address
+func (p *Proxy) isLocalRequest(req *http.Request) bool {
+	if req.Method == http.MethodConnect {
+		return false
+	}
+
+	if !req.URL.IsAbs() {
+		return true
+	}
+
+	host, port := req.URL.Hostname(), req.URL.Port()
+
+	if port == "" {
+		port = "80"
+	}
+
+	proxyHost := p.pacConfig().ProxyHost
+
+	if local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		lHost, lPort, err := net.SplitHostPort(local.String())
+
+		if err == nil && lPort == port && (host == proxyHost || sameIP(host, lHost)) {
+			return true
+		}
+	}
+
+	for _, l := range p.listenerConfigs() {
+		lHost, lPort, err := net.SplitHostPort(l.Address)
+
+		if err == nil && lPort == port && (host == proxyHost || sameIP(host, lHost)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameIP returns true when both hosts are the same IP address
+func sameIP(a string, b string) bool {
+	ip := net.ParseIP(a)
+
+	return ip != nil && ip.Equal(net.ParseIP(b))
+}
+
+func (p *Proxy) accessRequestsEnabled(next http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if !p.accessRequestsConf.Enabled {
+			http.NotFound(resp, req)
+			return
+		}
+
+		next(resp, req)
+	}
+}
+
+// requireAdmin only allows requests with the basic auth password of an admin credential
+func (p *Proxy) requireAdmin(next func(resp http.ResponseWriter, req *http.Request, admin string)) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		id := client.IdentityFromRequest(req)
+
+		if locked, _ := p.lockout.LockedOut(id.AddressKey()); locked {
+			http.Error(resp, "Too many failed attempts.  Try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		_, password, ok := req.BasicAuth()
+
+		if ok {
+			if cred, cOk := p.credentials.AuthenticateAdmin(password); cOk {
+				p.lockout.Success(id.AddressKey())
+
+				if req.Method == http.MethodPost && !p.validCSRFToken(req) {
+					http.Error(resp, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
+
+				next(resp, req, cred.Name)
+				return
+			}
+
+			if locked, until := p.lockout.Failure(id.AddressKey()); locked {
+				p.logger.Warn("admin locked out: too many failed attempts", zap.String("client address", req.RemoteAddr), zap.Time("until", until))
+			} else {
+				p.logger.Warn("admin login failed: invalid password", zap.String("client address", req.RemoteAddr))
+			}
+		}
+
+		resp.Header().Set("WWW-Authenticate", "Basic realm=\""+ADMIN_BASIC_AUTH_REALM+"\"")
+		http.Error(resp, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	}
+}
+
+func (p *Proxy) handleAccessRequest(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		p.renderPage(resp, http.StatusOK, page{Page: "request", Title: "Ask for access", URL: req.URL.Query().Get("url")})
+	case http.MethodPost:
+		p.createAccessRequest(resp, req)
+	default:
+		http.Error(resp, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *Proxy) createAccessRequest(resp http.ResponseWriter, req *http.Request) {
+	target := strings.TrimSpace(req.PostFormValue("url"))
+	reason := strings.TrimSpace(req.PostFormValue("reason"))
+
+	if len(reason) > ACCESS_REQUEST_MAX_REASON {
+		reason = reason[:ACCESS_REQUEST_MAX_REASON]
+	}
+
+	targetReq, err := targetRequest(target, req.RemoteAddr)
+
+	if err != nil {
+		p.renderPage(resp, http.StatusBadRequest, page{Page: "request", Title: "Ask for access", Error: "That doesn't look like a website address", URL: target})
+		return
+	}
+
+	// the rules are checked for the client asking for access
+	targetReq = targetReq.WithContext(req.Context())
+
+	r, blocked := p.blockingRule(targetReq)
+
+	if !blocked {
+		p.renderPage(resp, http.StatusOK, page{Title: "Ask for access", Message: "That website isn't blocked."})
+		return
+	}
+
+	if !r.PasswordBypass {
+		p.renderPage(resp, http.StatusForbidden, page{Title: "Ask for access", Message: "That website can't be unlocked."})
+		return
+	}
+
+	id := client.IdentityFromRequest(req)
+	ar, err := p.accessRequests.Create(id.Key(), targetReq.URL.String(), r.Pattern, reason)
+
+	if err != nil {
+		p.renderPage(resp, http.StatusTooManyRequests, page{Page: "request", Title: "Ask for access", Error: "You already have too many requests waiting for an answer", URL: target})
+		return
+	}
+
+	p.logger.Info("access requested", zap.String("id", ar.ID), zap.String("client address", ar.Client), zap.String("url", ar.URL), zap.String("pattern", ar.Rule), zap.String("reason", ar.Reason))
+
+	http.Redirect(resp, req, ACCESS_STATUS_PATH+"?id="+ar.ID, http.StatusSeeOther)
+}
+
+func (p *Proxy) handleAccessStatus(resp http.ResponseWriter, req *http.Request) {
+	ar, ok := p.accessRequests.Get(req.URL.Query().Get("id"))
+
+	// clients can only see their own requests
+	if !ok || ar.Client != client.IdentityFromRequest(req).Key() {
+		http.NotFound(resp, req)
+		return
+	}
+
+	p.renderPage(resp, http.StatusOK, page{Page: "status", Title: "Access request", Request: ar})
+}
+
+func (p *Proxy) handleAdmin(resp http.ResponseWriter, req *http.Request, admin string) {
+	p.renderPage(resp, http.StatusOK, page{Page: "admin", Title: "Access requests", Requests: p.accessRequests.Pending(), Durations: p.approvalDurations(), CSRFToken: p.csrfToken(req)})
+}
+
+func (p *Proxy) handleAdminDecision(resp http.ResponseWriter, req *http.Request, admin string) {
+	if req.Method != http.MethodPost {
+		http.Error(resp, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ar access.Request
+	var err error
+
+	id := req.PostFormValue("id")
+
+	if req.URL.Path == ADMIN_APPROVE_PATH {
+		duration, dErr := time.ParseDuration(req.PostFormValue("duration"))
+
+		if dErr != nil || duration <= 0 {
+			http.Error(resp, "invalid duration", http.StatusBadRequest)
+			return
+		}
+
+		if ar, err = p.accessRequests.Approve(id, duration, admin); err == nil {
+			p.grantAccessRequest(ar)
+		}
+	} else {
+		ar, err = p.accessRequests.Deny(id, admin)
+	}
+
+	if err == access.ErrNotFound {
+		http.NotFound(resp, req)
+		return
+	}
+
+	if err == nil {
+		p.logger.Info("access request "+string(ar.Status), zap.String("id", ar.ID), zap.String("client address", ar.Client), zap.String("url", ar.URL), zap.String("admin", admin), zap.Duration("duration", ar.Duration))
+
+		entry := audit.Entry{Event: audit.EVENT_DENY, Client: ar.Client, URL: ar.URL, Rule: ar.Rule, Credential: admin}
+
+		if ar.Status == access.STATUS_APPROVED {
+			expires := ar.Decided.Add(ar.Duration)
+
+			entry.Event = audit.EVENT_APPROVE
+			entry.Expires = &expires
+		}
+
+		p.auditEvent(entry)
+	}
+
+	http.Redirect(resp, req, ADMIN_PATH, http.StatusSeeOther)
+}
+
+// grantAccessRequest turns an approved access request into a bypass grant for the client
+func (p *Proxy) grantAccessRequest(ar access.Request) {
+	key := ar.Rule
+
+	targetReq, err := targetRequest(ar.URL, ar.Client)
+
+	if err == nil {
+		for _, r := range p.Rules {
+			if r.Pattern == ar.Rule {
+				key = r.BypassKey(targetReq, p.bypass())
+				break
+			}
+		}
+	}
+
+	p.bypassStore.Grant(ar.Client, key, ar.Decided.Add(ar.Duration))
+}
+
+// blockingRule returns the rule that blocks the request (if any)
+func (p *Proxy) blockingRule(req *http.Request) (rule.Rule, bool) {
+	for _, r := range p.Rules {
+		if r.Matches(req) {
+			return r, r.Access == "block"
+		}
+	}
+
+	return rule.Rule{}, false
+}
+
+func (p *Proxy) approvalDurations() []time.Duration {
+	durations := append([]time.Duration{}, accessApprovalDurations...)
+
+	for _, d := range durations {
+		if d == p.bypassConf.Duration {
+			return durations
+		}
+	}
+
+	return append(durations, p.bypassConf.Duration)
+}
+
+func (p *Proxy) renderPage(resp http.ResponseWriter, status int, pg page) {
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.WriteHeader(status)
+
+	if err := pageTemplate.Execute(resp, pg); err != nil {
+		p.logger.Error("error rendering page", zap.String("page", pg.Page), zap.Error(err))
+	}
+}
+
+// targetRequest creates the request rules are matched against for a URL requested by a client
+func targetRequest(target string, remoteAddr string) (*http.Request, error) {
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+
+	u, err := url.Parse(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.New("invalid website address (" + target + ")")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.RemoteAddr = remoteAddr
+
+	return req, nil
+}
+
+func newCSRFKey() []byte {
+	key := make([]byte, sha256.Size)
+
+	// crypto/rand only fails when the OS can't provide randomness
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+
+	return key
+}
+
+// csrfToken returns the token that protects the admin forms from cross-site requests.  It is tied to the admin's login
+// (the basic auth header the browser sends with every request), which other sites can't read
+func (p *Proxy) csrfToken(req *http.Request) string {
+	m := hmac.New(sha256.New, p.csrfKey)
+	m.Write([]byte(req.Header.Get("Authorization")))
+
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func (p *Proxy) validCSRFToken(req *http.Request) bool {
+	return hmac.Equal([]byte(req.PostFormValue(CSRF_TOKEN_FIELD)), []byte(p.csrfToken(req)))
+}
+
+// formatDuration drops the zero units from a duration ("1h0m0s" becomes "1h")
+func formatDuration(d time.Duration) string {
+	s := d.String()
+
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+
+	return s
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/logger"
+)
+
+func newAdminTestProxy(t *testing.T) *Proxy {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "allow", "type": "host", "pattern": "school\\.com"},
+		{"access": "block", "type": "host", "pattern": "youtube\\.com", "bypassScope": "host"},
+		{"access": "block", "type": "host", "pattern": "casino\\.com", "passwordBypass": false},
+	}
+	conf.AccessRequests = config.AccessRequestsConfig{Enabled: true, MaxPending: 5}
+	conf.Credentials = nil
+
+	_ = os.Setenv(BYPASS_PASSWD_ENV_NAME, "secret")
+	t.Cleanup(func() { _ = os.Unsetenv(BYPASS_PASSWD_ENV_NAME) })
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	return pxy
+}
+
+func serveLocal(pxy *Proxy, method string, target string, form url.Values, password string) *httptest.ResponseRecorder {
+	var req *http.Request
+
+	if form != nil {
+		req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+
+	req.RemoteAddr = "10.0.0.1:1234"
+
+	if password != "" {
+		req.SetBasicAuth("parent", password)
+	}
+
+	rec := httptest.NewRecorder()
+
+	pxy.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestProxy_AccessRequest(t *testing.T) {
+	pxy := newAdminTestProxy(t)
+
+	if rec := serveLocal(pxy, "GET", ACCESS_REQUEST_PATH+"?url=youtube.com", nil, ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `value="youtube.com"`) {
+		t.Errorf("expected the access request form, got %v", rec.Code)
+	}
+
+	rec := serveLocal(pxy, "POST", ACCESS_REQUEST_PATH, url.Values{"url": {"https://www.youtube.com/watch"}, "reason": {"science video"}}, "")
+
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected a redirect to the status page, got %v", rec.Code)
+	}
+
+	pending := pxy.accessRequests.Pending()
+
+	if len(pending) != 1 || pending[0].Client != "10.0.0.1" || pending[0].Rule != "youtube\\.com" || pending[0].Reason != "science video" {
+		t.Fatalf("expected a pending access request, got %v", pending)
+	}
+
+	if rec := serveLocal(pxy, "GET", rec.Header().Get("Location"), nil, ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "pending") {
+		t.Errorf("expected the status page, got %v", rec.Code)
+	}
+
+	for _, target := range []string{"school.com", "example.com", "casino.com"} {
+		serveLocal(pxy, "POST", ACCESS_REQUEST_PATH, url.Values{"url": {target}}, "")
+	}
+
+	if pending := pxy.accessRequests.Pending(); len(pending) != 1 {
+		t.Errorf("expected requests for sites that aren't blocked (or can't be unlocked) to be rejected, got %v", pending)
+	}
+}
+
+func TestProxy_AccessRequest_Approve(t *testing.T) {
+	pxy := newAdminTestProxy(t)
+
+	serveLocal(pxy, "POST", ACCESS_REQUEST_PATH, url.Values{"url": {"https://www.youtube.com/watch"}}, "")
+
+	id := pxy.accessRequests.Pending()[0].ID
+
+	if rec := serveLocal(pxy, "GET", ADMIN_PATH, nil, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected the admin page to require a password, got %v", rec.Code)
+	}
+
+	if rec := serveLocal(pxy, "GET", ADMIN_PATH, nil, "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected the admin page to reject a wrong password, got %v", rec.Code)
+	}
+
+	rec := serveLocal(pxy, "GET", ADMIN_PATH, nil, "secret")
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), id) {
+		t.Errorf("expected the admin page to list the pending request, got %v", rec.Code)
+	}
+
+	token := formValue(rec.Body.String(), CSRF_TOKEN_FIELD)
+
+	connect := httptest.NewRequest("CONNECT", "www.youtube.com:443", nil)
+	connect.RemoteAddr = "10.0.0.1:1234"
+
+	if pxy.IsAuthorized(httptest.NewRecorder(), connect) {
+		t.Fatal("expected the site to be blocked before the request is approved")
+	}
+
+	// a cross-site form can't know the token
+	if rec := serveLocal(pxy, "POST", ADMIN_APPROVE_PATH, url.Values{"id": {id}, "duration": {"15m"}}, "secret"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected a decision without the CSRF token to be rejected, got %v", rec.Code)
+	}
+
+	if rec := serveLocal(pxy, "POST", ADMIN_APPROVE_PATH, url.Values{"id": {id}, "duration": {"15m"}, CSRF_TOKEN_FIELD: {token}}, "secret"); rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected a redirect to the admin page, got %v", rec.Code)
+	}
+
+	if r, _ := pxy.accessRequests.Get(id); r.Status != "approved" || r.DecidedBy != BYPASS_PASSWD_ENV_NAME {
+		t.Errorf("expected the request to be approved, got %v", r)
+	}
+
+	connect = httptest.NewRequest("CONNECT", "www.youtube.com:443", nil)
+	connect.RemoteAddr = "10.0.0.1:4321"
+
+	if !pxy.IsAuthorized(httptest.NewRecorder(), connect) {
+		t.Error("expected the approved request to allow access")
+	}
+
+	// the rule's "host" scope only unlocks the requested host
+	if !pxy.bypassStore.Active("10.0.0.1", "host:www.youtube.com") {
+		t.Errorf("expected a host scoped grant, got %v", pxy.bypassStore.Grants())
+	}
+}
+
+func TestProxy_AccessRequest_ThroughProxy(t *testing.T) {
+	pxy := newAdminTestProxy(t)
+	pxy.interceptConf.BlockPage = true
+
+	srv := httptest.NewServer(pxy)
+	defer srv.Close()
+
+	pxy.updateListen(config.ListenConfig{Listeners: []config.ListenerConfig{{Address: srv.Listener.Addr().String()}}})
+
+	proxyURL, _ := url.Parse(srv.URL)
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := c.Get("http://www.casino.com/")
+
+	if err != nil {
+		t.Fatalf("request error = %v", err)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	match := regexp.MustCompile(`href="([^"]+)"`).FindStringSubmatch(string(body))
+
+	if resp.StatusCode != http.StatusForbidden || match == nil {
+		t.Fatalf("expected the block page with the access request link, got %v %s", resp.StatusCode, body)
+	}
+
+	link := html.UnescapeString(match[1])
+
+	if !strings.HasPrefix(link, srv.URL+ACCESS_REQUEST_PATH+"?") {
+		t.Errorf("expected a link to the proxy, got %v", link)
+	}
+
+	// the browser sends the link through the proxy
+	resp, err = c.Get(link)
+
+	if err != nil {
+		t.Fatalf("request error = %v", err)
+	}
+
+	body, _ = ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `value="http://www.casino.com/"`) {
+		t.Errorf("expected the access request form, got %v %s", resp.StatusCode, body)
+	}
+
+	// a website at another port of the proxy's address isn't the proxy
+	if pxy.isLocalRequest(httptest.NewRequest("GET", "http://127.0.0.1:1/", nil)) {
+		t.Error("expected a request for another port to be forwarded")
+	}
+}
+
+func TestProxy_AccessRequest_Disabled(t *testing.T) {
+	pxy := newAdminTestProxy(t)
+	pxy.accessRequestsConf.Enabled = false
+
+	if rec := serveLocal(pxy, "GET", ACCESS_REQUEST_PATH, nil, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected access requests to be disabled, got %v", rec.Code)
+	}
+}
+
+// formValue returns the value of a form field in a page
+func formValue(body string, name string) string {
+	v := body[strings.Index(body, `name="`+name+`" value="`)+len(`name="`+name+`" value="`):]
+
+	return v[:strings.Index(v, `"`)]
+}
+
+func TestProxy_isLocalRequest_Reload(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.Listen.Listeners = []config.ListenerConfig{{Address: "192.168.1.1:8080"}}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	done := make(chan struct{})
+
+	// reload the listeners while requests are checked (run with -race)
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			pxy.updateListen(conf.Listen)
+			pxy.updatePac(conf.Pac)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if !pxy.isLocalRequest(httptest.NewRequest("GET", "http://192.168.1.1:8080/admin", nil)) {
+			t.Fatal("expected a request for the proxy's address to be local")
+		}
+	}
+
+	<-done
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"go.uber.org/zap"
+
+	"github.com/cthayer/pc-proxy/internal/audit"
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/rule"
+)
+
+const (
+	AUDIT_MEGABYTE = 1024 * 1024
+)
+
+func (p *Proxy) updateAudit(conf config.AuditConfig) {
+	p.auditLock.Lock()
+	defer p.auditLock.Unlock()
+
+	if conf == p.auditConf && (p.audit != nil || conf.File == "") {
+		// nothing changed
+		return
+	}
+
+	if p.audit != nil {
+		if err := p.audit.Close(); err != nil {
+			p.logger.Error("error closing audit file", zap.String("file", p.audit.Path()), zap.Error(err))
+		}
+
+		p.audit = nil
+	}
+
+	p.auditConf = conf
+
+	if conf.File == "" {
+		return
+	}
+
+	l, err := audit.Open(conf.File, int64(conf.MaxSize)*AUDIT_MEGABYTE, conf.MaxBackups)
+
+	if err != nil {
+		// keep running without an audit trail
+		p.logger.Error("error opening audit file", zap.String("file", conf.File), zap.Error(err))
+		return
+	}
+
+	p.audit = l
+
+	p.logger.Info("audit file opened", zap.String("file", conf.File))
+}
+
+func (p *Proxy) closeAudit() error {
+	p.auditLock.Lock()
+	defer p.auditLock.Unlock()
+
+	if p.audit == nil {
+		return nil
+	}
+
+	err := p.audit.Close()
+	p.audit = nil
+
+	return err
+}
+
+func (p *Proxy) auditEvent(e audit.Entry) {
+	p.auditLock.Lock()
+	defer p.auditLock.Unlock()
+
+	if p.audit == nil {
+		return
+	}
+
+	if err := p.audit.Write(e); err != nil {
+		p.logger.Error("error writing audit file", zap.String("file", p.audit.Path()), zap.Error(err))
+	}
+}
+
+func (p *Proxy) auditBypassEvent(e rule.BypassEvent) {
+	entry := audit.Entry{
+		Event:  string(e.Type),
+		Client: e.Client,
+		Name:   e.Name,
+		Host:   e.Host,
+		Rule:   e.Rule.Pattern,
+	}
+
+	switch e.Type {
+	case rule.BYPASS_EVENT_UNLOCK:
+		entry.Credential = e.Credential
+		entry.Key = e.Key
+		entry.Expires = &e.Expires
+	case rule.BYPASS_EVENT_LOCKOUT:
+		entry.Until = &e.Until
+	}
+
+	p.auditEvent(entry)
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cthayer/pc-proxy/internal/audit"
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/logger"
+)
+
+func TestProxy_Audit(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	dir, err := ioutil.TempDir("", "pc-proxy-audit")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "block", "type": "host", "pattern": "youtube\\.com"},
+	}
+	conf.Audit = config.AuditConfig{File: filepath.Join(dir, "audit.jsonl"), MaxSize: 1}
+
+	_ = os.Setenv(BYPASS_PASSWD_ENV_NAME, "secret")
+	t.Cleanup(func() { _ = os.Unsetenv(BYPASS_PASSWD_ENV_NAME) })
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	// a client that can't be asked for the password (a transparent or SOCKS connection) isn't challenged
+	unprompted := httptest.NewRequest("CONNECT", "www.youtube.com:443", nil)
+	unprompted.RemoteAddr = "10.0.0.2:1234"
+
+	pxy.IsAuthorized(&responseWriter{ResponseWriter: &discardResponseWriter{}}, unprompted)
+
+	for _, password := range []string{"", "guess", "secret"} {
+		req := httptest.NewRequest("CONNECT", "www.youtube.com:443", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+
+		if password != "" {
+			req.SetBasicAuth("", password)
+			req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+			req.Header.Del("Authorization")
+		}
+
+		pxy.IsAuthorized(httptest.NewRecorder(), req)
+	}
+
+	if err := pxy.closeAudit(); err != nil {
+		t.Fatalf("closeAudit() error = %v", err)
+	}
+
+	f, err := os.Open(conf.Audit.File)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	var entries []audit.Entry
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		var e audit.Entry
+
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid audit line %q: %v", scanner.Text(), err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	want := []string{audit.EVENT_CHALLENGE, audit.EVENT_FAILURE, audit.EVENT_UNLOCK}
+
+	if len(entries) != len(want) {
+		t.Fatalf("expected %v audit entries, got %v", len(want), entries)
+	}
+
+	for i, e := range entries {
+		if e.Event != want[i] || e.Client != "10.0.0.1" || e.Host != "www.youtube.com:443" || e.Rule != "youtube\\.com" {
+			t.Errorf("unexpected audit entry %v: %v", i, e)
+		}
+	}
+
+	if e := entries[2]; e.Credential != BYPASS_PASSWD_ENV_NAME || e.Expires == nil {
+		t.Errorf("expected the unlock to record the credential and expiry, got %v", e)
+	}
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/cthayer/pc-proxy/internal/client"
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/credential"
+	"github.com/cthayer/pc-proxy/internal/digest"
+	"github.com/cthayer/pc-proxy/internal/rule"
+)
+
+const (
+	PROXY_AUTH_REALM = "pc-proxy"
+
+	AUTH_SCHEME_BASIC  = "basic"
+	AUTH_SCHEME_DIGEST = "digest"
+
+	// how long a successful proxy login is remembered for the client (it is extended while the client keeps using it)
+	LOGIN_CACHE_TTL = time.Minute * 5
+)
+
+func (p *Proxy) updateProxyAuth(conf config.ProxyAuthConfig) {
+	p.proxyAuthConf = conf
+
+	// check the logins again with the new users, rules and credentials
+	p.logins.Clear()
+
+	if !conf.Enabled {
+		return
+	}
+
+	// keep the users from the last good file when there is an error.  with no users every request is refused
+	if conf.Scheme == AUTH_SCHEME_DIGEST {
+		users, err := credential.LoadHtdigest(conf.HtdigestFile)
+
+		if err != nil {
+			p.logger.Error("error loading proxy auth htdigest file", zap.String("htdigestFile", conf.HtdigestFile), zap.Error(err))
+			return
+		}
+
+		p.digestUsers = users
+
+		p.logger.Info("new proxy auth users loaded", zap.Int("count", users.Len()))
+		return
+	}
+
+	users, err := credential.LoadHtpasswd(conf.HtpasswdFile)
+
+	if err != nil {
+		p.logger.Error("error loading proxy auth htpasswd file", zap.String("htpasswdFile", conf.HtpasswdFile), zap.Error(err))
+		return
+	}
+
+	p.users = users
+
+	p.logger.Info("new proxy auth users loaded", zap.Int("count", users.Len()))
+}
+
+// authenticate requires the client to log in with a user from the htpasswd (or htdigest) file.  A bypass password for the
+// rule that blocks the request is also accepted in place of the user's password (the browser keeps sending the
+// credentials it was last challenged for).  Those requests aren't logged in as the user, the client keeps the identity
+// of its address.  The returned request records the checked bypass password for the rules
+func (p *Proxy) authenticate(resp http.ResponseWriter, req *http.Request, id client.Identity) (*http.Request, client.Identity, bool) {
+	if locked, until := p.lockout.LockedOut(id.AddressKey()); locked {
+		resp.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+		http.Error(resp, "Too many failed login attempts.  Try again later", http.StatusTooManyRequests)
+		return req, id, false
+	}
+
+	var user string
+	var ok bool
+	var stale bool
+
+	if p.proxyAuthConf.Scheme == AUTH_SCHEME_DIGEST {
+		req, user, ok, stale = p.authenticateDigest(req, id)
+	} else {
+		req, user, ok = p.authenticateBasic(req, id)
+	}
+
+	if ok {
+		// not set for a bypass password
+		id.User = user
+
+		return req, id, true
+	}
+
+	if user != "" && !stale {
+		p.proxyLoginFailed(id.AddressKey(), req.RemoteAddr, user)
+	}
+
+	p.proxyAuthChallenge(resp, stale)
+
+	return req, id, false
+}
+
+// proxyLoginFailed records a failed login, locking the client's device out after too many failures
+func (p *Proxy) proxyLoginFailed(key string, remoteAddr string, user string) {
+	if locked, until := p.lockout.Failure(key); locked {
+		p.logger.Warn("client locked out after failed proxy logins", zap.String("client address", remoteAddr), zap.String("user", user), zap.Time("until", until))
+	} else {
+		p.logger.Warn("failed proxy login", zap.String("client address", remoteAddr), zap.String("user", user))
+	}
+}
+
+// authenticatePassword checks the password of a user for clients that send the password itself (SOCKS clients)
+func (p *Proxy) authenticatePassword(user string, password string) bool {
+	if p.proxyAuthConf.Scheme == AUTH_SCHEME_DIGEST {
+		return p.digestUsers.Authenticate(user, PROXY_AUTH_REALM, password)
+	}
+
+	return p.users.Authenticate(user, password)
+}
+
+// authenticateBasic returns the user name (when one was provided) and if the login succeeded.  The user name is empty
+// when a bypass password was accepted.  Successful logins are cached for the client, so the bcrypt hashes aren't checked
+// for every request
+func (p *Proxy) authenticateBasic(req *http.Request, id client.Identity) (*http.Request, string, bool) {
+	user, password, ok := proxyBasicAuth(req)
+
+	if !ok || user == "" {
+		return req, "", false
+	}
+
+	if p.logins.Check(id.IP, user, password) || p.users.Authenticate(user, password) {
+		p.logins.Add(id.IP, user, password)
+
+		// the user's own password isn't a bypass attempt
+		req.Header.Del("Proxy-Authorization")
+
+		return req, user, true
+	}
+
+	if !p.users.Exists(user) {
+		return req, user, false
+	}
+
+	// a bypass password, checked against the rule that blocks the request
+	r, ok := p.bypassRule(req, id)
+
+	if !ok {
+		return req, user, false
+	}
+
+	if p.logins.Check(id.IP, user, password, r.Pattern) {
+		return req, "", true
+	}
+
+	if req, ok, _ = r.Authenticate(req, p.bypass()); !ok {
+		return req, user, false
+	}
+
+	p.logins.Add(id.IP, user, password, r.Pattern)
+
+	return req, "", true
+}
+
+// authenticateDigest returns the user name (when one was provided), if the login succeeded, and if the nonce is stale.
+// The user name is empty when a bypass password was accepted
+func (p *Proxy) authenticateDigest(req *http.Request, id client.Identity) (*http.Request, string, bool, bool) {
+	r, err := digest.Parse(req.Header.Get("Proxy-Authorization"))
+
+	if err != nil || (req.RequestURI != "" && r.URI != req.RequestURI) {
+		return req, "", false, false
+	}
+
+	if p.digestUsers.VerifyDigest(r, req.Method) {
+		if ok, stale := p.digest.Use(r); !ok {
+			// a replayed or expired response
+			return req, "", false, stale
+		}
+
+		// the user's own password isn't a bypass attempt
+		req.Header.Del("Proxy-Authorization")
+
+		return req, r.Username, true, false
+	}
+
+	if !p.digestUsers.Exists(r.Username) {
+		return req, r.Username, false, false
+	}
+
+	// a bypass password, checked against the rule that blocks the request (using up the nonce)
+	rl, ok := p.bypassRule(req, id)
+
+	if !ok {
+		return req, r.Username, false, false
+	}
+
+	req, ok, stale := rl.Authenticate(req, p.bypass())
+
+	if !ok {
+		return req, r.Username, false, stale
+	}
+
+	return req, "", true, false
+}
+
+// bypassRule returns the rule that matches the request for the client's identity when it blocks the request and can be
+// bypassed with a password
+func (p *Proxy) bypassRule(req *http.Request, id client.Identity) (rule.Rule, bool) {
+	req = req.WithContext(client.WithIdentity(req.Context(), id))
+
+	for _, r := range p.Rules {
+		if r.Matches(req) {
+			return r, r.Access == "block" && r.PasswordBypass
+		}
+	}
+
+	return rule.Rule{}, false
+}
+
+func proxyBasicAuth(req *http.Request) (user string, password string, ok bool) {
+	proxyAuth := req.Header.Get("Proxy-Authorization")
+
+	if proxyAuth == "" {
+		return "", "", false
+	}
+
+	// use the request's basic auth parsing on a copy of the headers
+	r := http.Request{Header: http.Header{"Authorization": []string{proxyAuth}}}
+
+	return r.BasicAuth()
+}
+
+func (p *Proxy) proxyAuthChallenge(resp http.ResponseWriter, stale bool) {
+	if p.proxyAuthConf.Scheme == AUTH_SCHEME_DIGEST {
+		for _, c := range p.digest.Challenges(PROXY_AUTH_REALM, stale) {
+			resp.Header().Add("Proxy-Authenticate", c)
+		}
+	} else {
+		resp.Header().Set("Proxy-Authenticate", "Basic realm=\""+PROXY_AUTH_REALM+"\"")
+	}
+
+	http.Error(resp, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cthayer/pc-proxy/internal/client"
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/digest"
+	"github.com/cthayer/pc-proxy/internal/logger"
+)
+
+func TestProxy_ServeHTTP_ProxyAuth(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "block", "type": "host", "pattern": "youtube\\.com", "clients": []interface{}{"user:alice"}},
+		{"access": "block", "type": "host", "pattern": "games\\.com"},
+	}
+	conf.ProxyAuth = config.ProxyAuthConfig{Enabled: true, HtpasswdFile: filepath.Join("..", "..", "test", "htpasswd")}
+
+	_ = os.Setenv(BYPASS_PASSWD_ENV_NAME, "secret")
+	t.Cleanup(func() { _ = os.Unsetenv(BYPASS_PASSWD_ENV_NAME) })
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	var identity client.Identity
+
+	// stand in for cproxy, which only calls the filter
+	pxy.handler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		identity = client.IdentityFromRequest(req)
+
+		if pxy.IsAuthorized(resp, req) {
+			resp.WriteHeader(http.StatusOK)
+		}
+	})
+
+	serve := func(target string, user string, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("CONNECT", target, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+
+		if user != "" {
+			req.SetBasicAuth(user, password)
+			req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+			req.Header.Del("Authorization")
+		}
+
+		rec := httptest.NewRecorder()
+
+		pxy.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	if rec := serve("school.com:443", "", ""); rec.Code != http.StatusProxyAuthRequired || !strings.Contains(rec.Header().Get("Proxy-Authenticate"), PROXY_AUTH_REALM) {
+		t.Errorf("expected a proxy login challenge, got %v", rec.Code)
+	}
+
+	if rec := serve("school.com:443", "alice", "wrong"); rec.Code != http.StatusProxyAuthRequired {
+		t.Errorf("expected a wrong password to be rejected, got %v", rec.Code)
+	}
+
+	if rec := serve("school.com:443", "mallory", "secret"); rec.Code != http.StatusProxyAuthRequired {
+		t.Errorf("expected an unknown user to be rejected, got %v", rec.Code)
+	}
+
+	if rec := serve("school.com:443", "alice", "alicepw"); rec.Code != http.StatusOK || identity.Key() != "user:alice" {
+		t.Errorf("expected alice to be logged in, got %v (%v)", rec.Code, identity.Key())
+	}
+
+	// the rule only applies to alice
+	if rec := serve("www.youtube.com:443", "bob", "bobpw"); rec.Code != http.StatusOK {
+		t.Errorf("expected bob to be allowed, got %v", rec.Code)
+	}
+
+	if rec := serve("www.youtube.com:443", "alice", "alicepw"); rec.Code != http.StatusProxyAuthRequired || strings.Contains(rec.Header().Get("Proxy-Authenticate"), "realm=\""+PROXY_AUTH_REALM+"\"") {
+		t.Errorf("expected alice to be asked for the bypass password, got %v", rec.Code)
+	}
+
+	// a bypass password doesn't log in as alice, the bypass is granted to the client's address
+	if rec := serve("games.com:443", "alice", "secret"); rec.Code != http.StatusOK || identity.User != "" {
+		t.Errorf("expected the bypass password to unlock the site without logging in, got %v (%v)", rec.Code, identity.Key())
+	}
+
+	if !pxy.bypassStore.Active("10.0.0.1", "games\\.com") {
+		t.Errorf("expected the bypass to be granted to the client's address, got %v", pxy.bypassStore.Grants())
+	}
+
+	// the address's bypass doesn't apply to the users of the device
+	if rec := serve("games.com:443", "alice", "alicepw"); rec.Code != http.StatusProxyAuthRequired {
+		t.Errorf("expected the address's bypass to not unlock the site for alice, got %v", rec.Code)
+	}
+
+	// only the rule that blocks the request for the client's address is checked (the youtube rule only applies to alice)
+	if rec := serve("www.youtube.com:443", "alice", "secret"); rec.Code != http.StatusProxyAuthRequired {
+		t.Errorf("expected the bypass password of a rule that doesn't apply to be rejected, got %v", rec.Code)
+	}
+
+	// successful logins are cached, and the cache is cleared when the users change
+	if !pxy.logins.Check("10.0.0.1", "alice", "alicepw") {
+		t.Error("expected alice's login to be cached")
+	}
+
+	pxy.updateProxyAuth(pxy.proxyAuthConf)
+
+	if pxy.logins.Check("10.0.0.1", "alice", "alicepw") {
+		t.Error("expected the cache to be cleared when the proxy auth config is reloaded")
+	}
+}
+
+func TestProxy_ServeHTTP_ProxyAuth_Digest(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "block", "type": "host", "pattern": "youtube\\.com"},
+	}
+	conf.Bypass.Scheme = AUTH_SCHEME_DIGEST
+	conf.ProxyAuth = config.ProxyAuthConfig{Enabled: true, Scheme: AUTH_SCHEME_DIGEST, HtdigestFile: filepath.Join("..", "..", "test", "htdigest")}
+
+	_ = os.Setenv(BYPASS_PASSWD_ENV_NAME, "secret")
+	t.Cleanup(func() { _ = os.Unsetenv(BYPASS_PASSWD_ENV_NAME) })
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	pxy.handler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if pxy.IsAuthorized(resp, req) {
+			resp.WriteHeader(http.StatusOK)
+		}
+	})
+
+	serve := func(target string, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("CONNECT", target, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("Proxy-Authorization", authorization)
+
+		rec := httptest.NewRecorder()
+
+		pxy.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	rec := serve("school.com:443", "")
+	challenge := rec.Header().Values("Proxy-Authenticate")
+
+	if rec.Code != http.StatusProxyAuthRequired || len(challenge) != 2 || !strings.Contains(challenge[0], `realm="`+PROXY_AUTH_REALM+`"`) {
+		t.Fatalf("expected a digest proxy login challenge, got %v %v", rec.Code, challenge)
+	}
+
+	login := digest.Authorization(challenge[0], "CONNECT", "school.com:443", "alice", "alicepw")
+
+	if rec := serve("school.com:443", login); rec.Code != http.StatusOK {
+		t.Errorf("expected alice to be logged in, got %v", rec.Code)
+	}
+
+	if rec := serve("school.com:443", login); rec.Code != http.StatusProxyAuthRequired {
+		t.Errorf("expected a replayed login to be rejected, got %v", rec.Code)
+	}
+
+	// bob's entry is an MD5 hash
+	challenge = serve("school.com:443", "").Header().Values("Proxy-Authenticate")
+
+	if rec := serve("school.com:443", digest.Authorization(challenge[1], "CONNECT", "school.com:443", "bob", "bobpw")); rec.Code != http.StatusOK {
+		t.Errorf("expected bob to be logged in, got %v", rec.Code)
+	}
+
+	challenge = serve("school.com:443", "").Header().Values("Proxy-Authenticate")
+	rec = serve("www.youtube.com:443", digest.Authorization(challenge[0], "CONNECT", "www.youtube.com:443", "alice", "alicepw"))
+	challenge = rec.Header().Values("Proxy-Authenticate")
+
+	if rec.Code != http.StatusProxyAuthRequired || len(challenge) != 2 || strings.Contains(challenge[0], `realm="`+PROXY_AUTH_REALM+`"`) {
+		t.Fatalf("expected a digest bypass challenge, got %v %v", rec.Code, challenge)
+	}
+
+	bypass := digest.Authorization(challenge[0], "CONNECT", "www.youtube.com:443", "alice", "secret")
+
+	if rec := serve("www.youtube.com:443", bypass); rec.Code != http.StatusOK {
+		t.Errorf("expected the bypass password to unlock the site, got %v", rec.Code)
+	}
+
+	if rec := serve("www.youtube.com:443", bypass); rec.Code != http.StatusProxyAuthRequired {
+		t.Errorf("expected a replayed bypass login to be rejected, got %v", rec.Code)
+	}
+
+	// the nonce is only valid for the realm it was issued for
+	challenge = serve("school.com:443", "").Header().Values("Proxy-Authenticate")
+	otherRealm := strings.Replace(challenge[0], `realm="`+PROXY_AUTH_REALM+`"`, `realm="other"`, 1)
+
+	if rec := serve("school.com:443", digest.Authorization(otherRealm, "CONNECT", "school.com:443", "alice", "alicepw")); rec.Code != http.StatusProxyAuthRequired {
+		t.Errorf("expected a login with another realm to be rejected, got %v", rec.Code)
+	}
+
+	if !pxy.bypassStore.Active("10.0.0.1", "youtube\\.com") {
+		t.Errorf("expected the bypass to be granted to the client's address, got %v", pxy.bypassStore.Grants())
+	}
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+
+	"go.uber.org/zap"
+)
+
+// markBlockPage serves the block page over TLS for a blocked CONNECT request, instead of the error browsers show as a
+// broken connection.  Requests the rules answered (with a bypass password challenge or a lockout) are left alone
+func (p *Proxy) markBlockPage(resp http.ResponseWriter, req *http.Request) {
+	w, ok := resp.(*responseWriter)
+
+	if !ok || !p.interceptConf.BlockPage || w.wroteHeader || !p.canIntercept(req) {
+		return
+	}
+
+	w.blockPage = true
+}
+
+// serveBlockPage completes the TLS handshake of a blocked CONNECT request with a minted certificate and answers every
+// request inside the tunnel with the block page.  Nothing is forwarded
+func (p *Proxy) serveBlockPage(w *responseWriter, req *http.Request) {
+	conn, _, err := w.Hijack()
+
+	if err != nil {
+		p.logger.Error("error hijacking a blocked connection", zap.String("client address", req.RemoteAddr), zap.Error(err))
+		return
+	}
+
+	defer conn.Close()
+
+	if _, err := conn.Write(connectEstablished); err != nil {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(req.Host)
+
+	if err != nil {
+		host = req.Host
+	}
+
+	pg := page{Page: "blocked", Title: "Website blocked", URL: host}
+
+	if p.accessRequestsConf.Enabled {
+		pg.AccessURL = p.accessRequestURL(conn.LocalAddr(), "https://"+host+"/")
+	}
+
+	p.serveTLSConn(conn, req, func(resp http.ResponseWriter, inner *http.Request) {
+		p.renderPage(resp, http.StatusForbidden, pg)
+	})
+}
+
+// blocked answers a blocked plain HTTP request that the rules didn't answer (with a bypass password challenge or a
+// lockout) with the block page, or a 403 when the block page isn't enabled
+func (p *Proxy) blocked(w *responseWriter, req *http.Request) {
+	if w.wroteHeader {
+		return
+	}
+
+	if !p.interceptConf.BlockPage {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	p.renderBlockPage(w, req)
+}
+
+// renderBlockPage answers a blocked plain HTTP (or decrypted) request with the block page
+func (p *Proxy) renderBlockPage(resp http.ResponseWriter, req *http.Request) {
+	pg := page{Page: "blocked", Title: "Website blocked", URL: req.URL.Hostname()}
+
+	if p.accessRequestsConf.Enabled {
+		local, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		pg.AccessURL = p.accessRequestURL(local, req.URL.String())
+	}
+
+	p.renderPage(resp, http.StatusForbidden, pg)
+}
+
+// accessRequestURL returns the link to the access request page for a website, using the proxy address the client
+// connected to (`local`)
+func (p *Proxy) accessRequestURL(local net.Addr, target string) string {
+	host := p.pacConfig().ProxyHost
+
+	if host == "" && local != nil {
+		host, _, _ = net.SplitHostPort(local.String())
+	}
+
+	proxy := p.proxyListener()
+
+	_, port, _ := net.SplitHostPort(proxy.Address)
+
+	scheme := "http"
+
+	if proxy.Protocol == LISTEN_PROTOCOL_TLS {
+		scheme = "https"
+	}
+
+	return scheme + "://" + net.JoinHostPort(host, port) + ACCESS_REQUEST_PATH + "?url=" + url.QueryEscape(target)
+}
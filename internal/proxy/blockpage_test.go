@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/smartystreets/cproxy/v2"
+
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/logger"
+)
+
+func TestProxy_ServeHTTP_BlockPage(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "block", "type": "host", "pattern": "^blocked\\.example\\.com", "passwordBypass": false},
+		{"access": "block", "type": "host", "pattern": "^bypass\\.example\\.com"},
+		{"access": "block", "type": "host", "pattern": "^pinned\\.example\\.com", "passwordBypass": false},
+	}
+	conf.Intercept = config.InterceptConfig{BlockPage: true, DoNotIntercept: []string{"^pinned\\."}}
+	conf.AccessRequests = config.AccessRequestsConfig{Enabled: true, MaxPending: 5}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+	pxy.handler = cproxy.New(cproxy.Options.Filter(pxy), cproxy.Options.ClientConnector(clientConnector{}))
+
+	srv := httptest.NewServer(pxy)
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pxy.ca.CertPEM())
+
+	proxyURL, _ := url.Parse(srv.URL)
+
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	resp, err := c.Get("https://blocked.example.com/some/page")
+
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status %v, got %v", http.StatusForbidden, resp.StatusCode)
+	}
+
+	if !strings.Contains(string(body), "blocked.example.com is blocked") {
+		t.Errorf("expected the block page, got %q", body)
+	}
+
+	if !strings.Contains(string(body), ACCESS_REQUEST_PATH+"?url=https%3A%2F%2Fblocked.example.com%2F") {
+		t.Errorf("expected a link to ask for access, got %q", body)
+	}
+
+	// the browser asks for the bypass password, and pinned hosts get the usual error
+	for _, host := range []string{"bypass.example.com", "pinned.example.com"} {
+		if _, err := c.Get("https://" + host + "/"); err == nil {
+			t.Errorf("%v: Get() error = nil, want the CONNECT request to fail", host)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/smartystreets/cproxy/v2"
+	"go.uber.org/zap"
+
+	"github.com/cthayer/pc-proxy/internal/client"
+	"github.com/cthayer/pc-proxy/internal/ratelimit"
+	"github.com/cthayer/pc-proxy/internal/rule"
+	"github.com/cthayer/pc-proxy/internal/throttle"
+)
+
+// responseWriter carries per-request decisions from `IsAuthorized` to the client connector
+type responseWriter struct {
+	http.ResponseWriter
+	throttle    *ratelimit.Bucket
+	wroteHeader bool
+	blockPage   bool // the block page is served over TLS instead of the response
+}
+
+// clientConnector hijacks the client connection for the tunnel, wrapping it when the request is throttled
+type clientConnector struct{}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+
+	return hijacker.Hijack()
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.blockPage {
+		return
+	}
+
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.blockPage {
+		return len(b), nil
+	}
+
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (c clientConnector) Connect(resp http.ResponseWriter) cproxy.Socket {
+	hijacker, ok := resp.(http.Hijacker)
+
+	if !ok {
+		return nil
+	}
+
+	conn, _, err := hijacker.Hijack()
+
+	if err != nil || conn == nil {
+		return nil
+	}
+
+	if w, ok := resp.(*responseWriter); ok && w.throttle != nil {
+		return throttle.NewConn(conn, w.throttle)
+	}
+
+	return conn
+}
+
+// throttleResponse limits the bandwidth of the request's tunnel.  All tunnels of the same client matching the same rule share the bandwidth
+func (p *Proxy) throttleResponse(resp http.ResponseWriter, req *http.Request, r rule.Rule) {
+	w, ok := resp.(*responseWriter)
+
+	if !ok {
+		return
+	}
+
+	id := client.IdentityFromRequest(req)
+
+	w.throttle = p.throttles.Bucket(id.Key()+"|"+r.Pattern, r.ThrottleRate)
+
+	p.logger.Debug("throttling request", zap.String("url", req.URL.String()), zap.String("client address", req.RemoteAddr), zap.String("rate", strconv.FormatInt(r.ThrottleRate, 10)+"B/s"))
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/cthayer/pc-proxy/internal/client"
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/dns"
+)
+
+const (
+	DNS_UPSTREAM_TIMEOUT = time.Second * 5
+	DNS_TCP_IDLE_TIMEOUT = time.Second * 10
+
+	// how long clients cache the sinkhole address (or the NXDOMAIN answer) of a blocked name
+	DNS_BLOCKED_TTL = time.Minute
+)
+
+func (p *Proxy) updateDns(conf config.DnsConfig) {
+	if conf.Sinkhole != "" && net.ParseIP(conf.Sinkhole) == nil {
+		p.logger.Error("invalid dns sinkhole address, answering NXDOMAIN for blocked names", zap.String("sinkhole", conf.Sinkhole))
+		conf.Sinkhole = ""
+	}
+
+	if conf.Enabled && conf.Upstream == "" {
+		p.logger.Error("invalid dns config", zap.Error(errors.New("dns upstream is required")))
+	}
+
+	p.confLock.Lock()
+	p.dnsConf = conf
+	p.confLock.Unlock()
+}
+
+// dnsConfig returns the DNS config (queries read it while the config is reloaded)
+func (p *Proxy) dnsConfig() config.DnsConfig {
+	p.confLock.RLock()
+	defer p.confLock.RUnlock()
+
+	return p.dnsConf
+}
+
+// handleDns answers a query for a name blocked by the rules, and forwards every other query to the upstream resolver
+func (p *Proxy) handleDns(query []byte, remote net.Addr, tcp bool) []byte {
+	q, err := dns.ParseQuestion(query)
+
+	if err != nil {
+		return dns.ErrorResponse(query, dns.RCODE_FORMERR)
+	}
+
+	conf := p.dnsConfig()
+
+	if p.dnsBlocked(q.Name, remote) {
+		if sinkhole := net.ParseIP(conf.Sinkhole); sinkhole != nil {
+			return dns.Response(query, q, dns.RCODE_NOERROR, []net.IP{sinkhole}, DNS_BLOCKED_TTL)
+		}
+
+		return dns.NegativeResponse(query, q, dns.RCODE_NXDOMAIN, DNS_BLOCKED_TTL)
+	}
+
+	resp, err := dns.Forward(query, conf.Upstream, tcp, DNS_UPSTREAM_TIMEOUT)
+
+	if err != nil {
+		p.logger.Warn("error forwarding a DNS query", zap.String("client address", remote.String()), zap.String("name", q.Name), zap.String("upstream", conf.Upstream), zap.Error(err))
+		return dns.ErrorResponse(query, dns.RCODE_SERVFAIL)
+	}
+
+	return resp
+}
+
+// dnsBlocked returns true when the first host rule matching the name blocks it for the client.  Bypasses the client was
+// granted apply.  Queries from the proxy's own host (a loopback or listener address) are never blocked, the proxy
+// resolves names for the sites it unlocks
+func (p *Proxy) dnsBlocked(name string, remote net.Addr) bool {
+	if name == "" || p.isProxyHost(remote) {
+		return false
+	}
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Scheme: "http", Host: name},
+		Host:       name,
+		Header:     make(http.Header),
+		RemoteAddr: remote.String(),
+	}
+
+	req = req.WithContext(client.WithIdentity(req.Context(), p.identify(req)))
+
+	for _, r := range p.Rules {
+		if r.Type != "host" || !r.Matches(req) {
+			continue
+		}
+
+		if r.Access != "block" || (r.PasswordBypass && r.Bypassed(req, p.bypass())) {
+			return false
+		}
+
+		p.logger.Info("blocked DNS query", append(clientFields(req), zap.String("name", name))...)
+
+		return true
+	}
+
+	return false
+}
+
+// dnsHosts returns the hosts the DNS server listens on, the hosts of the proxy listeners (clients use the proxy's address
+// as their resolver).  Only the wildcard address is used when a listener is on every address
+func (p *Proxy) dnsHosts() []string {
+	var hosts []string
+
+	seen := make(map[string]bool)
+
+	for _, l := range p.listenerConfigs() {
+		host, _, err := net.SplitHostPort(l.Address)
+
+		if err != nil || seen[host] {
+			continue
+		}
+
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			return []string{host}
+		}
+
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+
+	if len(hosts) == 0 {
+		hosts = []string{p.listenConf.Host}
+	}
+
+	return hosts
+}
+
+// isProxyHost returns true when the query was sent from the proxy's own host, from a loopback address or the address of
+// a listener
+func (p *Proxy) isProxyHost(remote net.Addr) bool {
+	host, _, err := net.SplitHostPort(remote.String())
+
+	if err != nil {
+		return false
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+
+	for _, l := range p.listenerConfigs() {
+		if lHost, _, err := net.SplitHostPort(l.Address); err == nil && sameIP(host, lHost) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Proxy) listenDns() error {
+	conf := p.dnsConfig()
+
+	for _, host := range p.dnsHosts() {
+		addr := net.JoinHostPort(host, strconv.Itoa(conf.Port))
+
+		conn, err := p.listenUDP(addr)
+
+		if err != nil {
+			return err
+		}
+
+		l, err := p.listenTCP(addr)
+
+		if err != nil {
+			conn.Close()
+			return err
+		}
+
+		// closed on shutdown
+		p.dnsConns = append(p.dnsConns, conn)
+		p.dnsListeners = append(p.dnsListeners, l)
+
+		p.logger.Info("DNS server listening", zap.String("listen address", addr), zap.String("upstream", conf.Upstream))
+
+		p.waitGroup.Add(2)
+		go func() {
+			defer p.waitGroup.Done()
+
+			dns.ServeUDP(conn, p.handleDns)
+		}()
+
+		go func() {
+			defer p.waitGroup.Done()
+
+			dns.ServeTCP(l, p.handleDns, DNS_TCP_IDLE_TIMEOUT)
+		}()
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/dns"
+	"github.com/cthayer/pc-proxy/internal/logger"
+)
+
+func dnsQuery(name string) []byte {
+	msg := []byte{0xab, 0xcd, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+
+	for _, label := range strings.Split(name, ".") {
+		msg = append(append(msg, byte(len(label))), label...)
+	}
+
+	return append(msg, 0, 0, dns.TYPE_A, 0, dns.CLASS_IN)
+}
+
+func TestProxy_handleDns(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	// a stub resolver that answers every query with 192.0.2.1
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+
+	defer upstream.Close()
+
+	go dns.ServeUDP(upstream, func(query []byte, remote net.Addr, tcp bool) []byte {
+		q, _ := dns.ParseQuestion(query)
+		return dns.Response(query, q, dns.RCODE_NOERROR, []net.IP{net.ParseIP("192.0.2.1")}, time.Minute)
+	})
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "allow", "type": "host", "pattern": "^www\\.youtube\\.com", "clients": []interface{}{"192.168.1.20"}},
+		{"access": "block", "type": "path", "pattern": "^/"},
+		{"access": "block", "type": "host", "pattern": "youtube\\.com$"},
+	}
+
+	conf.Listen.Listeners = []config.ListenerConfig{{Address: "192.168.1.1:8080"}}
+
+	client := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 5353}
+
+	tests := []struct {
+		name     string
+		sinkhole string
+		query    string
+		remote   net.Addr
+		wantCode uint16
+		wantAddr []byte
+	}{
+		{name: "allowed", query: "example.com", remote: client, wantCode: dns.RCODE_NOERROR, wantAddr: []byte{192, 0, 2, 1}},
+		{name: "blocked", query: "www.youtube.com", remote: client, wantCode: dns.RCODE_NXDOMAIN},
+		{name: "sinkhole", sinkhole: "10.0.0.1", query: "www.youtube.com", remote: client, wantCode: dns.RCODE_NOERROR, wantAddr: []byte{10, 0, 0, 1}},
+		{name: "allowed client", query: "www.youtube.com", remote: &net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5353}, wantCode: dns.RCODE_NOERROR, wantAddr: []byte{192, 0, 2, 1}},
+		{name: "proxy host", query: "www.youtube.com", remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}, wantCode: dns.RCODE_NOERROR, wantAddr: []byte{192, 0, 2, 1}},
+		{name: "proxy listener address", query: "www.youtube.com", remote: &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 5353}, wantCode: dns.RCODE_NOERROR, wantAddr: []byte{192, 0, 2, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf.Dns = config.DnsConfig{Enabled: true, Upstream: upstream.LocalAddr().String(), Sinkhole: tt.sinkhole}
+
+			pxy := New()
+			pxy.LoadConfig(&conf)
+
+			resp := pxy.handleDns(dnsQuery(tt.query), tt.remote, false)
+
+			if code := binary.BigEndian.Uint16(resp[2:4]) & 0x0f; code != tt.wantCode {
+				t.Errorf("rcode = %v, want %v", code, tt.wantCode)
+			}
+
+			if tt.wantAddr != nil && !bytes.HasSuffix(resp, tt.wantAddr) {
+				t.Errorf("response = %x, want the address %v", resp, net.IP(tt.wantAddr))
+			}
+
+			// NXDOMAIN answers have an SOA record, so resolvers cache them
+			if authority := binary.BigEndian.Uint16(resp[8:10]); (tt.wantCode == dns.RCODE_NXDOMAIN) != (authority == 1) {
+				t.Errorf("authority records = %v for rcode %v", authority, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestProxy_dnsHosts(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	tests := []struct {
+		listeners []config.ListenerConfig
+		want      string
+	}{
+		{nil, "127.0.0.1"},
+		{[]config.ListenerConfig{{Address: "192.168.1.1:8080"}, {Address: "192.168.1.1:8443", Protocol: "tls"}, {Address: "[fd00::1]:8080"}}, "192.168.1.1,fd00::1"},
+		{[]config.ListenerConfig{{Address: "192.168.1.1:8080"}, {Address: ":8081"}}, ""},
+		{[]config.ListenerConfig{{Address: "192.168.1.1:8080"}, {Address: "0.0.0.0:8081"}}, "0.0.0.0"},
+	}
+
+	for _, tt := range tests {
+		conf := *config.GetConfig()
+		conf.Listen.Host = "127.0.0.1"
+		conf.Listen.Listeners = tt.listeners
+
+		pxy := New()
+		pxy.LoadConfig(&conf)
+
+		if got := strings.Join(pxy.dnsHosts(), ","); got != tt.want {
+			t.Errorf("dnsHosts() with %v = %q, want %q", tt.listeners, got, tt.want)
+		}
+	}
+}
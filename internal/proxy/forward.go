@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+
+	"go.uber.org/zap"
+
+	"github.com/cthayer/pc-proxy/internal/throttle"
+	"github.com/cthayer/pc-proxy/internal/transparent"
+)
+
+// newUpstreamTransport returns the transport of plain HTTP requests forwarded through the upstream proxy (a tunnel to the
+// destination is opened through it, like for CONNECT requests)
+func (p *Proxy) newUpstreamTransport() *http.Transport {
+	t := transparent.NewTransport()
+
+	t.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return p.upstreamDialer.Dial(addr)
+	}
+
+	return t
+}
+
+// forward checks a plain HTTP proxy request (`GET http://example.com/ HTTP/1.1`) against the rules and forwards it to
+// its destination when it is allowed.  cproxy only handles CONNECT requests
+func (p *Proxy) forward(resp http.ResponseWriter, req *http.Request) {
+	w := &responseWriter{ResponseWriter: resp}
+
+	if !p.IsAuthorized(w, req) {
+		p.blocked(w, req)
+		return
+	}
+
+	if w.throttle != nil {
+		resp = &throttledResponseWriter{ResponseWriter: resp, w: throttle.NewWriter(resp, w.throttle)}
+	}
+
+	transport := p.transport
+
+	if p.useUpstream(req) {
+		p.logger.Debug("forwarding request through the upstream proxy", zap.String("url", req.URL.String()), zap.String("client address", req.RemoteAddr))
+		transport = p.upstreamTransport
+	}
+
+	forwarder := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.Header["X-Forwarded-For"] = nil
+		},
+		Transport: transport,
+		ErrorHandler: func(resp http.ResponseWriter, req *http.Request, err error) {
+			p.logger.Warn("error forwarding a request", zap.String("client address", req.RemoteAddr), zap.String("url", req.URL.String()), zap.Error(err))
+			http.Error(resp, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		},
+	}
+
+	forwarder.ServeHTTP(resp, req)
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/logger"
+)
+
+func TestProxy_ServeHTTP_Forward(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		_, _ = resp.Write([]byte(req.URL.Path + " " + req.Header.Get("Proxy-Authorization") + req.Header.Get("X-Forwarded-For")))
+	}))
+	defer origin.Close()
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "block", "type": "path", "pattern": "^/games", "passwordBypass": false},
+		{"access": "block", "type": "path", "pattern": "^/videos"},
+	}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	srv := httptest.NewServer(pxy)
+	defer srv.Close()
+
+	proxyURL, _ := url.Parse(srv.URL)
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/homework", http.StatusOK, "/homework "},
+		{"/games", http.StatusForbidden, ""},
+		{"/videos", http.StatusProxyAuthRequired, ""},
+	}
+
+	for _, tt := range tests {
+		// an absolute form request (`GET http://host/path`), like a browser sends for plain HTTP sites
+		req, _ := http.NewRequest("GET", origin.URL+tt.path, nil)
+		req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+
+		resp, err := c.Do(req)
+
+		if err != nil {
+			t.Fatalf("%v: request error = %v", tt.path, err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("%v: expected status %v, got %v", tt.path, tt.status, resp.StatusCode)
+		}
+
+		if tt.body != "" && string(body) != tt.body {
+			t.Errorf("%v: expected %q from the origin, got %q", tt.path, tt.body, body)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/cthayer/pc-proxy/internal/arp"
+	"github.com/cthayer/pc-proxy/internal/client"
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/lease"
+)
+
+func (p *Proxy) updateArp(conf config.ArpConfig) {
+	if !conf.Enabled {
+		p.arp = nil
+		return
+	}
+
+	p.arp = arp.New(conf.File, conf.CacheTime)
+
+	p.logger.Info("identifying clients by MAC address", zap.String("arpFile", conf.File), zap.Duration("cacheTime", conf.CacheTime))
+}
+
+func (p *Proxy) updateLeases(conf config.LeasesConfig) {
+	if !conf.Enabled {
+		p.leases = nil
+		return
+	}
+
+	table, err := lease.New(conf.File, conf.Format)
+
+	if err != nil {
+		p.logger.Error("error loading the DHCP leases", zap.String("leasesFile", conf.File), zap.Error(err))
+		p.leases = nil
+		return
+	}
+
+	p.leases = table
+
+	p.logger.Info("naming clients from the DHCP leases", zap.String("leasesFile", conf.File), zap.String("format", conf.Format))
+}
+
+// identify returns the client's identity, adding what is known about the client's address
+func (p *Proxy) identify(req *http.Request) client.Identity {
+	id := client.IdentityFromRequest(req)
+
+	if table := p.arp; table != nil {
+		mac, ok, err := table.Lookup(id.IP)
+
+		if err != nil {
+			p.logger.Debug("error reading the ARP or neighbour table", zap.Error(err))
+		}
+
+		if ok {
+			id.MAC = mac
+		}
+	}
+
+	if table := p.leases; table != nil {
+		name, ok, err := table.Lookup(id.IP, id.MAC)
+
+		if err != nil {
+			p.logger.Debug("error reading the DHCP leases", zap.Error(err))
+		}
+
+		if ok {
+			id.Name = name
+		}
+	}
+
+	return id
+}
+
+// clientFields are the log fields that identify the client that made the request
+func clientFields(req *http.Request) []zap.Field {
+	fields := []zap.Field{zap.String("client address", req.RemoteAddr)}
+
+	if name := client.IdentityFromRequest(req).Name; name != "" {
+		fields = append(fields, zap.String("client name", name))
+	}
+
+	return fields
+}
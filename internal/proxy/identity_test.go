@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/cthayer/pc-proxy/internal/client"
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/logger"
+)
+
+func TestProxy_ServeHTTP_MAC(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "block", "type": "host", "pattern": "youtube\\.com", "clients": []interface{}{"mac:aa:bb:cc:dd:ee:01"}},
+	}
+	conf.Arp = config.ArpConfig{Enabled: true, File: filepath.Join("..", "..", "test", "arp"), CacheTime: config.DEFAULT_ARP_CACHE_TIME}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	var identity client.Identity
+
+	pxy.handler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		identity = client.IdentityFromRequest(req)
+
+		if pxy.IsAuthorized(resp, req) {
+			resp.WriteHeader(http.StatusOK)
+		}
+	})
+
+	tests := []struct {
+		remoteAddr string
+		key        string
+		status     int
+	}{
+		{"192.168.1.10:1234", "mac:aa:bb:cc:dd:ee:01", http.StatusProxyAuthRequired},
+		{"192.168.1.11:1234", "mac:aa:bb:cc:dd:ee:02", http.StatusOK},
+		{"192.168.1.99:1234", "192.168.1.99", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("CONNECT", "www.youtube.com:443", nil)
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+
+		pxy.ServeHTTP(rec, req)
+
+		if identity.Key() != tt.key {
+			t.Errorf("%v: expected the client key %v, got %v", tt.remoteAddr, tt.key, identity.Key())
+		}
+
+		if rec.Code != tt.status {
+			t.Errorf("%v: expected status %v, got %v", tt.remoteAddr, tt.status, rec.Code)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_Name(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "block", "type": "host", "pattern": "youtube\\.com", "clients": []interface{}{"name:kids-laptop"}},
+	}
+	conf.Arp = config.ArpConfig{Enabled: true, File: filepath.Join("..", "..", "test", "arp"), CacheTime: config.DEFAULT_ARP_CACHE_TIME}
+	conf.Leases = config.LeasesConfig{Enabled: true, File: filepath.Join("..", "..", "test", "dnsmasq.leases"), Format: config.DEFAULT_LEASES_FORMAT}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	var identity client.Identity
+
+	pxy.handler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		identity = client.IdentityFromRequest(req)
+
+		if pxy.IsAuthorized(resp, req) {
+			resp.WriteHeader(http.StatusOK)
+		}
+	})
+
+	tests := []struct {
+		remoteAddr string
+		name       string
+		status     int
+	}{
+		{"192.168.1.10:1234", "kids-laptop", http.StatusProxyAuthRequired},
+		{"192.168.1.20:1234", "tablet", http.StatusOK},
+		{"192.168.1.99:1234", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("CONNECT", "www.youtube.com:443", nil)
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+
+		pxy.ServeHTTP(rec, req)
+
+		if identity.Name != tt.name {
+			t.Errorf("%v: expected the client name %v, got %v", tt.remoteAddr, tt.name, identity.Name)
+		}
+
+		if rec.Code != tt.status {
+			t.Errorf("%v: expected status %v, got %v", tt.remoteAddr, tt.status, rec.Code)
+		}
+	}
+}
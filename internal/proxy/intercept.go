@@ -0,0 +1,310 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/cthayer/pc-proxy/internal/client"
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/mitm"
+	"github.com/cthayer/pc-proxy/internal/throttle"
+	"github.com/cthayer/pc-proxy/internal/transparent"
+)
+
+const (
+	CA_CERT_FILE = "ca.pem"
+	CA_KEY_FILE  = "ca-key.pem"
+
+	// clients download the CA certificate from the proxy to install it
+	CA_CERT_PATH = "/ca.crt"
+
+	// how long an intercepted connection can stay idle between requests
+	INTERCEPT_IDLE_TIMEOUT = time.Minute * 2
+)
+
+var (
+	// the response to a CONNECT request when the tunnel is ready
+	connectEstablished = []byte("HTTP/1.1 200 OK\r\n\r\n")
+)
+
+// connListener serves a single connection with an `http.Server`
+type connListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+
+	l.once.Do(func() {
+		conn = l.conn
+	})
+
+	if conn != nil {
+		return conn, nil
+	}
+
+	// the server stops when the connection is done
+	<-l.closed
+
+	return nil, http.ErrServerClosed
+}
+
+func (l *connListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (p *Proxy) updateIntercept(conf config.InterceptConfig) {
+	p.doNotIntercept = p.hostPatterns("intercept doNotIntercept", conf.DoNotIntercept)
+	p.interceptConf = conf
+
+	if !conf.Enabled && !conf.BlockPage {
+		return
+	}
+
+	certFile, keyFile := conf.CaCert, conf.CaKey
+
+	if certFile == "" && keyFile == "" && p.dataDir != "" {
+		certFile, keyFile = filepath.Join(p.dataDir, CA_CERT_FILE), filepath.Join(p.dataDir, CA_KEY_FILE)
+
+		if err := os.MkdirAll(p.dataDir, DATA_DIR_PERMS); err != nil {
+			p.logger.Error("Error creating data directory", zap.String("dataDir", p.dataDir), zap.Error(err))
+		}
+	}
+
+	if p.ca != nil && p.caFiles == certFile+"|"+keyFile {
+		return
+	}
+
+	if certFile == "" || keyFile == "" {
+		// clients must install the CA again after every restart
+		certPEM, keyPEM, err := mitm.Generate(mitm.CA_COMMON_NAME)
+
+		if err == nil {
+			p.ca, err = mitm.New(certPEM, keyPEM)
+		}
+
+		if err != nil {
+			p.logger.Error("error generating the interception CA", zap.Error(err))
+			return
+		}
+
+		p.caFiles = "|"
+		p.logger.Warn("using a temporary interception CA, set intercept caCert and caKey (or dataDir) to keep it")
+		return
+	}
+
+	ca, err := mitm.LoadOrCreate(certFile, keyFile)
+
+	if err != nil {
+		// keep the last good CA
+		p.logger.Error("error loading the interception CA", zap.String("caCert", certFile), zap.String("caKey", keyFile), zap.Error(err))
+		return
+	}
+
+	p.ca, p.caFiles = ca, certFile+"|"+keyFile
+
+	p.logger.Info("interception CA loaded", zap.String("caCert", certFile))
+}
+
+// shouldIntercept returns true when a CONNECT request is decrypted: the rule that matches it has `intercept` set and the
+// host isn't on the do not intercept list (apps that pin their certificates break when intercepted)
+func (p *Proxy) shouldIntercept(req *http.Request) bool {
+	if !p.interceptConf.Enabled || !p.canIntercept(req) {
+		return false
+	}
+
+	for _, r := range p.Rules {
+		if r.Matches(req) {
+			return r.Intercept
+		}
+	}
+
+	return false
+}
+
+// canIntercept returns true when a certificate can be minted for a CONNECT request (the CA is loaded and the host isn't on
+// the do not intercept list)
+func (p *Proxy) canIntercept(req *http.Request) bool {
+	if p.ca == nil || req.Method != http.MethodConnect {
+		return false
+	}
+
+	for _, re := range p.doNotIntercept {
+		if re.MatchString(req.Host) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// intercept checks a CONNECT request against the rules, then completes the TLS handshake with a minted certificate and
+// serves the requests inside the tunnel with `handleIntercepted`
+func (p *Proxy) intercept(resp http.ResponseWriter, req *http.Request) {
+	w := &responseWriter{ResponseWriter: resp}
+
+	if !p.IsAuthorized(w, req) {
+		if w.blockPage {
+			p.serveBlockPage(w, req)
+		} else if !w.wroteHeader {
+			http.Error(resp, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		}
+
+		return
+	}
+
+	conn, _, err := w.Hijack()
+
+	if err != nil {
+		p.logger.Error("error hijacking an intercepted connection", zap.String("client address", req.RemoteAddr), zap.Error(err))
+		return
+	}
+
+	defer conn.Close()
+
+	if _, err := conn.Write(connectEstablished); err != nil {
+		return
+	}
+
+	var clientConn net.Conn = conn
+
+	if w.throttle != nil {
+		clientConn = throttle.NewConn(conn, w.throttle)
+	}
+
+	p.logger.Debug("intercepting connection", zap.String("host", req.Host), zap.String("client address", req.RemoteAddr))
+
+	transport := p.interceptTransport(req)
+	defer transport.CloseIdleConnections()
+
+	p.serveTLSConn(clientConn, req, func(resp http.ResponseWriter, inner *http.Request) {
+		p.handleIntercepted(resp, inner, req, transport)
+	})
+}
+
+// serveTLSConn completes the TLS handshake of a CONNECT request's tunnel with a minted certificate and serves the requests
+// inside it until the connection is closed
+func (p *Proxy) serveTLSConn(conn net.Conn, connect *http.Request, handler http.HandlerFunc) {
+	host, _, err := net.SplitHostPort(connect.Host)
+
+	if err != nil {
+		host = connect.Host
+	}
+
+	l := newConnListener(tls.Server(conn, p.ca.TLSConfig(host)))
+
+	srv := &http.Server{
+		Handler:     handler,
+		IdleTimeout: INTERCEPT_IDLE_TIMEOUT,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				_ = l.Close()
+			}
+		},
+	}
+
+	_ = srv.Serve(l)
+}
+
+// handleIntercepted checks a request from inside an intercepted tunnel against the rules and forwards it to the tunnel's
+// destination when it is allowed.  Blocked requests get the block page
+func (p *Proxy) handleIntercepted(resp http.ResponseWriter, req *http.Request, connect *http.Request, transport http.RoundTripper) {
+	if req.Host == "" {
+		req.Host = connect.Host
+	}
+
+	req.URL.Scheme = "https"
+	req.URL.Host = req.Host
+	req.RequestURI = req.URL.String()
+
+	// the requests use the identity of the tunnel's client
+	req = req.WithContext(client.WithIdentity(req.Context(), client.IdentityFromRequest(connect)))
+
+	// the browser can't be asked for the bypass password inside the tunnel (it only answers a 407 to a proxy request), so
+	// a password sent with the CONNECT request is used
+	if proxyAuth := connect.Header.Get("Proxy-Authorization"); proxyAuth != "" {
+		req.Header.Set("Proxy-Authorization", proxyAuth)
+	} else {
+		req.Header.Del("Proxy-Authorization")
+	}
+
+	// the rules' challenges are discarded
+	w := &responseWriter{ResponseWriter: &discardResponseWriter{}}
+
+	if !p.IsAuthorized(w, req) {
+		// the block page links to the access request page, to ask for the site to be unlocked
+		p.renderBlockPage(resp, req)
+		return
+	}
+
+	if w.throttle != nil {
+		resp = &throttledResponseWriter{ResponseWriter: resp, w: throttle.NewWriter(resp, w.throttle)}
+	}
+
+	forwarder := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			// connect to the tunnel's destination, the host header is kept
+			out.URL.Host = connect.Host
+
+			out.Header["X-Forwarded-For"] = nil
+		},
+		Transport: transport,
+		ErrorHandler: func(resp http.ResponseWriter, req *http.Request, err error) {
+			p.logger.Warn("error forwarding an intercepted request", zap.String("client address", req.RemoteAddr), zap.String("destination", connect.Host), zap.Error(err))
+			http.Error(resp, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		},
+	}
+
+	forwarder.ServeHTTP(resp, req)
+}
+
+// interceptTransport returns the transport of an intercepted tunnel.  It connects like the tunnel would have (directly
+// or through the upstream proxy)
+func (p *Proxy) interceptTransport(connect *http.Request) *http.Transport {
+	t := transparent.NewTransport()
+	t.TLSClientConfig = p.originTLS
+
+	t.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return p.dial(connect, addr)
+	}
+
+	return t
+}
+
+// handleCaCert serves the interception CA certificate, so clients can install it
+func (p *Proxy) handleCaCert(resp http.ResponseWriter, req *http.Request) {
+	if (!p.interceptConf.Enabled && !p.interceptConf.BlockPage) || p.ca == nil {
+		http.NotFound(resp, req)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	resp.Header().Set("Content-Disposition", "attachment; filename=\"pc-proxy-ca.crt\"")
+
+	_, _ = resp.Write(p.ca.CertPEM())
+}
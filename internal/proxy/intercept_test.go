@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/logger"
+)
+
+func TestProxy_intercept(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		_, _ = resp.Write([]byte("hello " + req.URL.Path))
+	}))
+	defer origin.Close()
+
+	dir, err := ioutil.TempDir("", "intercept")
+
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	conf := *config.GetConfig()
+	conf.DataDir = dir
+	conf.Rules = []map[string]interface{}{
+		{"access": "block", "type": "path", "pattern": "^/shorts", "passwordBypass": false},
+		{"access": "block", "type": "path", "pattern": "^/games"},
+		{"access": "allow", "type": "host", "pattern": "^127\\.0\\.0\\.1", "intercept": true},
+	}
+	conf.Intercept = config.InterceptConfig{Enabled: true}
+
+	_ = os.Setenv(BYPASS_PASSWD_ENV_NAME, "secret")
+	t.Cleanup(func() { _ = os.Unsetenv(BYPASS_PASSWD_ENV_NAME) })
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	if pxy.ca == nil {
+		t.Fatal("expected the CA to be generated")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, CA_KEY_FILE)); err != nil {
+		t.Errorf("expected the CA to be saved in the data dir: %v", err)
+	}
+
+	pxy.originTLS = &tls.Config{RootCAs: x509.NewCertPool()}
+	pxy.originTLS.RootCAs.AddCert(origin.Certificate())
+
+	srv := httptest.NewServer(pxy)
+	defer srv.Close()
+
+	// clients trust the CA they downloaded from the proxy
+	caResp, err := http.Get(srv.URL + CA_CERT_PATH)
+
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+
+	caPEM, _ := ioutil.ReadAll(caResp.Body)
+	caResp.Body.Close()
+
+	roots := x509.NewCertPool()
+
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatalf("expected the CA certificate, got %q", caPEM)
+	}
+
+	proxyURL, _ := url.Parse(srv.URL)
+
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	// the client sends the bypass password with the CONNECT requests
+	bypassURL := *proxyURL
+	bypassURL.User = url.UserPassword("kid", "secret")
+
+	bypassClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&bypassURL), TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	tests := []struct {
+		client   *http.Client
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{client: c, path: "/videos", wantCode: http.StatusOK, wantBody: "hello /videos"},
+		{client: c, path: "/shorts/abc", wantCode: http.StatusForbidden, wantBody: "is blocked by the proxy"},
+		// a 407 inside the tunnel isn't a proxy challenge the browser would answer
+		{client: c, path: "/games", wantCode: http.StatusForbidden, wantBody: "is blocked by the proxy"},
+		{client: bypassClient, path: "/games", wantCode: http.StatusOK, wantBody: "hello /games"},
+	}
+
+	for _, tt := range tests {
+		resp, err := tt.client.Get(origin.URL + tt.path)
+
+		if err != nil {
+			t.Fatalf("%v: Get() error = %v", tt.path, err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.wantCode {
+			t.Errorf("%v: expected status %v, got %v", tt.path, tt.wantCode, resp.StatusCode)
+		}
+
+		if !strings.Contains(string(body), tt.wantBody) {
+			t.Errorf("%v: expected body %q, got %q", tt.path, tt.wantBody, body)
+		}
+	}
+}
+
+func TestProxy_shouldIntercept(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "allow", "type": "host", "pattern": "youtube\\.com", "intercept": true},
+		{"access": "allow", "type": "host", "pattern": "example\\.com"},
+	}
+	conf.Intercept = config.InterceptConfig{Enabled: true, DoNotIntercept: []string{"^app\\.youtube\\.com"}}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	for host, want := range map[string]bool{"www.youtube.com:443": true, "app.youtube.com:443": false, "www.example.com:443": false} {
+		if got := pxy.shouldIntercept(httptest.NewRequest("CONNECT", host, nil)); got != want {
+			t.Errorf("%v: shouldIntercept() = %v, want %v", host, got, want)
+		}
+	}
+}
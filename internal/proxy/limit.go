@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/cthayer/pc-proxy/internal/client"
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/ratelimit"
+)
+
+type clientGroup struct {
+	client.Group
+	limits config.ClientGroupConfig
+}
+
+func (p *Proxy) updateClientGroups(rateLimit config.RateLimitConfig, groups []config.ClientGroupConfig) {
+	var newGroups []clientGroup
+
+	for _, g := range groups {
+		group, err := client.NewGroup(g.Name, g.Clients)
+
+		if err != nil {
+			// skip invalid groups rather than failing the whole config
+			p.logger.Error("invalid client group", zap.String("name", g.Name), zap.Error(err))
+			continue
+		}
+
+		newGroups = append(newGroups, clientGroup{Group: group, limits: g})
+	}
+
+	p.clientLock.Lock()
+	defer p.clientLock.Unlock()
+
+	p.rateLimitConf = rateLimit
+	p.clientGroups = newGroups
+
+	p.logger.Info("new client groups loaded", zap.Any("clientGroups", groups), zap.Any("rateLimit", rateLimit))
+}
+
+// clientLimits returns the global limits overridden by the first client group the client belongs to
+func (p *Proxy) clientLimits(id client.Identity) ratelimit.Limits {
+	p.clientLock.RLock()
+	defer p.clientLock.RUnlock()
+
+	limits := ratelimit.Limits{
+		RequestsPerSecond: p.rateLimitConf.RequestsPerSecond,
+		Burst:             p.rateLimitConf.Burst,
+		MaxConnections:    p.rateLimitConf.MaxConnections,
+	}
+
+	for _, g := range p.clientGroups {
+		if !g.Matches(id) {
+			continue
+		}
+
+		// the burst belongs to the request rate, so they are overridden together
+		if g.limits.RequestsPerSecond > 0 {
+			limits.RequestsPerSecond = g.limits.RequestsPerSecond
+			limits.Burst = g.limits.Burst
+		}
+
+		if g.limits.MaxConnections > 0 {
+			limits.MaxConnections = g.limits.MaxConnections
+		}
+
+		break
+	}
+
+	return limits
+}
+
+func (p *Proxy) manageRateLimiter() {
+	// this function is run in a background go thread
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(time.Minute):
+		}
+
+		p.limiter.Prune()
+		p.throttles.Prune()
+
+		counters := p.limiter.Counters()
+
+		if counters.RateLimited > 0 || counters.ConnectionsRefused > 0 {
+			p.logger.Debug("rate limiter counters", zap.Uint64("rateLimitedTotal", counters.RateLimited), zap.Uint64("connectionsRefusedTotal", counters.ConnectionsRefused))
+		}
+	}
+}
+
+// acquire applies the client's request rate and connection limits.  When it returns true, `p.limiter.Release` must be
+// called with the client's key once the request is done
+func (p *Proxy) acquire(req *http.Request, id client.Identity) bool {
+	limits := p.clientLimits(id)
+
+	if !p.limiter.Allow(id.Key(), limits) {
+		p.logger.Warn("client request rate limit exceeded", zap.String("client address", req.RemoteAddr), zap.String("url", req.URL.String()), zap.Float64("requestsPerSecond", limits.RequestsPerSecond), zap.Uint64("rateLimitedTotal", p.limiter.Counters().RateLimited))
+		return false
+	}
+
+	if !p.limiter.Acquire(id.Key(), limits) {
+		p.logger.Warn("client connection limit exceeded", zap.String("client address", req.RemoteAddr), zap.String("url", req.URL.String()), zap.Int("maxConnections", limits.MaxConnections), zap.Uint64("connectionsRefusedTotal", p.limiter.Counters().ConnectionsRefused))
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/cthayer/pc-proxy/internal/config"
+)
+
+const (
+	LISTEN_PROTOCOL_HTTP = "http"
+	LISTEN_PROTOCOL_TLS  = "tls"
+)
+
+// the protocols offered by the tls listeners (the same as http.Server.ServeTLS)
+var serverNextProtos = []string{"h2", "http/1.1"}
+
+// listener is a proxy listener.  Each listener has its own server, so it can be shut down without dropping the
+// connections of the others
+type listener struct {
+	conf    config.ListenerConfig
+	srv     *http.Server
+	l       net.Listener
+	socket  net.Listener // the listening socket (`l` wraps it)
+	stopped int32
+}
+
+// close stops accepting connections, freeing the address right away.  The server keeps its connections until it is
+// shut down
+func (l *listener) close() {
+	atomic.StoreInt32(&l.stopped, 1)
+	_ = l.l.Close()
+}
+
+// closeOnceListener lets the listener be closed before its server is shut down (the server closes it again)
+type closeOnceListener struct {
+	net.Listener
+	once sync.Once
+	err  error
+}
+
+func (l *closeOnceListener) Close() error {
+	l.once.Do(func() {
+		l.err = l.Listener.Close()
+	})
+
+	return l.err
+}
+
+// updateListen validates the proxy listeners.  The `host`, `port` and `tlsPort` settings are used when no listeners are
+// configured
+func (p *Proxy) updateListen(conf config.ListenConfig) {
+	confs := p.validListeners(conf)
+
+	// requests read the listeners (to find the requests for the proxy itself)
+	p.listenLock.Lock()
+	p.listenConf, p.listenerConfs = conf, confs
+	p.listenLock.Unlock()
+}
+
+// validListeners returns the configured listeners, ignoring the invalid ones
+func (p *Proxy) validListeners(conf config.ListenConfig) []config.ListenerConfig {
+	if len(conf.Listeners) == 0 {
+		confs := []config.ListenerConfig{{Address: net.JoinHostPort(conf.Host, strconv.Itoa(conf.Port)), Protocol: LISTEN_PROTOCOL_HTTP}}
+
+		if p.tlsConf.Enabled {
+			confs = append(confs, config.ListenerConfig{Address: net.JoinHostPort(conf.Host, strconv.Itoa(conf.TlsPort)), Protocol: LISTEN_PROTOCOL_TLS})
+		}
+
+		return confs
+	}
+
+	var confs []config.ListenerConfig
+
+	seen := make(map[config.ListenerConfig]bool)
+
+	for _, l := range conf.Listeners {
+		l.Protocol = strings.ToLower(l.Protocol)
+
+		if l.Protocol == "" {
+			l.Protocol = LISTEN_PROTOCOL_HTTP
+		}
+
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			p.logger.Error("invalid listener address, ignoring the listener", zap.String("address", l.Address), zap.Error(err))
+			continue
+		}
+
+		if l.Protocol != LISTEN_PROTOCOL_HTTP && l.Protocol != LISTEN_PROTOCOL_TLS {
+			p.logger.Error("invalid listener protocol, ignoring the listener", zap.String("address", l.Address), zap.String("protocol", l.Protocol))
+			continue
+		}
+
+		if seen[l] {
+			continue
+		}
+
+		seen[l] = true
+		confs = append(confs, l)
+	}
+
+	return confs
+}
+
+// proxyListener returns the listener clients are told to use (in the PAC file and links to the proxy), the first http
+// listener
+func (p *Proxy) proxyListener() config.ListenerConfig {
+	p.listenLock.Lock()
+	confs, listenConf := p.listenerConfs, p.listenConf
+	p.listenLock.Unlock()
+
+	for _, l := range confs {
+		if l.Protocol == LISTEN_PROTOCOL_HTTP {
+			return l
+		}
+	}
+
+	if len(confs) > 0 {
+		return confs[0]
+	}
+
+	return config.ListenerConfig{Address: net.JoinHostPort(listenConf.Host, strconv.Itoa(listenConf.Port)), Protocol: LISTEN_PROTOCOL_HTTP}
+}
+
+// listenerConfigs returns the configured listeners (the slice is replaced, not changed, when the config is reloaded)
+func (p *Proxy) listenerConfigs() []config.ListenerConfig {
+	p.listenLock.Lock()
+	defer p.listenLock.Unlock()
+
+	return p.listenerConfs
+}
+
+// updateListeners starts the configured listeners that aren't running, and shuts down the running listeners that were
+// removed from the config (after their requests finish).  The other listeners keep running with their connections.  Does
+// nothing until the proxy is started
+func (p *Proxy) updateListeners() error {
+	p.listenLock.Lock()
+	defer p.listenLock.Unlock()
+
+	if p.listeners == nil {
+		return nil
+	}
+
+	var firstErr error
+
+	wanted := make(map[config.ListenerConfig]bool)
+	tlsReady := false
+
+	for _, conf := range p.listenerConfs {
+		wanted[conf] = true
+
+		if conf.Protocol == LISTEN_PROTOCOL_TLS {
+			tlsReady = true
+		}
+	}
+
+	var removed []*listener
+
+	for conf, l := range p.listeners {
+		if !wanted[conf] {
+			l.close()
+			delete(p.listeners, conf)
+			removed = append(removed, l)
+		}
+	}
+
+	if len(removed) > 0 {
+		p.waitGroup.Add(1)
+		go func() {
+			defer p.waitGroup.Done()
+
+			for _, err := range p.shutdownListeners(removed) {
+				p.logger.Error("Error shutting down a listener", zap.Error(err))
+			}
+		}()
+	}
+
+	// load the certificate for the tls listeners (running listeners use it for new connections)
+	if tlsReady {
+		if err := p.setupTls(); err != nil {
+			p.logger.Error("Error loading the TLS certificate", zap.Error(err))
+			firstErr = err
+			tlsReady = false
+		}
+	}
+
+	for _, conf := range p.listenerConfs {
+		if p.listeners[conf] != nil || (conf.Protocol == LISTEN_PROTOCOL_TLS && !tlsReady) {
+			continue
+		}
+
+		l, err := p.listen(conf)
+
+		if err != nil {
+			p.logger.Error("Error starting a listener", zap.String("listen address", conf.Address), zap.String("protocol", conf.Protocol), zap.Error(err))
+
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			continue
+		}
+
+		p.listeners[conf] = l
+	}
+
+	return firstErr
+}
+
+func (p *Proxy) listen(conf config.ListenerConfig) (*listener, error) {
+	nl, err := p.listenTCP(conf.Address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listener{
+		conf:   conf,
+		srv:    &http.Server{Addr: conf.Address, Handler: p},
+		l:      &closeOnceListener{Listener: nl},
+		socket: nl,
+	}
+
+	name := "HTTP"
+
+	if conf.Protocol == LISTEN_PROTOCOL_TLS {
+		name = "HTTPS"
+
+		// the certificate can change when the config is reloaded
+		l.srv.TLSConfig = &tls.Config{NextProtos: serverNextProtos, GetConfigForClient: p.serverTLSConfig}
+		l.l = tls.NewListener(l.l, l.srv.TLSConfig)
+	}
+
+	p.logger.Info(name+" server listening", zap.String("listen address", nl.Addr().String()))
+
+	p.waitGroup.Add(1)
+	go func() {
+		defer p.waitGroup.Done()
+
+		// this will block until the server is stopped or an error occurs
+		err := l.srv.Serve(l.l)
+
+		// if the server exits for any reason other than being stopped, log the error
+		if err != http.ErrServerClosed && atomic.LoadInt32(&l.stopped) == 0 {
+			p.logger.Error("Error serving "+name+" requests", zap.String("listen address", conf.Address), zap.Error(err))
+		}
+	}()
+
+	return l, nil
+}
+
+// shutdownListeners shuts down the servers of closed listeners, waiting for their requests to finish
+func (p *Proxy) shutdownListeners(listeners []*listener) []error {
+	var errs []error
+	var errsLock sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *listener) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.TODO(), time.Second*HTTP_SERVER_STOP_TIMEOUT)
+			defer cancel()
+
+			if err := l.srv.Shutdown(ctx); err != nil {
+				errsLock.Lock()
+				errs = append(errs, err)
+				errsLock.Unlock()
+			}
+
+			p.logger.Debug("listener shutdown", zap.String("listen address", l.conf.Address), zap.String("protocol", l.conf.Protocol))
+		}(l)
+	}
+
+	wg.Wait()
+
+	return errs
+}
+
+// serverTLSConfig returns the TLS config of the tls listeners
+func (p *Proxy) serverTLSConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	p.tlsLock.RLock()
+	defer p.tlsLock.RUnlock()
+
+	return p.serverTLS, nil
+}
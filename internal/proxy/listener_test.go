@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/logger"
+)
+
+func TestProxy_updateListen(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	tests := []struct {
+		name   string
+		listen config.ListenConfig
+		tls    bool
+		want   []config.ListenerConfig
+	}{
+		{
+			name:   "legacy",
+			listen: config.ListenConfig{Host: "0.0.0.0", Port: 80, TlsPort: 443},
+			want:   []config.ListenerConfig{{Address: "0.0.0.0:80", Protocol: "http"}},
+		},
+		{
+			name:   "legacy tls",
+			listen: config.ListenConfig{Host: "::", Port: 80, TlsPort: 443},
+			tls:    true,
+			want:   []config.ListenerConfig{{Address: "[::]:80", Protocol: "http"}, {Address: "[::]:443", Protocol: "tls"}},
+		},
+		{
+			name: "listeners",
+			listen: config.ListenConfig{Host: "0.0.0.0", Port: 80, Listeners: []config.ListenerConfig{
+				{Address: "[::]:3128"},
+				{Address: "192.168.1.1:3129", Protocol: "TLS"},
+				{Address: "[::]:3128", Protocol: "http"},
+				{Address: "3130", Protocol: "http"},
+				{Address: "192.168.1.1:3131", Protocol: "socks"},
+			}},
+			want: []config.ListenerConfig{{Address: "[::]:3128", Protocol: "http"}, {Address: "192.168.1.1:3129", Protocol: "tls"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pxy := New()
+			pxy.tlsConf.Enabled = tt.tls
+			pxy.updateListen(tt.listen)
+
+			if !reflect.DeepEqual(pxy.listenerConfs, tt.want) {
+				t.Errorf("listeners = %v, want %v", pxy.listenerConfs, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxy_LoadConfig_Listeners(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	addrs := make([]string, 2)
+
+	// reserve ports for the listeners
+	for i := range addrs {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+
+		if err != nil {
+			t.Fatalf("Listen() error = %v", err)
+		}
+
+		addrs[i] = l.Addr().String()
+		l.Close()
+	}
+
+	kept := config.ListenerConfig{Address: "127.0.0.1:0", Protocol: "http"}
+
+	conf := *config.GetConfig()
+	conf.Listen = config.ListenConfig{Listeners: []config.ListenerConfig{kept, {Address: addrs[0], Protocol: "http"}}}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	if err := pxy.Start(); err != nil {
+		t.Fatalf("Error starting proxy: %v", err)
+	}
+
+	defer pxy.Stop()
+
+	keptListener := pxy.listeners[kept]
+
+	// a connection to the listener that doesn't change
+	conn, err := net.Dial("tcp", keptListener.l.Addr().String())
+
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+
+	defer conn.Close()
+
+	get := func() error {
+		if _, err := conn.Write([]byte("GET /not-found HTTP/1.1\r\nHost: proxy\r\n\r\n")); err != nil {
+			return err
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+
+		if err != nil {
+			return err
+		}
+
+		return resp.Body.Close()
+	}
+
+	if err := get(); err != nil {
+		t.Fatalf("request error = %v", err)
+	}
+
+	// replace the second listener
+	conf.Listen = config.ListenConfig{Listeners: []config.ListenerConfig{kept, {Address: addrs[1], Protocol: "http"}}}
+	pxy.LoadConfig(&conf)
+
+	if pxy.listeners[kept] != keptListener {
+		t.Error("expected the unchanged listener to keep running")
+	}
+
+	if err := get(); err != nil {
+		t.Errorf("expected the connection to the unchanged listener to stay open, got %v", err)
+	}
+
+	if c, err := net.Dial("tcp", addrs[0]); err == nil {
+		c.Close()
+		t.Errorf("expected the removed listener on %v to be closed", addrs[0])
+	}
+
+	c, err := net.Dial("tcp", addrs[1])
+
+	if err != nil {
+		t.Fatalf("expected the new listener on %v to accept connections, got %v", addrs[1], err)
+	}
+
+	c.Close()
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/pac"
+)
+
+const (
+	PAC_PATH  = "/proxy.pac"
+	WPAD_PATH = "/wpad.dat"
+)
+
+func (p *Proxy) updatePac(conf config.PacConfig) {
+	if conf.Enabled {
+		// check the direct hosts before replacing the config, keeping the last good list when there is an error
+		if _, err := pac.Generate("", conf.DirectHosts); err != nil {
+			p.logger.Error("invalid pac directHosts", zap.Error(err))
+			conf.DirectHosts = p.pacConfig().DirectHosts
+		}
+	}
+
+	p.confLock.Lock()
+	p.pacConf = conf
+	p.confLock.Unlock()
+}
+
+// pacConfig returns the PAC config (requests read it while the config is reloaded)
+func (p *Proxy) pacConfig() config.PacConfig {
+	p.confLock.RLock()
+	defer p.confLock.RUnlock()
+
+	return p.pacConf
+}
+
+func (p *Proxy) newPacMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(PAC_PATH, p.pacEnabled(p.handlePac))
+	mux.HandleFunc(WPAD_PATH, p.pacEnabled(p.handlePac))
+
+	return mux
+}
+
+func (p *Proxy) pacEnabled(next http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if !p.pacConfig().Enabled {
+			http.NotFound(resp, req)
+			return
+		}
+
+		next(resp, req)
+	}
+}
+
+// handlePac generates the PAC file from the current config, so it changes when the config is reloaded
+func (p *Proxy) handlePac(resp http.ResponseWriter, req *http.Request) {
+	_, port, _ := net.SplitHostPort(p.proxyListener().Address)
+
+	file, err := pac.Generate(net.JoinHostPort(p.pacProxyHost(req), port), p.pacConfig().DirectHosts)
+
+	if err != nil {
+		p.logger.Error("error generating pac file", zap.Error(err))
+		http.Error(resp, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", pac.CONTENT_TYPE)
+	resp.Header().Set("Cache-Control", "no-cache")
+
+	_, _ = resp.Write([]byte(file))
+}
+
+// pacProxyHost is the host clients use to reach the proxy
+func (p *Proxy) pacProxyHost(req *http.Request) string {
+	if host := p.pacConfig().ProxyHost; host != "" {
+		return host
+	}
+
+	if host, _, _ := net.SplitHostPort(p.proxyListener().Address); host != "" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+			return host
+		}
+	}
+
+	// listening on every address, use the address the client used to download the file
+	host, _, err := net.SplitHostPort(req.Host)
+
+	if err != nil {
+		return req.Host
+	}
+
+	return host
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/logger"
+)
+
+func TestProxy_ServeHTTP_Pac(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.Listen = config.ListenConfig{Host: "0.0.0.0", Port: 3128}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "wpad.lan"
+		rec := httptest.NewRecorder()
+
+		pxy.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	if rec := get(PAC_PATH); rec.Code != http.StatusNotFound {
+		t.Errorf("expected the PAC file to be disabled, got status %v", rec.Code)
+	}
+
+	conf.Pac = config.PacConfig{Enabled: true, DirectHosts: []string{"*.lan"}}
+	pxy.LoadConfig(&conf)
+
+	for _, path := range []string{PAC_PATH, WPAD_PATH} {
+		rec := get(path)
+
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ns-proxy-autoconfig" {
+			t.Errorf("%v: expected a PAC file, got status %v (%v)", path, rec.Code, rec.Header().Get("Content-Type"))
+		}
+
+		// listening on every address, the file uses the host it was requested from
+		if body := rec.Body.String(); !strings.Contains(body, `"PROXY wpad.lan:3128"`) || !strings.Contains(body, `shExpMatch(host, "*.lan")`) {
+			t.Errorf("%v: unexpected PAC file:\n%v", path, body)
+		}
+	}
+
+	// the file follows config reloads (an invalid direct host keeps the last good list)
+	conf.Pac = config.PacConfig{Enabled: true, ProxyHost: "proxy.lan", DirectHosts: []string{"10.0.0.0/33"}}
+	pxy.LoadConfig(&conf)
+
+	if body := get(PAC_PATH).Body.String(); !strings.Contains(body, `"PROXY proxy.lan:3128"`) || !strings.Contains(body, `shExpMatch(host, "*.lan")`) {
+		t.Errorf("unexpected PAC file after reload:\n%v", body)
+	}
+}
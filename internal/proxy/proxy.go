@@ -3,9 +3,13 @@ package proxy
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,51 +18,187 @@ import (
 	"github.com/smartystreets/cproxy/v2"
 	"go.uber.org/zap"
 
+	"github.com/cthayer/pc-proxy/internal/access"
+	"github.com/cthayer/pc-proxy/internal/activation"
+	"github.com/cthayer/pc-proxy/internal/arp"
+	"github.com/cthayer/pc-proxy/internal/audit"
+	"github.com/cthayer/pc-proxy/internal/bypass"
+	"github.com/cthayer/pc-proxy/internal/client"
 	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/credential"
+	"github.com/cthayer/pc-proxy/internal/digest"
+	"github.com/cthayer/pc-proxy/internal/lease"
+	"github.com/cthayer/pc-proxy/internal/lockout"
 	"github.com/cthayer/pc-proxy/internal/logger"
+	"github.com/cthayer/pc-proxy/internal/mitm"
+	"github.com/cthayer/pc-proxy/internal/ratelimit"
 	"github.com/cthayer/pc-proxy/internal/rule"
+	"github.com/cthayer/pc-proxy/internal/throttle"
+	"github.com/cthayer/pc-proxy/internal/transparent"
+	"github.com/cthayer/pc-proxy/internal/upstream"
 )
 
 const (
 	BYPASS_PASSWD_ENV_NAME   = "BYPASS_PASSWORD"
-	BYPASS_PASSWD_CACHE_TIME = time.Millisecond * 72000000 // 20 hours
+	RULE_CREDENTIAL_PREFIX   = "rule:"
+	BYPASS_STATE_FILE        = "bypass.json"
+	DATA_DIR_PERMS           = 0700
 	TLS_MIN_VERSION          = tls.VersionTLS12
 	HTTP_SERVER_STOP_TIMEOUT = 300
 )
 
 type Proxy struct {
-	Rules               []rule.Rule
-	password            string
-	handler             http.Handler
-	logger              *zap.Logger
-	tlsConf             config.TLSConfig
-	listenConf          config.ListenConfig
-	httpSrv             *http.Server
-	tlsSrv              *http.Server
-	waitGroup           sync.WaitGroup
-	netListener         net.Listener
-	tlsNetListener      net.Listener
-	passwordBypassCache map[string]map[string]time.Duration
+	Rules         []rule.Rule
+	credentials   *credential.Set
+	handler       http.Handler
+	transport     *http.Transport // forwards plain HTTP requests (cproxy only handles CONNECT requests)
+	logger        *zap.Logger
+	tlsConf       config.TLSConfig
+	listenConf    config.ListenConfig
+	waitGroup     sync.WaitGroup
+	bypassStore   *bypass.FileStore
+	limiter       *ratelimit.Limiter
+	clientLock    sync.RWMutex
+	rateLimitConf config.RateLimitConfig
+	clientGroups  []clientGroup
+	throttles     *throttle.Registry
+	bypassConf    config.BypassConfig
+	dataDir       string
+	lockout       *lockout.Tracker
+	localMux      *http.ServeMux
+
+	listenerConfs []config.ListenerConfig
+	listeners     map[config.ListenerConfig]*listener // the running listeners (nil when the proxy isn't running)
+	listenLock    sync.Mutex
+	serverTLS     *tls.Config
+	tlsLock       sync.RWMutex
+	sockets       *activation.Sockets // the sockets passed to the process
+	openConns     int64
+	stop          chan struct{} // closed to stop the background managers
+	stopOnce      sync.Once
+
+	accessRequests     *access.Queue
+	accessRequestsConf config.AccessRequestsConfig
+	csrfKey            []byte // signs the CSRF tokens of the admin forms
+
+	proxyAuthConf config.ProxyAuthConfig
+	users         *credential.Htpasswd
+	digestUsers   *credential.Htdigest
+	digest        *digest.Server
+	logins        *credential.Cache
+
+	audit     *audit.Log
+	auditConf config.AuditConfig
+	auditLock sync.Mutex
+
+	arp    *arp.Table
+	leases *lease.Table
+
+	pacConf        config.PacConfig // read with pacConfig()
+	confLock       sync.RWMutex     // guards the configs requests read while the config is reloaded
+	pacMux         *http.ServeMux
+	pacSrv         *http.Server
+	pacNetListener net.Listener
+
+	transparentSrv         *http.Server
+	transparentListener    net.Listener
+	transparentTransport   *http.Transport
+	transparentTlsListener net.Listener
+	originalDst            func(conn net.Conn) (string, error)
+
+	socksListener net.Listener
+
+	upstreamConf        config.UpstreamConfig
+	upstreamDialer      *upstream.Dialer
+	upstreamHandler     http.Handler
+	upstreamDirectHosts []*regexp.Regexp
+	upstreamHosts       []*regexp.Regexp
+	upstreamTransport   *http.Transport
+
+	interceptConf  config.InterceptConfig
+	ca             *mitm.CA
+	caFiles        string // the CA files that were loaded
+	doNotIntercept []*regexp.Regexp
+	originTLS      *tls.Config // verifies the servers of intercepted requests (the system roots when nil)
+
+	dnsConf      config.DnsConfig // read with dnsConfig()
+	dnsConns     []net.PacketConn
+	dnsListeners []net.Listener
 }
 
 func New() *Proxy {
 	p := Proxy{
-		Rules:               []rule.Rule{},
-		password:            "",
-		handler:             nil,
-		logger:              logger.GetLogger(),
-		tlsConf:             config.GetConfig().TLS,
-		listenConf:          config.GetConfig().Listen,
-		httpSrv:             nil,
-		tlsSrv:              nil,
-		waitGroup:           sync.WaitGroup{},
-		netListener:         nil,
-		tlsNetListener:      nil,
-		passwordBypassCache: map[string]map[string]time.Duration{},
-	}
-
-	// start the passwordBypassCache manager
-	go p.managePasswordBypassCache()
+		Rules:         []rule.Rule{},
+		credentials:   credential.NewSet(),
+		transport:     transparent.NewTransport(),
+		handler:       nil,
+		logger:        logger.GetLogger(),
+		tlsConf:       config.GetConfig().TLS,
+		listenConf:    config.GetConfig().Listen,
+		waitGroup:     sync.WaitGroup{},
+		bypassStore:   nil,
+		limiter:       ratelimit.New(),
+		clientLock:    sync.RWMutex{},
+		rateLimitConf: config.GetConfig().RateLimit,
+		clientGroups:  nil,
+		throttles:     throttle.NewRegistry(),
+		bypassConf:    config.GetConfig().Bypass,
+		dataDir:       config.GetConfig().DataDir,
+		lockout:       lockout.New(lockoutConfig(config.GetConfig().Bypass)),
+		localMux:      nil,
+
+		listenerConfs: nil,
+		listeners:     nil,
+		listenLock:    sync.Mutex{},
+		serverTLS:     nil,
+		tlsLock:       sync.RWMutex{},
+		sockets:       nil,
+		openConns:     0,
+		stop:          make(chan struct{}),
+
+		accessRequests:     access.NewQueue(config.GetConfig().AccessRequests.MaxPending),
+		accessRequestsConf: config.GetConfig().AccessRequests,
+		csrfKey:            newCSRFKey(),
+
+		proxyAuthConf: config.GetConfig().ProxyAuth,
+		users:         nil,
+		digestUsers:   nil,
+		digest:        digest.NewServer(),
+		logins:        credential.NewCache(LOGIN_CACHE_TTL),
+
+		audit:     nil,
+		auditConf: config.AuditConfig{},
+		auditLock: sync.Mutex{},
+
+		arp:    nil,
+		leases: nil,
+
+		pacConf:        config.GetConfig().Pac,
+		pacSrv:         nil,
+		pacNetListener: nil,
+
+		transparentSrv:         nil,
+		transparentListener:    nil,
+		transparentTransport:   transparent.NewTransport(),
+		transparentTlsListener: nil,
+		originalDst:            transparent.OriginalDestination,
+
+		socksListener: nil,
+	}
+
+	p.pacMux = p.newPacMux()
+	p.localMux = p.newLocalMux()
+	p.upstreamTransport = p.newUpstreamTransport()
+
+	p.bypassStore = bypass.NewFileStore(func(err error) {
+		p.logger.Error("Error saving bypass state", zap.Error(err))
+	})
+
+	// start the bypassStore manager
+	go p.manageBypassStore()
+
+	// start the rate limiter manager
+	go p.manageRateLimiter()
 
 	return &p
 }
@@ -66,102 +206,189 @@ func New() *Proxy {
 func (p *Proxy) Start() error {
 	var err error = nil
 
-	p.handler = cproxy.New(cproxy.Options.Filter(p))
-
-	p.httpSrv = &http.Server{Addr: p.listenConf.Host + ":" + strconv.Itoa(p.listenConf.Port)}
+	// restore the bypass grants saved before the last shutdown
+	p.openDataDir()
 
-	// setup the http server
-	p.httpSrv.Handler = p.handler
+	p.handler = cproxy.New(cproxy.Options.Filter(p), cproxy.Options.ClientConnector(clientConnector{}))
+	p.upstreamHandler = cproxy.New(cproxy.Options.Filter(p), cproxy.Options.ClientConnector(clientConnector{}), cproxy.Options.Dialer(upstreamDialer{p: p}))
 
-	p.netListener, err = net.Listen("tcp", p.httpSrv.Addr)
+	// start the proxy listeners
+	p.listenLock.Lock()
+	p.listeners = make(map[config.ListenerConfig]*listener)
+	p.listenLock.Unlock()
 
-	if err != nil {
+	if err = p.updateListeners(); err != nil {
 		return err
 	}
 
-	p.logger.Info("HTTP server listening", zap.String("listen address", p.httpSrv.Addr))
+	// accept HTTP and HTTPS connections redirected by iptables
+	if p.listenConf.TransparentPort > 0 {
+		if err = p.listenTransparentHTTP(); err != nil {
+			return err
+		}
+	}
 
-	// setup the https server
-	if p.tlsConf.Enabled {
-		p.tlsSrv = &http.Server{Addr: p.listenConf.Host + ":" + strconv.Itoa(p.listenConf.TlsPort)}
+	if p.listenConf.TransparentTlsPort > 0 {
+		if err = p.listenTransparentTLS(); err != nil {
+			return err
+		}
+	}
 
-		if err = p.setupTls(); err != nil {
+	if p.listenConf.SocksPort > 0 {
+		if err = p.listenSocks(); err != nil {
 			return err
 		}
+	}
 
-		p.tlsSrv.Handler = p.handler
+	if p.dnsConfig().Enabled {
+		if err = p.listenDns(); err != nil {
+			return err
+		}
+	}
+
+	// serve the PAC file on its own port
+	if pacConf := p.pacConfig(); pacConf.Enabled && pacConf.Port > 0 {
+		p.pacSrv = &http.Server{Addr: net.JoinHostPort(p.listenConf.Host, strconv.Itoa(pacConf.Port)), Handler: p.pacMux}
 
-		p.tlsNetListener, err = net.Listen("tcp", p.tlsSrv.Addr)
+		p.pacNetListener, err = p.listenTCP(p.pacSrv.Addr)
 
 		if err != nil {
 			return err
 		}
 
-		p.logger.Info("HTTPS server listening", zap.String("listen address", p.tlsSrv.Addr))
+		p.logger.Info("PAC server listening", zap.String("listen address", p.pacSrv.Addr))
 
-		// start the HTTPS proxy async
 		p.waitGroup.Add(1)
 		go func() {
 			defer p.waitGroup.Done()
 
-			// this will block until the server is stopped or an error occurs
-			err := p.tlsSrv.ServeTLS(p.tlsNetListener, "", "")
+			err := p.pacSrv.Serve(p.pacNetListener)
 
-			// if the server exits for any reason other than being stopped, log the error
 			if err != http.ErrServerClosed {
-				p.logger.Error("Error serving HTTPS requests", zap.Error(err))
+				p.logger.Error("Error serving PAC requests", zap.Error(err))
 			}
 		}()
 	}
 
-	// start the HTTP proxy async
-	p.waitGroup.Add(1)
-	go func() {
-		defer p.waitGroup.Done()
-
-		// this will block until the server is stopped or an error occurs
-		err := p.httpSrv.Serve(p.netListener)
-
-		// if the server exits for any reason other than being stopped, log the error
-		if err != http.ErrServerClosed {
-			p.logger.Error("Error serving HTTP requests", zap.Error(err))
-		}
-	}()
+	// passed sockets stay open, a listener can use them after the config is reloaded
+	for _, sock := range p.sockets.Remaining() {
+		p.logger.Warn("passed socket isn't used by a listener", zap.String("name", sock.Name), zap.String("listen address", sock.Addr().String()))
+	}
 
 	return err
 }
 
 func (p *Proxy) Stop() []error {
+	errs := p.shutdown()
+
+	p.stopManagers()
+
+	if err := p.bypassStore.Save(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := p.closeAudit(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+// shutdown stops the servers, waiting for their requests to finish
+func (p *Proxy) shutdown() []error {
 	var errs []error
+	var errsLock sync.Mutex
+	var wg sync.WaitGroup
 
-	// stop the HTTP server async
-	go func() {
-		ctx, cancel := context.WithTimeout(context.TODO(), time.Second*HTTP_SERVER_STOP_TIMEOUT)
+	addErr := func(err error) {
+		errsLock.Lock()
+		errs = append(errs, err)
+		errsLock.Unlock()
+	}
 
-		if err := p.httpSrv.Shutdown(ctx); err != nil {
-			errs = append(errs, err)
-		}
+	// stop the proxy listeners async (their requests are allowed to finish)
+	p.listenLock.Lock()
 
-		cancel()
+	var listeners []*listener
+
+	for _, l := range p.listeners {
+		l.close()
+		listeners = append(listeners, l)
+	}
+
+	p.listeners = nil
+	p.listenLock.Unlock()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
 
-		p.logger.Debug("HTTP server shutdown")
+		for _, err := range p.shutdownListeners(listeners) {
+			addErr(err)
+		}
 	}()
 
-	if p.tlsSrv != nil {
-		// stop the HTTPS server async
+	if p.transparentSrv != nil {
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
+
 			ctx, cancel := context.WithTimeout(context.TODO(), time.Second*HTTP_SERVER_STOP_TIMEOUT)
+			defer cancel()
 
-			if err := p.tlsSrv.Shutdown(ctx); err != nil {
-				errs = append(errs, err)
+			if err := p.transparentSrv.Shutdown(ctx); err != nil {
+				addErr(err)
 			}
 
-			cancel()
+			p.logger.Debug("transparent HTTP server shutdown")
+		}()
+	}
+
+	if p.transparentTlsListener != nil {
+		if err := p.transparentTlsListener.Close(); err != nil {
+			addErr(err)
+		}
+	}
+
+	if p.socksListener != nil {
+		if err := p.socksListener.Close(); err != nil {
+			addErr(err)
+		}
+	}
+
+	for _, conn := range p.dnsConns {
+		if err := conn.Close(); err != nil {
+			addErr(err)
+		}
+	}
 
-			p.logger.Debug("HTTPS server shutdown")
+	for _, l := range p.dnsListeners {
+		if err := l.Close(); err != nil {
+			addErr(err)
+		}
+	}
+
+	p.dnsConns, p.dnsListeners = nil, nil
+
+	if p.pacSrv != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.TODO(), time.Second*HTTP_SERVER_STOP_TIMEOUT)
+			defer cancel()
+
+			if err := p.pacSrv.Shutdown(ctx); err != nil {
+				addErr(err)
+			}
+
+			p.logger.Debug("PAC server shutdown")
 		}()
 	}
 
+	// wait for the servers to shut down
+	wg.Wait()
+
 	// wait for shutdown to finish
 	p.waitGroup.Wait()
 
@@ -172,28 +399,112 @@ func (p *Proxy) LoadConfig(conf *config.Config) {
 	// get new logger
 	p.logger = logger.GetLogger()
 
-	p.password = os.Getenv(BYPASS_PASSWD_ENV_NAME)
+	p.bypassConf = conf.Bypass
+	p.updateCredentials(os.Getenv(BYPASS_PASSWD_ENV_NAME), conf.Credentials)
 	p.tlsConf = conf.TLS
-	p.listenConf = conf.Listen // this config will not update without a restart of the service
-
+	p.lockout.SetConfig(lockoutConfig(conf.Bypass))
+	p.accessRequestsConf = conf.AccessRequests
+	p.accessRequests.SetMaxPending(conf.AccessRequests.MaxPending)
+	p.dataDir = conf.DataDir    // this config will not update without a restart of the service
+	p.updateListen(conf.Listen) // only the proxy listeners update without a restart of the service
+
+	p.updateProxyAuth(conf.ProxyAuth)
+	p.updateAudit(conf.Audit)
+	p.updateArp(conf.Arp)
+	p.updateLeases(conf.Leases)
+	p.updatePac(conf.Pac) // the port will not update without a restart of the service
+	p.updateUpstream(conf.Upstream, os.Getenv(UPSTREAM_PASSWD_ENV_NAME))
+	p.updateIntercept(conf.Intercept)
+	p.updateDns(conf.Dns) // the port will not update without a restart of the service
 	p.updateRules(conf.Rules)
+	p.updateClientGroups(conf.RateLimit, conf.ClientGroups)
+
+	// start and stop the listeners that changed (errors are logged)
+	_ = p.updateListeners()
+}
 
-	if p.tlsSrv != nil {
-		_ = p.setupTls()
+func (p *Proxy) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	defer p.trackConn()()
+
+	id := p.identify(req)
+
+	if p.proxyAuthConf.Enabled && !p.isLocalRequest(req) {
+		var ok bool
+
+		if req, id, ok = p.authenticate(resp, req, id); !ok {
+			return
+		}
+	}
+
+	// rules, limits and bypass grants use the client's identity
+	req = req.WithContext(client.WithIdentity(req.Context(), id))
+
+	if !p.acquire(req, id) {
+		http.Error(resp, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	// CONNECT requests block here until the tunnel is closed
+	defer p.limiter.Release(id.Key())
+
+	if p.isLocalRequest(req) {
+		// requests to the proxy itself (access requests, admin pages)
+		p.localMux.ServeHTTP(resp, req)
+		return
+	}
+
+	if p.shouldIntercept(req) {
+		p.intercept(resp, req)
+		return
+	}
+
+	if req.Method != http.MethodConnect {
+		p.forward(resp, req)
+		return
+	}
+
+	w := &responseWriter{ResponseWriter: resp}
+
+	if p.useUpstream(req) {
+		p.logger.Debug("forwarding request through the upstream proxy", zap.String("url", req.URL.String()), zap.String("client address", req.RemoteAddr))
+		p.upstreamHandler.ServeHTTP(w, req)
+	} else {
+		p.handler.ServeHTTP(w, req)
+	}
+
+	if w.blockPage {
+		p.serveBlockPage(w, req)
 	}
 }
 
 func (p *Proxy) IsAuthorized(resp http.ResponseWriter, req *http.Request) bool {
 	p.logger.Debug("request received", zap.Any("headers", req.Header), zap.String("client address", req.RemoteAddr))
 
+	bypass := p.bypass()
+
+	if !canPrompt(resp) {
+		// the client can't be asked for the bypass password, so it isn't a challenge
+		onEvent := bypass.OnEvent
+		bypass.OnEvent = func(e rule.BypassEvent) {
+			if e.Type != rule.BYPASS_EVENT_CHALLENGE {
+				onEvent(e)
+			}
+		}
+	}
+
 	// check the rules to see if this request is allowed
 	for _, r := range p.Rules {
-		if match, allow := r.Match(req, resp, p.password, &p.passwordBypassCache, BYPASS_PASSWD_CACHE_TIME); match {
+		if match, allow := r.Match(req, resp, bypass); match {
 			if !allow {
-				p.logger.Info("blocked request", zap.String("url", req.URL.String()))
+				p.logger.Info("blocked request", append(clientFields(req), zap.String("url", req.URL.String()))...)
+				p.markBlockPage(resp, req)
+			}
+
+			if allow && r.Access == "throttle" {
+				p.throttleResponse(resp, req, r)
 			}
 
-			p.logger.Debug("processed request", zap.String("url", req.URL.String()), zap.Any("rule", r), zap.Bool("match", match), zap.Bool("allow", allow), zap.Any("respHeaders", resp.Header().Get("Proxy-Authenticate")))
+			p.logger.Debug("processed request", append(clientFields(req), zap.String("url", req.URL.String()), zap.Any("rule", r), zap.Bool("match", match), zap.Bool("allow", allow), zap.Any("respHeaders", resp.Header().Get("Proxy-Authenticate")))...)
 
 			return allow
 		}
@@ -213,6 +524,15 @@ func (p *Proxy) updateRules(rules []map[string]interface{}) {
 		t, tOk := v["type"].(string)
 		pat, pOk := v["pattern"].(string)
 		b, bOk := v["passwordBypass"].(bool)
+		tr, trOk := rateString(v["throttleRate"])
+		tags, tagsOk := stringSlice(v["tags"])
+		bd, bdOk := v["bypassDuration"].(string)
+		bs, bsOk := v["bypassScope"].(string)
+		clients, clientsOk := stringSlice(v["clients"])
+		bp, _ := v["bypassPassword"].(string)
+		bph, _ := v["bypassPasswordHash"].(string)
+		rt, rtOk := v["route"].(string)
+		ic, icOk := v["intercept"].(bool)
 
 		r := rule.New()
 
@@ -232,6 +552,80 @@ func (p *Proxy) updateRules(rules []map[string]interface{}) {
 			r.PasswordBypass = b
 		}
 
+		if !trOk && v["throttleRate"] != nil {
+			p.logger.Error("invalid rule throttleRate", zap.String("pattern", r.Pattern), zap.Any("throttleRate", v["throttleRate"]), zap.Error(errors.New("must be a string or a number")))
+			continue
+		}
+
+		if trOk {
+			rate, err := throttle.ParseRate(tr)
+
+			if err != nil {
+				p.logger.Error("invalid rule throttleRate", zap.String("pattern", r.Pattern), zap.Error(err))
+				continue
+			}
+
+			r.ThrottleRate = rate
+		}
+
+		if tagsOk {
+			r.Tags = tags
+		}
+
+		if bdOk {
+			duration, err := time.ParseDuration(bd)
+
+			if err != nil {
+				p.logger.Error("invalid rule bypassDuration", zap.String("pattern", r.Pattern), zap.Error(err))
+			} else {
+				r.BypassDuration = duration
+			}
+		}
+
+		if bsOk && rule.BypassScope(bs).IsValid() {
+			r.BypassScope = rule.BypassScope(bs)
+		}
+
+		if icOk {
+			r.Intercept = ic
+		}
+
+		if rtOk {
+			if rule.Route(rt).IsValid() {
+				r.Route = rule.Route(rt)
+			} else {
+				p.logger.Error("invalid rule route", zap.String("pattern", r.Pattern), zap.String("route", rt))
+			}
+		}
+
+		if clientsOk {
+			selectors, err := client.ParseSelectors(clients)
+
+			if err != nil {
+				// a rule meant for some clients must not be applied to every client
+				p.logger.Error("invalid rule clients", zap.String("pattern", r.Pattern), zap.Error(err))
+				continue
+			}
+
+			r.Clients = selectors
+		}
+
+		if bp != "" || bph != "" {
+			// an invalid password leaves the rule with the default credentials
+			cred, err := p.ruleCredential(r, bp, bph)
+
+			if err != nil {
+				p.logger.Error("invalid rule bypass password", zap.String("pattern", r.Pattern), zap.Error(err))
+			} else {
+				r.Credential = &cred
+			}
+		}
+
+		if r.Access == "throttle" && r.ThrottleRate <= 0 {
+			p.logger.Error("throttle rule is missing throttleRate", zap.String("pattern", r.Pattern))
+			continue
+		}
+
 		if r.Pattern != "" {
 			newRules = append(newRules, r)
 		}
@@ -242,6 +636,144 @@ func (p *Proxy) updateRules(rules []map[string]interface{}) {
 	p.logger.Info("new rules loaded", zap.Any("rules", p.Rules))
 }
 
+// ruleCredential creates the credential for a rule's own `bypassPassword` or `bypassPasswordHash`
+func (p *Proxy) ruleCredential(r rule.Rule, password string, hash string) (credential.Credential, error) {
+	name := RULE_CREDENTIAL_PREFIX + r.Pattern
+
+	if password != "" && hash != "" {
+		return credential.Credential{}, errors.New("a rule can't have both a bypassPassword and a bypassPasswordHash")
+	}
+
+	if password != "" {
+		return credential.NewPlaintext(name, password), nil
+	}
+
+	if p.bypassConf.Scheme == AUTH_SCHEME_DIGEST {
+		p.logger.Warn("a rule's bypassPasswordHash can't be used with digest auth", zap.String("pattern", r.Pattern))
+	}
+
+	return credential.New(name, hash, nil, 0)
+}
+
+func (p *Proxy) updateCredentials(password string, creds []config.CredentialConfig) {
+	var newCreds []credential.Credential
+
+	// the env var password is kept as an unrestricted (admin) credential
+	if password != "" {
+		envCred := credential.NewPlaintext(BYPASS_PASSWD_ENV_NAME, password)
+		envCred.Admin = true
+
+		newCreds = append(newCreds, envCred)
+	}
+
+	for _, c := range creds {
+		if len(c.TotpSecrets) > 0 {
+			if c.Hash != "" || c.HashFile != "" {
+				p.logger.Error("invalid credential", zap.String("name", c.Name), zap.Error(errors.New("a credential can't have both a hash and totp secrets")))
+				continue
+			}
+
+			cred, err := credential.NewTOTP(c.Name, c.TotpSecrets, c.Tags, c.MaxDuration)
+
+			if err != nil {
+				p.logger.Error("invalid credential", zap.String("name", c.Name), zap.Error(err))
+				continue
+			}
+
+			cred.Admin = c.Admin
+
+			// codes used before the reload stay used
+			for _, existing := range p.credentials.Credentials() {
+				if existing.Name == c.Name {
+					cred.KeepState(existing)
+				}
+			}
+
+			newCreds = append(newCreds, cred)
+			continue
+		}
+
+		hash := c.Hash
+
+		if c.HashFile != "" {
+			contents, err := ioutil.ReadFile(c.HashFile)
+
+			if err != nil {
+				p.logger.Error("error reading credential hash file", zap.String("name", c.Name), zap.String("hashFile", c.HashFile), zap.Error(err))
+				continue
+			}
+
+			hash = string(contents)
+		}
+
+		cred, err := credential.New(c.Name, hash, c.Tags, c.MaxDuration)
+
+		if err != nil {
+			p.logger.Error("invalid credential", zap.String("name", c.Name), zap.Error(err))
+			continue
+		}
+
+		cred.Admin = c.Admin
+
+		newCreds = append(newCreds, cred)
+	}
+
+	p.credentials = credential.NewSet(newCreds...)
+
+	if p.bypassConf.Scheme == AUTH_SCHEME_DIGEST {
+		for _, c := range newCreds {
+			if !c.SupportsDigest() {
+				p.logger.Warn("hashed credentials can't be used with digest auth", zap.String("name", c.Name))
+			}
+		}
+	}
+
+	p.logger.Info("new credentials loaded", zap.Int("count", p.credentials.Len()))
+}
+
+func (p *Proxy) bypass() rule.Bypass {
+	b := rule.Bypass{
+		Credentials: p.credentials,
+		Store:       p.bypassStore,
+		Lockout:     p.lockout,
+		Duration:    p.bypassConf.Duration,
+		Scope:       rule.BypassScope(p.bypassConf.Scope),
+		Default:     BYPASS_PASSWD_ENV_NAME,
+		OnEvent:     p.logBypassEvent,
+	}
+
+	if p.bypassConf.Scheme == AUTH_SCHEME_DIGEST {
+		b.Digest = p.digest
+	}
+
+	return b
+}
+
+func (p *Proxy) logBypassEvent(e rule.BypassEvent) {
+	p.auditBypassEvent(e)
+
+	switch e.Type {
+	case rule.BYPASS_EVENT_CHALLENGE:
+		p.logger.Debug("bypass password requested", zap.String("client address", e.Client), zap.String("client name", e.Name), zap.String("pattern", e.Rule.Pattern))
+	case rule.BYPASS_EVENT_UNLOCK:
+		p.logger.Info("bypass granted", zap.String("client address", e.Client), zap.String("credential", e.Credential), zap.String("pattern", e.Rule.Pattern), zap.Duration("duration", e.Duration))
+	case rule.BYPASS_EVENT_FAILURE:
+		p.logger.Warn("bypass failed: invalid password", zap.String("client address", e.Client), zap.String("client name", e.Name), zap.String("pattern", e.Rule.Pattern))
+	case rule.BYPASS_EVENT_LOCKOUT:
+		p.logger.Warn("bypass locked out: too many failed attempts", zap.String("client address", e.Client), zap.String("client name", e.Name), zap.String("pattern", e.Rule.Pattern), zap.Time("until", e.Until))
+	}
+}
+
+func lockoutConfig(conf config.BypassConfig) lockout.Config {
+	return lockout.Config{
+		MaxFailures: conf.MaxFailures,
+		Window:      conf.FailureWindow,
+		Duration:    conf.LockoutDuration,
+		MaxDuration: conf.MaxLockoutDuration,
+	}
+}
+
+// setupTls loads the certificate and ciphers of the tls listeners.  Running listeners use them for new connections
 func (p *Proxy) setupTls() error {
 	keyPair, err := tls.LoadX509KeyPair(p.tlsConf.Cert, p.tlsConf.Key)
 
@@ -249,18 +781,13 @@ func (p *Proxy) setupTls() error {
 		return err
 	}
 
-	if p.tlsSrv.TLSConfig == nil {
-		p.tlsSrv.TLSConfig = &tls.Config{}
-		p.tlsSrv.TLSConfig.PreferServerCipherSuites = true
-		p.tlsSrv.TLSConfig.MinVersion = TLS_MIN_VERSION
+	tlsConf := &tls.Config{
+		PreferServerCipherSuites: true,
+		MinVersion:               TLS_MIN_VERSION,
+		Certificates:             []tls.Certificate{keyPair},
+		NextProtos:               serverNextProtos,
 	}
 
-	if p.tlsSrv.TLSConfig.Certificates == nil {
-		p.tlsSrv.TLSConfig.Certificates = make([]tls.Certificate, 1)
-	}
-
-	p.tlsSrv.TLSConfig.Certificates[0] = keyPair
-
 	// load ciphers
 	var cipherIds []uint16
 	cipherNames := strings.Split(p.tlsConf.Ciphers, ":")
@@ -283,32 +810,105 @@ func (p *Proxy) setupTls() error {
 		}
 	}
 
-	p.tlsSrv.TLSConfig.CipherSuites = cipherIds
+	tlsConf.CipherSuites = cipherIds
+
+	p.tlsLock.Lock()
+	p.serverTLS = tlsConf
+	p.tlsLock.Unlock()
 
 	return nil
 }
 
-func (p *Proxy) managePasswordBypassCache() {
-	// this function is run in a background go thread
-	for {
-		<-time.After(time.Minute)
+// stringSlice converts a list from the config file (decoded as `[]interface{}`) to a list of strings
+// rateString returns a throttle rate from the config as a string for throttle.ParseRate (a number is in bytes per second)
+func rateString(v interface{}) (string, bool) {
+	switch r := v.(type) {
+	case string:
+		return r, true
+	case int:
+		return strconv.Itoa(r), true
+	case int64:
+		return strconv.FormatInt(r, 10), true
+	case float64:
+		return strconv.FormatFloat(r, 'f', -1, 64), true
+	}
 
-		p.logger.Debug("updating password bypass cache", zap.Any("passwordBypassCache", p.passwordBypassCache))
+	return "", false
+}
 
-		for ip, cache := range p.passwordBypassCache {
-			for pattern, duration := range cache {
-				p.passwordBypassCache[ip][pattern] = duration - time.Minute
+func stringSlice(v interface{}) ([]string, bool) {
+	switch l := v.(type) {
+	case []string:
+		return l, true
+	case string:
+		return []string{l}, true
+	case []interface{}:
+		var ret []string
 
-				if p.passwordBypassCache[ip][pattern] <= 0 {
-					delete(p.passwordBypassCache[ip], pattern)
-				}
-			}
+		for _, item := range l {
+			s, ok := item.(string)
 
-			if len(p.passwordBypassCache[ip]) < 1 {
-				delete(p.passwordBypassCache, ip)
+			if !ok {
+				return nil, false
 			}
+
+			ret = append(ret, s)
+		}
+
+		return ret, true
+	}
+
+	return nil, false
+}
+
+func (p *Proxy) openDataDir() {
+	if p.dataDir == "" {
+		return
+	}
+
+	if err := os.MkdirAll(p.dataDir, DATA_DIR_PERMS); err != nil {
+		// keep running without persisting state
+		p.logger.Error("Error creating data directory", zap.String("dataDir", p.dataDir), zap.Error(err))
+		return
+	}
+
+	stateFile := filepath.Join(p.dataDir, BYPASS_STATE_FILE)
+
+	if err := p.bypassStore.Open(stateFile); err != nil {
+		p.logger.Error("Error loading bypass state", zap.String("stateFile", stateFile), zap.Error(err))
+		return
+	}
+
+	p.logger.Info("bypass state loaded", zap.String("stateFile", stateFile), zap.Int("grants", len(p.bypassStore.Grants())))
+}
+
+// stopManagers stops the background managers (they would change the bypass state and the audit log after the proxy
+// stopped)
+func (p *Proxy) stopManagers() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+func (p *Proxy) manageBypassStore() {
+	// this function is run in a background go thread
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(time.Minute):
 		}
 
-		p.logger.Debug("finished updating password bypass cache", zap.Any("passwordBypassCache", p.passwordBypassCache))
+		p.lockout.Prune()
+		p.accessRequests.Prune()
+		p.digest.Prune()
+		p.logins.Prune()
+
+		for _, g := range p.bypassStore.Purge() {
+			p.logger.Debug("bypass expired", zap.String("client address", g.Client), zap.String("key", g.Key), zap.Time("expires", g.Expires))
+
+			expires := g.Expires
+			p.auditEvent(audit.Entry{Event: audit.EVENT_EXPIRY, Client: g.Client, Key: g.Key, Expires: &expires})
+		}
 	}
 }
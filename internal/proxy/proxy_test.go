@@ -1,10 +1,21 @@
 package proxy
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
 	"github.com/cthayer/pc-proxy/internal/logger"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/credential"
 )
 
 func TestNew(t *testing.T) {
@@ -34,5 +45,325 @@ func TestProxy_Start_Stop(t *testing.T) {
 }
 
 func TestProxy_LoadConfig(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "block", "type": "host", "pattern": "youtube\\.com", "bypassDuration": "15m", "bypassScope": "host"},
+	}
+	conf.Bypass = config.BypassConfig{Duration: time.Hour, Scope: "all"}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	if len(pxy.Rules) != 1 {
+		t.Fatalf("expected 1 rule, got %v", len(pxy.Rules))
+	}
+
+	if pxy.Rules[0].BypassDuration != time.Minute*15 {
+		t.Errorf("expected %v, got %v", time.Minute*15, pxy.Rules[0].BypassDuration)
+	}
+
+	if pxy.Rules[0].BypassScope != "host" {
+		t.Errorf("expected %v, got %v", "host", pxy.Rules[0].BypassScope)
+	}
+
+	if b := pxy.bypass(); b.Duration != time.Hour || b.Scope != "all" {
+		t.Errorf("expected the global bypass config to be used, got %v %v", b.Duration, b.Scope)
+	}
+}
+
+func TestProxy_LoadConfig_TOTP(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.Credentials = []config.CredentialConfig{
+		{Name: "babysitter", TotpSecrets: []string{"JBSWY3DPEHPK3PXP"}, MaxDuration: time.Hour},
+		{Name: "both", Hash: "$2a$10$u.VvPb7coU2tC7wWO3uJNuQXHadcRVA0jnGfdj9eIT.tvjNaHsG3K", TotpSecrets: []string{"JBSWY3DPEHPK3PXP"}},
+		{Name: "invalid", TotpSecrets: []string{"not base32!"}},
+	}
+
+	_ = os.Unsetenv(BYPASS_PASSWD_ENV_NAME)
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	if pxy.credentials.Len() != 1 {
+		t.Errorf("expected only the valid totp credential to be loaded, got %v credentials", pxy.credentials.Len())
+	}
+}
+
+func TestProxy_LoadConfig_TOTP_Reload(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.Credentials = []config.CredentialConfig{
+		{Name: "babysitter", TotpSecrets: []string{"JBSWY3DPEHPK3PXP"}, MaxDuration: time.Hour},
+	}
+
+	_ = os.Unsetenv(BYPASS_PASSWD_ENV_NAME)
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	code := currentTOTP(t, "JBSWY3DPEHPK3PXP")
+
+	if !pxy.credentials.Verify(code) {
+		t.Fatal("expected the current code to be accepted")
+	}
+
+	reloaded := conf
+	pxy.LoadConfig(&reloaded)
+
+	if pxy.credentials.Verify(code) {
+		t.Error("expected a code used before the reload to be rejected after it")
+	}
+}
+
+// currentTOTP returns the RFC 6238 code for the secret at the current time
+func currentTOTP(t *testing.T, secret string) string {
+	key, err := credential.DecodeTOTPSecret(secret)
+
+	if err != nil {
+		t.Fatalf("DecodeTOTPSecret() error = %v", err)
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(time.Now().Unix()/int64(credential.TOTP_PERIOD.Seconds())))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+func TestProxy_LoadConfig_RuleBypassPassword(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "block", "type": "host", "pattern": "homework\\.com", "bypassPassword": "homework"},
+		{"access": "block", "type": "host", "pattern": "youtube\\.com", "bypassPasswordHash": "$2a$10$u.VvPb7coU2tC7wWO3uJNuQXHadcRVA0jnGfdj9eIT.tvjNaHsG3K"},
+		{"access": "block", "type": "host", "pattern": "invalid\\.com", "bypassPasswordHash": "not a hash"},
+		{"access": "block", "type": "host", "pattern": "default\\.com"},
+	}
+
+	_ = os.Setenv(BYPASS_PASSWD_ENV_NAME, "secret")
+	t.Cleanup(func() { _ = os.Unsetenv(BYPASS_PASSWD_ENV_NAME) })
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	if len(pxy.Rules) != 4 {
+		t.Fatalf("expected 4 rules, got %v", len(pxy.Rules))
+	}
+
+	if c := pxy.Rules[0].Credential; c == nil || !c.Verify("homework") || c.Name != "rule:homework\\.com" {
+		t.Errorf("expected the rule's bypassPassword to be loaded, got %v", c)
+	}
+
+	if pxy.Rules[1].Credential == nil {
+		t.Error("expected the rule's bypassPasswordHash to be loaded")
+	}
+
+	// an invalid hash leaves the rule with the default password
+	if pxy.Rules[2].Credential != nil || pxy.Rules[3].Credential != nil {
+		t.Error("expected rules without a valid password to use the default credentials")
+	}
+
+	for _, tt := range []struct {
+		host     string
+		password string
+		status   int
+	}{
+		{"homework.com", "secret", http.StatusProxyAuthRequired},
+		{"homework.com", "homework", http.StatusOK},
+		{"default.com", "homework", http.StatusProxyAuthRequired},
+		{"default.com", "secret", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "http://"+tt.host+"/", nil)
+		req.SetBasicAuth("", tt.password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		rec := httptest.NewRecorder()
+
+		if pxy.IsAuthorized(rec, req) {
+			rec.WriteHeader(http.StatusOK)
+		}
+
+		if rec.Code != tt.status {
+			t.Errorf("%v with %v: expected status %v, got %v", tt.host, tt.password, tt.status, rec.Code)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_RateLimit(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.RateLimit = config.RateLimitConfig{RequestsPerSecond: 1, Burst: 1}
+	conf.ClientGroups = []config.ClientGroupConfig{
+		{Name: "unlimited", Clients: []string{"10.0.0.2"}, RequestsPerSecond: 100},
+	}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+	pxy.handler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {})
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		rec := httptest.NewRecorder()
+
+		pxy.ServeHTTP(rec, req)
+
+		if rec.Code != want {
+			t.Errorf("request %v: expected status %v, got %v", i, want, rec.Code)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+		req.RemoteAddr = "10.0.0.2:1234"
+		rec := httptest.NewRecorder()
+
+		pxy.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected client group limits to apply, got status %v", rec.Code)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_MaxConnections(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.RateLimit = config.RateLimitConfig{MaxConnections: 1}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	// hold the first connection open until the second request has been refused
+	release := make(chan bool)
+	started := make(chan bool)
+
+	pxy.handler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		started <- true
+		<-release
+	})
+
+	go func() {
+		req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		pxy.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	<-started
+
+	req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+	req.RemoteAddr = "10.0.0.1:1235"
+	rec := httptest.NewRecorder()
+
+	pxy.ServeHTTP(rec, req)
+
+	close(release)
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %v, got %v", http.StatusTooManyRequests, rec.Code)
+	}
+}
+
+func TestProxy_IsAuthorized_Throttle(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "throttle", "type": "host", "pattern": "youtube\\.com", "throttleRate": "500kbit"},
+		{"access": "throttle", "type": "host", "pattern": "invalid\\.com"},
+		{"access": "throttle", "type": "host", "pattern": "invalid\\.org", "throttleRate": true},
+		{"access": "throttle", "type": "host", "pattern": "vimeo\\.com", "throttleRate": 50000},
+		{"access": "throttle", "type": "host", "pattern": "twitch\\.tv", "throttleRate": 12500.5},
+	}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	if len(pxy.Rules) != 3 {
+		t.Fatalf("expected throttle rules without a valid rate to be skipped, got %v rules", len(pxy.Rules))
+	}
+
+	for i, want := range []int64{62500, 50000, 12500} {
+		if pxy.Rules[i].ThrottleRate != want {
+			t.Errorf("rule %v: expected %v, got %v", pxy.Rules[i].Pattern, want, pxy.Rules[i].ThrottleRate)
+		}
+	}
+
+	var writers []*responseWriter
+
+	for _, port := range []string{"1234", "1235"} {
+		req := httptest.NewRequest("CONNECT", "www.youtube.com:443", nil)
+		req.RemoteAddr = "10.0.0.1:" + port
+		w := &responseWriter{ResponseWriter: httptest.NewRecorder()}
+
+		if !pxy.IsAuthorized(w, req) {
+			t.Errorf("expected throttled request to be allowed")
+		}
+
+		if w.throttle == nil {
+			t.Fatalf("expected throttled request to have a bandwidth bucket")
+		}
+
+		writers = append(writers, w)
+	}
+
+	if writers[0].throttle != writers[1].throttle {
+		t.Errorf("expected parallel connections of the same client to share a bandwidth bucket")
+	}
+}
+
+func TestProxy_Start_Stop_BypassState(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	dir, err := ioutil.TempDir("", "pc-proxy-data")
 
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	conf := *config.GetConfig()
+	conf.DataDir = filepath.Join(dir, "state")
+	conf.Listen = config.ListenConfig{Host: "127.0.0.1", Port: 0}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	if err := pxy.Start(); err != nil {
+		t.Fatalf("Error starting proxy: %v", err)
+	}
+
+	pxy.bypassStore.Grant("10.0.0.1", "*", time.Now().Add(time.Hour))
+
+	if errs := pxy.Stop(); len(errs) > 0 {
+		t.Fatalf("Errors stopping proxy: %v", errs)
+	}
+
+	// a new proxy (after a restart) restores the grant
+	restarted := New()
+	restarted.LoadConfig(&conf)
+
+	if err := restarted.Start(); err != nil {
+		t.Fatalf("Error starting proxy: %v", err)
+	}
+
+	defer restarted.Stop()
+
+	if !restarted.bypassStore.Active("10.0.0.1", "*") {
+		t.Error("expected the bypass grant to be restored after a restart")
+	}
 }
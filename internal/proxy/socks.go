@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/cthayer/pc-proxy/internal/client"
+	"github.com/cthayer/pc-proxy/internal/socks5"
+	"github.com/cthayer/pc-proxy/internal/throttle"
+	"github.com/cthayer/pc-proxy/internal/transparent"
+)
+
+const (
+	// how long a SOCKS client has to authenticate and send its request
+	SOCKS_HANDSHAKE_TIMEOUT = time.Second * 10
+)
+
+// handleSocks checks a SOCKS5 CONNECT request against the rules, as the CONNECT request of an HTTP proxy client, and
+// splices the connection to the target when it is allowed.  With proxy auth enabled, clients log in with a username and
+// password from the htpasswd (or htdigest) file
+func (p *Proxy) handleSocks(conn net.Conn) {
+	defer conn.Close()
+
+	// the lockouts of the client's device
+	lockoutKey := p.identify(connRequest(conn, "")).AddressKey()
+
+	var auth socks5.Authenticator
+
+	if p.proxyAuthConf.Enabled {
+		if locked, _ := p.lockout.LockedOut(lockoutKey); locked {
+			p.logger.Debug("SOCKS client is locked out", zap.String("client address", conn.RemoteAddr().String()))
+			return
+		}
+
+		auth = func(user string, password string) bool {
+			if p.authenticatePassword(user, password) {
+				return true
+			}
+
+			p.proxyLoginFailed(lockoutKey, conn.RemoteAddr().String(), user)
+
+			return false
+		}
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(SOCKS_HANDSHAKE_TIMEOUT))
+
+	sreq, err := socks5.Handshake(conn, auth)
+
+	if err != nil {
+		p.logger.Debug("error reading the SOCKS request", zap.String("client address", conn.RemoteAddr().String()), zap.Error(err))
+		return
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	req := connRequest(conn, sreq.Address())
+
+	id := p.identify(req)
+	id.User = sreq.User
+	req = req.WithContext(client.WithIdentity(req.Context(), id))
+
+	w, release, ok := p.authorizeConn(req)
+
+	if !ok {
+		_ = socks5.WriteReply(conn, socks5.REPLY_NOT_ALLOWED, nil)
+		return
+	}
+
+	defer release()
+
+	upstream, err := p.dial(req, sreq.Address())
+
+	if err != nil {
+		p.logger.Warn("error connecting to the SOCKS destination", zap.String("client address", conn.RemoteAddr().String()), zap.String("destination", sreq.Address()), zap.Error(err))
+		_ = socks5.WriteReply(conn, socksDialReply(err), nil)
+		return
+	}
+
+	if err := socks5.WriteReply(conn, socks5.REPLY_SUCCEEDED, upstream.LocalAddr()); err != nil {
+		upstream.Close()
+		return
+	}
+
+	var clientConn net.Conn = conn
+
+	if w.throttle != nil {
+		clientConn = throttle.NewConn(conn, w.throttle)
+	}
+
+	transparent.Splice(clientConn, upstream)
+}
+
+// socksDialReply returns the reply code for an error connecting to the target
+func socksDialReply(err error) byte {
+	opErr, ok := err.(*net.OpError)
+
+	if !ok {
+		return socks5.REPLY_GENERAL_FAILURE
+	}
+
+	if _, ok := opErr.Err.(*net.DNSError); ok {
+		return socks5.REPLY_HOST_UNREACHABLE
+	}
+
+	if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+		switch sysErr.Err {
+		case syscall.ECONNREFUSED:
+			return socks5.REPLY_CONNECTION_REFUSED
+		case syscall.ENETUNREACH:
+			return socks5.REPLY_NETWORK_UNREACHABLE
+		case syscall.EHOSTUNREACH:
+			return socks5.REPLY_HOST_UNREACHABLE
+		}
+	}
+
+	return socks5.REPLY_GENERAL_FAILURE
+}
+
+func (p *Proxy) listenSocks() error {
+	addr := net.JoinHostPort(p.listenConf.Host, strconv.Itoa(p.listenConf.SocksPort))
+
+	l, err := p.listenTCP(addr)
+
+	if err != nil {
+		return err
+	}
+
+	p.socksListener = l
+
+	p.logger.Info("SOCKS server listening", zap.String("listen address", addr))
+
+	p.waitGroup.Add(1)
+	go func() {
+		defer p.waitGroup.Done()
+
+		p.serveConns(l, p.handleSocks)
+	}()
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/logger"
+	"github.com/cthayer/pc-proxy/internal/socks5"
+)
+
+func TestProxy_handleSocks(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		_, _ = resp.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "block", "type": "host", "pattern": "127\\.0\\.0\\.2"},
+	}
+	conf.ProxyAuth = config.ProxyAuthConfig{Enabled: true, Scheme: AUTH_SCHEME_BASIC, HtpasswdFile: "../../test/htpasswd"}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	defer l.Close()
+
+	go pxy.serveConns(l, pxy.handleSocks)
+
+	tests := []struct {
+		name      string
+		user      string
+		password  string
+		host      string
+		wantAuth  byte
+		wantReply byte
+		wantBody  string
+	}{
+		{name: "allowed", user: "alice", password: "alicepw", host: "127.0.0.1", wantAuth: socks5.AUTH_SUCCEEDED, wantReply: socks5.REPLY_SUCCEEDED, wantBody: "hello"},
+		{name: "blocked", user: "alice", password: "alicepw", host: "127.0.0.2", wantAuth: socks5.AUTH_SUCCEEDED, wantReply: socks5.REPLY_NOT_ALLOWED},
+		{name: "wrong password", user: "alice", password: "wrong", host: "127.0.0.1", wantAuth: socks5.AUTH_FAILED},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", l.Addr().String())
+
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+
+			defer conn.Close()
+
+			r := bufio.NewReader(conn)
+
+			_, _ = conn.Write([]byte{socks5.VERSION, 1, socks5.METHOD_USER_PASS})
+
+			if method := readSocks(t, r, 2); method[1] != socks5.METHOD_USER_PASS {
+				t.Fatalf("method = %v, want %v", method[1], socks5.METHOD_USER_PASS)
+			}
+
+			auth := append([]byte{socks5.AUTH_VERSION, byte(len(tt.user))}, tt.user...)
+			auth = append(append(auth, byte(len(tt.password))), tt.password...)
+			_, _ = conn.Write(auth)
+
+			if status := readSocks(t, r, 2); status[1] != tt.wantAuth {
+				t.Fatalf("auth status = %v, want %v", status[1], tt.wantAuth)
+			}
+
+			if tt.wantAuth != socks5.AUTH_SUCCEEDED {
+				return
+			}
+
+			p, _ := strconv.Atoi(port)
+			req := append([]byte{socks5.VERSION, socks5.COMMAND_CONNECT, 0, socks5.ADDRESS_IPV4}, net.ParseIP(tt.host).To4()...)
+			req = append(req, 0, 0)
+			binary.BigEndian.PutUint16(req[len(req)-2:], uint16(p))
+			_, _ = conn.Write(req)
+
+			if reply := readSocks(t, r, 10); reply[1] != tt.wantReply {
+				t.Fatalf("reply = %v, want %v", reply[1], tt.wantReply)
+			}
+
+			if tt.wantReply != socks5.REPLY_SUCCEEDED {
+				return
+			}
+
+			hreq, _ := http.NewRequest("GET", "http://"+origin.Listener.Addr().String()+"/", nil)
+			hreq.Close = true
+
+			if err := hreq.Write(conn); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+
+			resp, err := http.ReadResponse(r, hreq)
+
+			if err != nil {
+				t.Fatalf("ReadResponse() error = %v", err)
+			}
+
+			defer resp.Body.Close()
+
+			if body, _ := ioutil.ReadAll(resp.Body); string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func readSocks(t *testing.T, r io.Reader, n int) []byte {
+	b := make([]byte, n)
+
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+
+	return b
+}
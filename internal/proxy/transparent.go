@@ -0,0 +1,334 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/cthayer/pc-proxy/internal/client"
+	"github.com/cthayer/pc-proxy/internal/throttle"
+	"github.com/cthayer/pc-proxy/internal/transparent"
+)
+
+const (
+	// how long a client has to send the TLS ClientHello
+	TRANSPARENT_PEEK_TIMEOUT = time.Second * 10
+)
+
+type originalDstContextKey struct{}
+
+// originalDst is the address a redirected connection was sent to
+type originalDst struct {
+	addr string
+	err  error
+}
+
+// throttledResponseWriter limits the bandwidth of a response body
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+// discardResponseWriter records the status of responses that can't be sent to the client (connections that aren't HTTP)
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return len(b), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// canPrompt returns false when the response is discarded (the client can't be asked for the bypass password)
+func canPrompt(resp http.ResponseWriter) bool {
+	if w, ok := resp.(*responseWriter); ok {
+		resp = w.ResponseWriter
+	}
+
+	_, discarded := resp.(*discardResponseWriter)
+
+	return !discarded
+}
+
+// serveConns accepts connections until the listener is closed
+func (p *Proxy) serveConns(l net.Listener, handle func(conn net.Conn)) {
+	for {
+		conn, err := l.Accept()
+
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(time.Millisecond * 100)
+				continue
+			}
+
+			return
+		}
+
+		done := p.trackConn()
+
+		go func() {
+			defer done()
+
+			handle(conn)
+		}()
+	}
+}
+
+// handleTransparentTLS checks a redirected HTTPS connection against the rules, using the server name from the TLS
+// ClientHello as the host, and splices it to its original destination when it is allowed
+func (p *Proxy) handleTransparentTLS(conn net.Conn) {
+	defer conn.Close()
+
+	dst, err := p.originalDst(conn)
+
+	if err != nil {
+		p.logger.Error("error reading the original destination of a transparent connection", zap.String("client address", conn.RemoteAddr().String()), zap.Error(err))
+		return
+	}
+
+	if dst == conn.LocalAddr().String() {
+		// connecting to the proxy itself would loop forever
+		p.logger.Warn("transparent connection was not redirected", zap.String("client address", conn.RemoteAddr().String()))
+		return
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(TRANSPARENT_PEEK_TIMEOUT))
+
+	serverName, peeked, err := transparent.PeekServerName(conn)
+
+	if err != nil {
+		p.logger.Debug("error reading the TLS client hello of a transparent connection", zap.String("client address", conn.RemoteAddr().String()), zap.Error(err))
+		return
+	}
+
+	_ = conn.SetReadDeadline(time.Time{})
+
+	host, port, _ := net.SplitHostPort(dst)
+
+	if serverName != "" {
+		host = serverName
+	}
+
+	req := connRequest(conn, net.JoinHostPort(host, port))
+	req = req.WithContext(client.WithIdentity(req.Context(), p.identify(req)))
+
+	w, release, ok := p.authorizeConn(req)
+
+	if !ok {
+		return
+	}
+
+	defer release()
+
+	upstream, err := p.dial(req, dst)
+
+	if err != nil {
+		p.logger.Warn("error connecting to the original destination", zap.String("client address", conn.RemoteAddr().String()), zap.String("destination", dst), zap.Error(err))
+		return
+	}
+
+	var clientConn net.Conn = peeked
+
+	if w.throttle != nil {
+		clientConn = throttle.NewConn(peeked, w.throttle)
+	}
+
+	transparent.Splice(clientConn, upstream)
+}
+
+// connRequest synthesizes the CONNECT request of a connection that wasn't made with an HTTP proxy request, so the rules
+// can be checked
+func connRequest(conn net.Conn, hostPort string) *http.Request {
+	return &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: hostPort},
+		Host:       hostPort,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+		RequestURI: hostPort,
+	}
+}
+
+// authorizeConn applies the client limits and the rules to a connection's synthesized request (with the client's identity
+// attached).  Clients can't be asked for a bypass password, but bypasses they were already granted apply.  `release` must
+// be called when the connection is closed
+func (p *Proxy) authorizeConn(req *http.Request) (*responseWriter, func(), bool) {
+	id := client.IdentityFromRequest(req)
+
+	if !p.acquire(req, id) {
+		return nil, nil, false
+	}
+
+	release := func() {
+		p.limiter.Release(id.Key())
+	}
+
+	w := &responseWriter{ResponseWriter: &discardResponseWriter{}}
+
+	if !p.IsAuthorized(w, req) {
+		release()
+		return nil, nil, false
+	}
+
+	return w, release, true
+}
+
+func (p *Proxy) listenTransparentTLS() error {
+	addr := net.JoinHostPort(p.listenConf.Host, strconv.Itoa(p.listenConf.TransparentTlsPort))
+
+	l, err := p.listenTCP(addr)
+
+	if err != nil {
+		return err
+	}
+
+	p.transparentTlsListener = l
+
+	p.logger.Info("transparent HTTPS server listening", zap.String("listen address", addr))
+
+	p.waitGroup.Add(1)
+	go func() {
+		defer p.waitGroup.Done()
+
+		p.serveConns(l, p.handleTransparentTLS)
+	}()
+
+	return nil
+}
+
+// handleTransparentHTTP checks a redirected plain HTTP request against the rules and forwards it to its original
+// destination when it is allowed.  Redirected requests are in origin form (`GET /path` with a `Host` header), so they are
+// rebuilt into the absolute form of proxy requests first.  Blocked requests get the block page (or a 403)
+func (p *Proxy) handleTransparentHTTP(resp http.ResponseWriter, req *http.Request) {
+	dst, _ := req.Context().Value(originalDstContextKey{}).(originalDst)
+
+	if dst.err != nil {
+		p.logger.Error("error reading the original destination of a transparent request", zap.String("client address", req.RemoteAddr), zap.Error(dst.err))
+		http.Error(resp, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	if req.Host == "" {
+		// HTTP/1.0 clients may not send the host
+		req.Host = dst.addr
+	}
+
+	req.URL.Scheme = "http"
+	req.URL.Host = req.Host
+	req.RequestURI = req.URL.String()
+
+	id := p.identify(req)
+	req = req.WithContext(client.WithIdentity(req.Context(), id))
+
+	if !p.acquire(req, id) {
+		http.Error(resp, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	defer p.limiter.Release(id.Key())
+
+	// clients don't know they are using a proxy, so the rules' challenges are discarded
+	w := &responseWriter{ResponseWriter: &discardResponseWriter{}}
+
+	if !p.IsAuthorized(w, req) {
+		p.blocked(&responseWriter{ResponseWriter: resp}, req)
+		return
+	}
+
+	if w.throttle != nil {
+		resp = &throttledResponseWriter{ResponseWriter: resp, w: throttle.NewWriter(resp, w.throttle)}
+	}
+
+	forwarder := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			// connect to the address the client connected to, the host header is kept
+			out.URL.Host = dst.addr
+
+			// stay transparent
+			out.Header["X-Forwarded-For"] = nil
+		},
+		Transport: p.transparentTransport,
+		ErrorHandler: func(resp http.ResponseWriter, req *http.Request, err error) {
+			p.logger.Warn("error forwarding a transparent request", zap.String("client address", req.RemoteAddr), zap.String("destination", dst.addr), zap.Error(err))
+			http.Error(resp, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		},
+	}
+
+	forwarder.ServeHTTP(resp, req)
+}
+
+// transparentConnContext looks up the original destination once for every connection to the transparent HTTP listener
+func (p *Proxy) transparentConnContext(ctx context.Context, conn net.Conn) context.Context {
+	addr, err := p.originalDst(conn)
+
+	if err == nil && addr == conn.LocalAddr().String() {
+		// connecting to the proxy itself would loop forever
+		err = errors.New("the connection was not redirected")
+	}
+
+	return context.WithValue(ctx, originalDstContextKey{}, originalDst{addr: addr, err: err})
+}
+
+func (w *throttledResponseWriter) Write(b []byte) (int, error) {
+	return w.w.Write(b)
+}
+
+func (p *Proxy) listenTransparentHTTP() error {
+	p.transparentSrv = &http.Server{
+		Addr:        net.JoinHostPort(p.listenConf.Host, strconv.Itoa(p.listenConf.TransparentPort)),
+		Handler:     http.HandlerFunc(p.handleTransparentHTTP),
+		ConnContext: p.transparentConnContext,
+	}
+
+	l, err := p.listenTCP(p.transparentSrv.Addr)
+
+	if err != nil {
+		return err
+	}
+
+	p.transparentListener = l
+
+	p.logger.Info("transparent HTTP server listening", zap.String("listen address", p.transparentSrv.Addr))
+
+	p.waitGroup.Add(1)
+	go func() {
+		defer p.waitGroup.Done()
+
+		err := p.transparentSrv.Serve(l)
+
+		if err != http.ErrServerClosed {
+			p.logger.Error("Error serving transparent HTTP requests", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
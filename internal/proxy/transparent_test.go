@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/logger"
+)
+
+func TestProxy_handleTransparentTLS(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		_, _ = resp.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "block", "type": "host", "pattern": "youtube\\.com"},
+	}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	redirected := int32(1)
+
+	// every redirected connection was sent to the origin server
+	pxy.originalDst = func(conn net.Conn) (string, error) {
+		if atomic.LoadInt32(&redirected) == 0 {
+			return conn.LocalAddr().String(), nil
+		}
+
+		return origin.Listener.Addr().String(), nil
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	defer l.Close()
+
+	go pxy.serveConns(l, pxy.handleTransparentTLS)
+
+	get := func(serverName string) (string, error) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+
+		if err != nil {
+			return "", err
+		}
+
+		defer conn.Close()
+
+		req, _ := http.NewRequest("GET", "https://"+serverName+"/", nil)
+
+		if err := req.Write(conn); err != nil {
+			return "", err
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+
+		if err != nil {
+			return "", err
+		}
+
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+
+		return string(body), err
+	}
+
+	if body, err := get("www.example.com"); err != nil || body != "hello" {
+		t.Errorf("expected the allowed connection to reach the origin, got %q (%v)", body, err)
+	}
+
+	// the block can't be bypassed with a password, the connection is dropped
+	if _, err := get("www.youtube.com"); err == nil {
+		t.Error("expected the blocked connection to be dropped")
+	}
+
+	// connections that weren't redirected would connect back to the proxy
+	atomic.StoreInt32(&redirected, 0)
+
+	if _, err := get("www.example.com"); err == nil {
+		t.Error("expected a connection that wasn't redirected to be dropped")
+	}
+}
+
+func TestProxy_handleTransparentHTTP(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		_, _ = resp.Write([]byte(req.Host + req.URL.Path + " " + req.Header.Get("X-Forwarded-For")))
+	}))
+	defer origin.Close()
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "block", "type": "host", "pattern": "youtube\\.com"},
+		{"access": "block", "type": "url", "pattern": "example\\.com/games", "passwordBypass": false},
+	}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	pxy.originalDst = func(conn net.Conn) (string, error) {
+		return origin.Listener.Addr().String(), nil
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(pxy.handleTransparentHTTP))
+	srv.Config.ConnContext = pxy.transparentConnContext
+	srv.Start()
+
+	defer srv.Close()
+
+	tests := []struct {
+		host   string
+		path   string
+		status int
+		body   string
+	}{
+		{"www.example.com", "/homework", http.StatusOK, "www.example.com/homework "},
+		{"www.example.com", "/games", http.StatusForbidden, ""},
+		// clients that don't know about the proxy can't answer a bypass password challenge
+		{"www.youtube.com", "/", http.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		// an origin form request, like a client that doesn't know about the proxy sends
+		req, _ := http.NewRequest("GET", srv.URL+tt.path, nil)
+		req.Host = tt.host
+
+		resp, err := http.DefaultClient.Do(req)
+
+		if err != nil {
+			t.Fatalf("%v%v: request error = %v", tt.host, tt.path, err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("%v%v: expected status %v, got %v", tt.host, tt.path, tt.status, resp.StatusCode)
+		}
+
+		if tt.body != "" && string(body) != tt.body {
+			t.Errorf("%v%v: expected %q from the origin, got %q", tt.host, tt.path, tt.body, body)
+		}
+	}
+
+	pxy.interceptConf.BlockPage = true
+
+	req, _ := http.NewRequest("GET", srv.URL+"/", nil)
+	req.Host = "www.youtube.com"
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("request error = %v", err)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), "www.youtube.com is blocked") {
+		t.Errorf("expected the block page, got %v %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+
+	"github.com/smartystreets/cproxy/v2"
+	"go.uber.org/zap"
+
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/rule"
+	"github.com/cthayer/pc-proxy/internal/transparent"
+	"github.com/cthayer/pc-proxy/internal/upstream"
+)
+
+const (
+	UPSTREAM_PASSWD_ENV_NAME = "UPSTREAM_PASSWORD"
+)
+
+// upstreamDialer connects cproxy tunnels through the upstream proxy
+type upstreamDialer struct {
+	p *Proxy
+}
+
+func (d upstreamDialer) Dial(address string) cproxy.Socket {
+	conn, err := d.p.upstreamDialer.Dial(address)
+
+	if err != nil {
+		d.p.logger.Warn("error connecting through the upstream proxy", zap.String("upstream", d.p.upstreamConf.Address), zap.String("destination", address), zap.Error(err))
+		return nil
+	}
+
+	return conn
+}
+
+func (p *Proxy) updateUpstream(conf config.UpstreamConfig, password string) {
+	if conf.Enabled && conf.Address == "" {
+		p.logger.Error("invalid upstream config", zap.Error(errors.New("upstream address is required")))
+		conf.Enabled = false
+	}
+
+	if !rule.Route(conf.Route).IsValid() {
+		p.logger.Error("invalid upstream route", zap.String("route", conf.Route))
+		conf.Route = rule.ROUTE_UPSTREAM.String()
+	}
+
+	p.upstreamDirectHosts = p.hostPatterns("upstream directHosts", conf.DirectHosts)
+	p.upstreamHosts = p.hostPatterns("upstream upstreamHosts", conf.UpstreamHosts)
+	p.upstreamDialer = &upstream.Dialer{Address: conf.Address, User: conf.User, Password: password, Timeout: transparent.DIAL_TIMEOUT}
+	p.upstreamConf = conf
+}
+
+// hostPatterns compiles a list of host patterns, skipping the invalid ones
+func (p *Proxy) hostPatterns(name string, patterns []string) []*regexp.Regexp {
+	var compiled []*regexp.Regexp
+
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+
+		if err != nil {
+			p.logger.Error("invalid "+name+" pattern", zap.String("pattern", pattern), zap.Error(err))
+			continue
+		}
+
+		compiled = append(compiled, re)
+	}
+
+	return compiled
+}
+
+// useUpstream returns true when an allowed request is forwarded through the upstream proxy.  The route of the rule that
+// matches the request wins, then the host lists, then the default route
+func (p *Proxy) useUpstream(req *http.Request) bool {
+	if !p.upstreamConf.Enabled {
+		return false
+	}
+
+	for _, r := range p.Rules {
+		if r.Matches(req) {
+			if r.Route != "" {
+				return r.Route == rule.ROUTE_UPSTREAM
+			}
+
+			break
+		}
+	}
+
+	for _, re := range p.upstreamDirectHosts {
+		if re.MatchString(req.Host) {
+			return false
+		}
+	}
+
+	for _, re := range p.upstreamHosts {
+		if re.MatchString(req.Host) {
+			return true
+		}
+	}
+
+	return p.upstreamConf.Route == rule.ROUTE_UPSTREAM.String()
+}
+
+// dial connects to the destination of a tunnel that isn't handled by cproxy (SOCKS and transparent connections)
+func (p *Proxy) dial(req *http.Request, address string) (net.Conn, error) {
+	if p.useUpstream(req) {
+		return p.upstreamDialer.Dial(address)
+	}
+
+	return net.DialTimeout("tcp", address, transparent.DIAL_TIMEOUT)
+}
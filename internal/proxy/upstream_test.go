@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cthayer/pc-proxy/internal/config"
+	"github.com/cthayer/pc-proxy/internal/logger"
+)
+
+func TestProxy_useUpstream(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.Rules = []map[string]interface{}{
+		{"access": "allow", "type": "host", "pattern": "^school\\.example\\.com", "route": "direct"},
+		{"access": "allow", "type": "host", "pattern": "^work\\.example\\.com", "route": "upstream"},
+		{"access": "allow", "type": "host", "pattern": "^other\\.example\\.com"},
+	}
+
+	tests := []struct {
+		name     string
+		upstream config.UpstreamConfig
+		host     string
+		want     bool
+	}{
+		{name: "disabled", upstream: config.UpstreamConfig{Address: "127.0.0.1:3128", Route: "upstream"}, host: "www.example.com:443", want: false},
+		{name: "default upstream", upstream: config.UpstreamConfig{Enabled: true, Address: "127.0.0.1:3128", Route: "upstream"}, host: "www.example.com:443", want: true},
+		{name: "default direct", upstream: config.UpstreamConfig{Enabled: true, Address: "127.0.0.1:3128", Route: "direct"}, host: "www.example.com:443", want: false},
+		{name: "direct host", upstream: config.UpstreamConfig{Enabled: true, Address: "127.0.0.1:3128", Route: "upstream", DirectHosts: []string{"\\.example\\.com"}}, host: "www.example.com:443", want: false},
+		{name: "upstream host", upstream: config.UpstreamConfig{Enabled: true, Address: "127.0.0.1:3128", Route: "direct", UpstreamHosts: []string{"\\.example\\.com"}}, host: "www.example.com:443", want: true},
+		{name: "rule direct", upstream: config.UpstreamConfig{Enabled: true, Address: "127.0.0.1:3128", Route: "upstream"}, host: "school.example.com:443", want: false},
+		{name: "rule upstream", upstream: config.UpstreamConfig{Enabled: true, Address: "127.0.0.1:3128", Route: "direct", DirectHosts: []string{"\\.example\\.com"}}, host: "work.example.com:443", want: true},
+		{name: "rule without route", upstream: config.UpstreamConfig{Enabled: true, Address: "127.0.0.1:3128", Route: "upstream", DirectHosts: []string{"^other\\."}}, host: "other.example.com:443", want: false},
+		{name: "missing address", upstream: config.UpstreamConfig{Enabled: true, Route: "upstream"}, host: "www.example.com:443", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf.Upstream = tt.upstream
+
+			pxy := New()
+			pxy.LoadConfig(&conf)
+
+			req := httptest.NewRequest("CONNECT", tt.host, nil)
+
+			if got := pxy.useUpstream(req); got != tt.want {
+				t.Errorf("useUpstream() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxy_ServeHTTP_Upstream(t *testing.T) {
+	logger.InitLogger("info", "console")
+
+	conf := *config.GetConfig()
+	conf.Upstream = config.UpstreamConfig{Enabled: true, Address: "127.0.0.1:3128", Route: "upstream", DirectHosts: []string{"^direct\\."}}
+
+	pxy := New()
+	pxy.LoadConfig(&conf)
+
+	var used string
+
+	pxy.handler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) { used = "direct" })
+	pxy.upstreamHandler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) { used = "upstream" })
+
+	for host, want := range map[string]string{"direct.example.com:443": "direct", "www.example.com:443": "upstream"} {
+		used = ""
+
+		req := httptest.NewRequest("CONNECT", host, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+
+		pxy.ServeHTTP(httptest.NewRecorder(), req)
+
+		if used != want {
+			t.Errorf("%v: expected the %v handler, got %q", host, want, used)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// buckets that have been idle this long are full again and can be discarded
+	BUCKET_IDLE_TIMEOUT = time.Minute * 10
+)
+
+type Limits struct {
+	RequestsPerSecond float64
+	Burst             int
+	MaxConnections    int
+}
+
+type Counters struct {
+	RateLimited        uint64
+	ConnectionsRefused uint64
+}
+
+// Bucket is a token bucket that refills at `rate` tokens per second up to `burst` tokens
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	used   time.Time
+	now    func() time.Time
+}
+
+type Limiter struct {
+	mu          sync.Mutex
+	buckets     map[string]*Bucket
+	connections map[string]int
+	counters    Counters
+	now         func() time.Time
+}
+
+func NewBucket(rate float64, burst int) *Bucket {
+	return newBucket(rate, burst, time.Now)
+}
+
+func newBucket(rate float64, burst int, now func() time.Time) *Bucket {
+	b := Bucket{
+		now: now,
+	}
+
+	b.SetRate(rate, burst)
+
+	b.tokens = b.burst
+	b.last = now()
+	b.used = b.last
+
+	return &b
+}
+
+// SetRate changes the refill rate and size of the bucket.  A `burst` smaller than 1 allows bursts of one second worth of tokens
+func (b *Bucket) SetRate(rate float64, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rate = rate
+	b.burst = float64(burst)
+
+	if b.burst < 1 {
+		b.burst = rate
+	}
+
+	if b.burst < 1 {
+		b.burst = 1
+	}
+
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *Bucket) Rate() (rate float64, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.rate, int(b.burst)
+}
+
+func (b *Bucket) Allow() bool {
+	return b.AllowN(1)
+}
+
+func (b *Bucket) AllowN(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+
+	b.used = b.last
+
+	if b.tokens < float64(n) {
+		return false
+	}
+
+	b.tokens -= float64(n)
+
+	return true
+}
+
+// Reserve takes `n` tokens from the bucket, going into debt when there aren't enough, and returns how long the caller must wait before using them
+func (b *Bucket) Reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+
+	b.used = b.last
+	b.tokens -= float64(n)
+
+	if b.tokens >= 0 || b.rate <= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Idle returns true when the bucket is full and hasn't been used for `timeout`
+func (b *Bucket) Idle(timeout time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+
+	return b.tokens >= b.burst && b.now().Sub(b.used) >= timeout
+}
+
+func (b *Bucket) refill() {
+	now := b.now()
+
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+
+	b.last = now
+}
+
+func New() *Limiter {
+	return newLimiter(time.Now)
+}
+
+func newLimiter(now func() time.Time) *Limiter {
+	return &Limiter{
+		buckets:     map[string]*Bucket{},
+		connections: map[string]int{},
+		now:         now,
+	}
+}
+
+// Allow consumes a request token for the client.  It always returns true when the request rate is not limited
+func (l *Limiter) Allow(client string, limits Limits) bool {
+	if limits.RequestsPerSecond <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+
+	b, ok := l.buckets[client]
+
+	if !ok {
+		b = newBucket(limits.RequestsPerSecond, limits.Burst, l.now)
+		l.buckets[client] = b
+	}
+
+	l.mu.Unlock()
+
+	// the limits may have changed since the bucket was created (config reload)
+	if rate, burst := b.Rate(); rate != limits.RequestsPerSecond || (limits.Burst > 0 && burst != limits.Burst) {
+		b.SetRate(limits.RequestsPerSecond, limits.Burst)
+	}
+
+	if !b.Allow() {
+		atomic.AddUint64(&l.counters.RateLimited, 1)
+		return false
+	}
+
+	return true
+}
+
+// Acquire reserves a concurrent connection slot for the client.  Every successful call must be followed by a call to `Release`
+func (l *Limiter) Acquire(client string, limits Limits) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limits.MaxConnections > 0 && l.connections[client] >= limits.MaxConnections {
+		atomic.AddUint64(&l.counters.ConnectionsRefused, 1)
+		return false
+	}
+
+	l.connections[client]++
+
+	return true
+}
+
+func (l *Limiter) Release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.connections[client]--
+
+	if l.connections[client] <= 0 {
+		delete(l.connections, client)
+	}
+}
+
+func (l *Limiter) Connections(client string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.connections[client]
+}
+
+func (l *Limiter) Counters() Counters {
+	return Counters{
+		RateLimited:        atomic.LoadUint64(&l.counters.RateLimited),
+		ConnectionsRefused: atomic.LoadUint64(&l.counters.ConnectionsRefused),
+	}
+}
+
+// Prune discards the buckets of clients that haven't made a request recently
+func (l *Limiter) Prune() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for client, b := range l.buckets {
+		if b.Idle(BUCKET_IDLE_TIMEOUT) {
+			delete(l.buckets, client)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestBucket_Allow(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	b := newBucket(2, 2, clock.now)
+
+	if !b.Allow() || !b.Allow() {
+		t.Error("expected the first 2 requests to be allowed")
+	}
+
+	if b.Allow() {
+		t.Error("expected the 3rd request to be limited")
+	}
+
+	clock.t = clock.t.Add(time.Millisecond * 500)
+
+	if !b.Allow() {
+		t.Error("expected a request to be allowed after the bucket refilled")
+	}
+
+	if b.Allow() {
+		t.Error("expected the bucket to be empty")
+	}
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	l := newLimiter(clock.now)
+	limits := Limits{RequestsPerSecond: 1, Burst: 1}
+
+	if !l.Allow("10.0.0.1", limits) {
+		t.Error("expected the first request to be allowed")
+	}
+
+	if l.Allow("10.0.0.1", limits) {
+		t.Error("expected the second request to be limited")
+	}
+
+	if !l.Allow("10.0.0.2", limits) {
+		t.Error("expected clients to have separate buckets")
+	}
+
+	if !l.Allow("10.0.0.1", Limits{}) {
+		t.Error("expected requests to be allowed when the rate is not limited")
+	}
+
+	if c := l.Counters(); c.RateLimited != 1 {
+		t.Errorf("expected 1 rate limited request, got %v", c.RateLimited)
+	}
+}
+
+func TestLimiter_Acquire(t *testing.T) {
+	l := New()
+	limits := Limits{MaxConnections: 2}
+
+	if !l.Acquire("10.0.0.1", limits) || !l.Acquire("10.0.0.1", limits) {
+		t.Error("expected the first 2 connections to be allowed")
+	}
+
+	if l.Acquire("10.0.0.1", limits) {
+		t.Error("expected the 3rd connection to be refused")
+	}
+
+	l.Release("10.0.0.1")
+
+	if !l.Acquire("10.0.0.1", limits) {
+		t.Error("expected a connection to be allowed after one was released")
+	}
+
+	if n := l.Connections("10.0.0.1"); n != 2 {
+		t.Errorf("expected 2 connections, got %v", n)
+	}
+
+	if c := l.Counters(); c.ConnectionsRefused != 1 {
+		t.Errorf("expected 1 refused connection, got %v", c.ConnectionsRefused)
+	}
+}
+
+func TestLimiter_Prune(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	l := newLimiter(clock.now)
+
+	l.Allow("10.0.0.1", Limits{RequestsPerSecond: 1})
+
+	clock.t = clock.t.Add(BUCKET_IDLE_TIMEOUT)
+
+	l.Prune()
+
+	if len(l.buckets) != 0 {
+		t.Errorf("expected idle buckets to be pruned, got %v", len(l.buckets))
+	}
+}
@@ -1,10 +1,16 @@
 package rule
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"regexp"
+	"strconv"
 	"time"
+
+	"github.com/cthayer/pc-proxy/internal/client"
+	"github.com/cthayer/pc-proxy/internal/credential"
+	"github.com/cthayer/pc-proxy/internal/digest"
 )
 
 const (
@@ -14,22 +20,114 @@ const (
 	DEFAULT_PASSWORD_BYPASS = true
 
 	DEFAULT_BASIC_AUTH_REALM = "pc-proxy: Enter password to bypass block"
+
+	// bypass cache key used for grants with the "all" scope
+	BYPASS_KEY_ALL = "*"
+	// prefix of bypass cache keys used for grants with the "host" scope
+	BYPASS_KEY_HOST_PREFIX = "host:"
+
+	BYPASS_EVENT_CHALLENGE BypassEventType = "challenge"
+	BYPASS_EVENT_UNLOCK    BypassEventType = "unlock"
+	BYPASS_EVENT_FAILURE   BypassEventType = "failure"
+	BYPASS_EVENT_LOCKOUT   BypassEventType = "lockout"
+
+	ROUTE_DIRECT   Route = "direct"
+	ROUTE_UPSTREAM Route = "upstream"
+)
+
+const (
+	authMissing authResult = iota
+	authStale
+	authFailed
+	authOk
 )
 
 var (
-	accessValues map[string]string = map[string]string{"block": "block", "allow": "allow"}
+	accessValues map[string]string = map[string]string{"block": "block", "allow": "allow", "throttle": "throttle"}
 	typeValues   map[string]string = map[string]string{"host": "host", "path": "path", "url": "url"}
+	scopeValues  map[string]string = map[string]string{"rule": "rule", "host": "host", "all": "all"}
+	routeValues  map[string]string = map[string]string{"direct": "direct", "upstream": "upstream"}
 )
 
 type RuleAccess string
 
 type RuleType string
 
+// BypassScope controls what a successful bypass unlocks: the matched rule, the requested host, or all rules
+type BypassScope string
+
+// Route selects how allowed requests reach the destination: directly or through the upstream (parent) proxy
+type Route string
+
 type Rule struct {
 	Access         RuleAccess
 	Type           RuleType
 	Pattern        string
 	PasswordBypass bool
+	ThrottleRate   int64 // bytes per second (only used when `Access` is "throttle")
+	Tags           []string
+	BypassDuration time.Duration          // overrides the global bypass duration when > 0
+	BypassScope    BypassScope            // overrides the global bypass scope when set
+	Clients        []client.Selector      // the rule only applies to these clients (empty applies to all clients)
+	Credential     *credential.Credential // the rule's own bypass password, replaces the default credential when set
+	Route          Route                  // overrides the upstream proxy's host lists when set
+	Intercept      bool                   // decrypt the CONNECT requests the rule allows, so every rule applies to the requests inside
+}
+
+// BypassStore tracks which clients have bypassed which blocks.  Implementations must be safe for concurrent use
+type BypassStore interface {
+	// Active returns true when the client has an unexpired grant for the key
+	Active(client string, key string) bool
+	Grant(client string, key string, expires time.Time)
+}
+
+// BypassLockout tracks failed bypass attempts.  Implementations must be safe for concurrent use
+type BypassLockout interface {
+	// LockedOut returns true (and when the lockout ends) while the client is locked out
+	LockedOut(client string) (bool, time.Time)
+	// Failure records a failed attempt and returns true (and when the lockout ends) when it locked the client out
+	Failure(client string) (bool, time.Time)
+	Success(client string)
+}
+
+type BypassEventType string
+
+type authResult int
+
+type authenticatedContextKey struct{}
+
+// authenticated is the result of Authenticate, recorded in the request's context
+type authenticated struct {
+	pattern string
+	cred    credential.Credential
+}
+
+// BypassEvent describes what happened when a client tried to bypass a rule
+type BypassEvent struct {
+	Type       BypassEventType
+	Rule       Rule
+	Client     string
+	Name       string        // the client's host name (when known)
+	Host       string        // the requested host
+	Credential string        // name of the credential used (unlock events)
+	Key        string        // the bypass store key of the grant (unlock events)
+	Duration   time.Duration // how long the bypass lasts (unlock events)
+	Expires    time.Time     // when the bypass ends (unlock events)
+	Until      time.Time     // when the lockout ends (lockout events)
+}
+
+// Bypass holds what a rule needs to allow a client to bypass a block with a password
+type Bypass struct {
+	Credentials *credential.Set
+	Store       BypassStore
+	Lockout     BypassLockout  // optional
+	Digest      *digest.Server // use digest auth instead of basic auth when set
+	Duration    time.Duration
+	Scope       BypassScope
+	Default     string // name of the credential that a rule's own bypass password replaces
+
+	// optional, called for every bypass event
+	OnEvent func(e BypassEvent)
 }
 
 func New() Rule {
@@ -38,14 +136,24 @@ func New() Rule {
 		Type:           DEFAULT_TYPE,
 		Pattern:        DEFAULT_PATTERN,
 		PasswordBypass: DEFAULT_PASSWORD_BYPASS,
+		ThrottleRate:   0,
+		Tags:           nil,
+		BypassDuration: 0,
+		BypassScope:    "",
+		Clients:        nil,
+		Credential:     nil,
+		Route:          "",
+		Intercept:      false,
 	}
 }
 
-func (r Rule) Match(req *http.Request, resp http.ResponseWriter, password string, bypassCache *map[string]map[string]time.Duration, bypassCacheDuration time.Duration) (match bool, allow bool) {
+// Matches returns true when the request matches the rule's clients, type and pattern
+func (r Rule) Matches(req *http.Request) bool {
 	var checkStr string
 
-	// does this rule allow access?
-	allowed := r.Access.String() == "allow"
+	if !r.appliesTo(client.IdentityFromRequest(req)) {
+		return false
+	}
 
 	switch r.Type {
 	case "host":
@@ -56,11 +164,21 @@ func (r Rule) Match(req *http.Request, resp http.ResponseWriter, password string
 		checkStr = req.URL.String()
 	default:
 		// can't match against an invalid rule
-		return false, allowed
+		return false
 	}
 
-	if matched, err := regexp.Match(r.Pattern, []byte(checkStr)); err != nil || !matched {
-		// error occurred during match check OR not the rule we're looking for
+	matched, err := regexp.Match(r.Pattern, []byte(checkStr))
+
+	// an error occurred during the match check is not a match
+	return err == nil && matched
+}
+
+func (r Rule) Match(req *http.Request, resp http.ResponseWriter, bypass Bypass) (match bool, allow bool) {
+	// does this rule allow access? (throttled requests are allowed, but their bandwidth is limited by the proxy)
+	allowed := r.Access.String() == "allow" || r.Access.String() == "throttle"
+
+	if !r.Matches(req) {
+		// not the rule we're looking for
 		return false, allowed
 	}
 
@@ -70,61 +188,274 @@ func (r Rule) Match(req *http.Request, resp http.ResponseWriter, password string
 
 	if !allowed && r.PasswordBypass {
 		// this request is only allowed if the bypass password has been specified
-		clientIp, _, _ := net.SplitHostPort(req.RemoteAddr)
-
-		if clientIp != "" {
-			// check the bypass cache firs
-			if clientCache, ok := (*bypassCache)[clientIp]; ok {
-				if duration, dOk := clientCache[r.Pattern]; dOk && duration > 0 {
-					// the bypass password has been specified previously, allow the request
-					return true, true
-				}
-			}
+		id := client.IdentityFromRequest(req)
+		clientKey := id.Key()
+		// lockouts are tracked for the client's device, like the proxy logins
+		lockoutKey := id.AddressKey()
+
+		// check the bypass store first
+		if r.Bypassed(req, bypass) {
+			// the bypass password has been specified previously, allow the request
+			return true, true
 		}
 
-		proxyAuth := req.Header.Get("Proxy-Authorization")
+		if bypass.Lockout != nil {
+			if locked, until := bypass.Lockout.LockedOut(lockoutKey); locked {
+				// don't accept (or ask for) the password while the client is locked out
+				lockedOut(resp, until)
 
-		if proxyAuth != "" {
-			req.Header.Set("Authorization", proxyAuth)
+				return true, false
+			}
 		}
 
-		_, p, ok := req.BasicAuth()
+		cred, result := bypass.authenticate(req, r)
 
-		// unset the proxy authorization header
-		if proxyAuth != "" {
-			req.Header.Del("Authorization")
-		}
+		switch result {
+		case authMissing:
+			// no credentials provided, request them and exit
+			bypass.event(BypassEvent{Type: BYPASS_EVENT_CHALLENGE, Rule: r, Client: clientKey, Name: id.Name, Host: req.Host})
+			challenge(resp, bypass, false)
 
-		if !ok {
-			// no basic auth provided, request it and exit
-			// request basic auth
-			resp.Header().Set("Proxy-Authenticate", "Basic realm=\""+DEFAULT_BASIC_AUTH_REALM+"\"")
-			http.Error(resp, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+			return true, false
+		case authStale:
+			// the digest nonce expired, ask the client to retry with a new one (not a failed attempt)
+			challenge(resp, bypass, true)
 
 			return true, false
 		}
 
-		if p == password {
+		if result == authOk {
 			// the provided password is valid, allow access
-			// cache the successful bypass
-			clientCache, ok := (*bypassCache)[clientIp]
-
-			if ok {
-				clientCache[r.Pattern] = bypassCacheDuration
-			} else {
-				// create the cache
-				(*bypassCache)[clientIp] = map[string]time.Duration{
-					r.Pattern: bypassCacheDuration,
-				}
+			// store the successful bypass (for no longer than the credential allows)
+			duration := cred.Duration(r.bypassDuration(bypass))
+			key := r.grantKey(req, bypass, cred)
+			expires := time.Now().Add(duration)
+
+			bypass.Store.Grant(clientKey, key, expires)
+
+			if bypass.Lockout != nil {
+				bypass.Lockout.Success(lockoutKey)
 			}
 
+			bypass.event(BypassEvent{Type: BYPASS_EVENT_UNLOCK, Rule: r, Client: clientKey, Name: id.Name, Host: req.Host, Credential: cred.Name, Key: key, Duration: duration, Expires: expires})
+
 			return true, true
 		}
+
+		// the password is wrong
+		if bypass.Lockout != nil {
+			if locked, until := bypass.Lockout.Failure(lockoutKey); locked {
+				bypass.event(BypassEvent{Type: BYPASS_EVENT_LOCKOUT, Rule: r, Client: clientKey, Name: id.Name, Host: req.Host, Until: until})
+				lockedOut(resp, until)
+
+				return true, false
+			}
+		}
+
+		bypass.event(BypassEvent{Type: BYPASS_EVENT_FAILURE, Rule: r, Client: clientKey, Name: id.Name, Host: req.Host})
+
+		// ask for the password again
+		challenge(resp, bypass, false)
+
+		return true, false
 	}
 
 	return true, allowed
 }
 
+// Authenticate checks the bypass password of a request the rule blocks, without granting a bypass (the proxy login accepts
+// a bypass password in place of the user's password).  Returns the request, if the password is valid, and if the digest
+// nonce is stale.  The returned request records the result, so Match doesn't check (and use up) the password again
+func (r Rule) Authenticate(req *http.Request, bypass Bypass) (*http.Request, bool, bool) {
+	if r.Access.String() != "block" || !r.PasswordBypass {
+		return req, false, false
+	}
+
+	cred, result := bypass.authenticate(req, r)
+
+	if result != authOk {
+		return req, false, result == authStale
+	}
+
+	return req.WithContext(context.WithValue(req.Context(), authenticatedContextKey{}, authenticated{pattern: r.Pattern, cred: cred})), true, false
+}
+
+// Bypassed returns true when the client has an active bypass grant for the rule.  The grants of an authenticated user
+// are only stored under the user (grants for the address would unlock the rule for every user of a shared device).
+// Host and all grants don't unlock restricted rules
+func (r Rule) Bypassed(req *http.Request, bypass Bypass) bool {
+	id := client.IdentityFromRequest(req)
+
+	if id.Key() == "" {
+		return false
+	}
+
+	keys := []string{r.Pattern, hostBypassKey(req), BYPASS_KEY_ALL}
+
+	if r.restricted() {
+		keys = keys[:1]
+	}
+
+	clientKeys := id.Keys()
+
+	if id.User != "" {
+		clientKeys = clientKeys[:1]
+	}
+
+	for _, k := range clientKeys {
+		for _, key := range keys {
+			if bypass.Store.Active(k, key) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (b Bypass) event(e BypassEvent) {
+	if b.OnEvent != nil {
+		b.OnEvent(e)
+	}
+}
+
+// authenticate checks the bypass credentials in the `Proxy-Authorization` header
+func (b Bypass) authenticate(req *http.Request, r Rule) (credential.Credential, authResult) {
+	if a, ok := req.Context().Value(authenticatedContextKey{}).(authenticated); ok && a.pattern == r.Pattern {
+		return a.cred, authOk
+	}
+
+	proxyAuth := req.Header.Get("Proxy-Authorization")
+	creds := b.Credentials
+
+	if r.Credential != nil {
+		creds = creds.Replace(b.Default, *r.Credential)
+	}
+
+	if b.Digest != nil {
+		resp, err := digest.Parse(proxyAuth)
+
+		if err != nil || (req.RequestURI != "" && resp.URI != req.RequestURI) {
+			return credential.Credential{}, authMissing
+		}
+
+		if ok, stale := b.Digest.Use(resp); !ok {
+			if stale {
+				return credential.Credential{}, authStale
+			}
+
+			// unknown or replayed nonce
+			return credential.Credential{}, authMissing
+		}
+
+		if cred, ok := creds.AuthenticateDigest(resp, req.Method, r.Tags); ok {
+			return cred, authOk
+		}
+
+		return credential.Credential{}, authFailed
+	}
+
+	// use the request's basic auth parsing on a copy of the headers
+	_, p, ok := (&http.Request{Header: http.Header{"Authorization": []string{proxyAuth}}}).BasicAuth()
+
+	if !ok {
+		return credential.Credential{}, authMissing
+	}
+
+	if cred, ok := creds.Authenticate(p, r.Tags); ok {
+		return cred, authOk
+	}
+
+	return credential.Credential{}, authFailed
+}
+
+// challenge requests basic or digest auth
+func challenge(resp http.ResponseWriter, bypass Bypass, stale bool) {
+	if bypass.Digest != nil {
+		for _, c := range bypass.Digest.Challenges(DEFAULT_BASIC_AUTH_REALM, stale) {
+			resp.Header().Add("Proxy-Authenticate", c)
+		}
+	} else {
+		resp.Header().Set("Proxy-Authenticate", "Basic realm=\""+DEFAULT_BASIC_AUTH_REALM+"\"")
+	}
+
+	http.Error(resp, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+}
+
+func lockedOut(resp http.ResponseWriter, until time.Time) {
+	retryAfter := int(time.Until(until).Seconds()) + 1
+
+	resp.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(resp, "Too many failed bypass attempts.  Try again later", http.StatusTooManyRequests)
+}
+
+func (r Rule) appliesTo(id client.Identity) bool {
+	if len(r.Clients) == 0 {
+		return true
+	}
+
+	for _, s := range r.Clients {
+		if s.Matches(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r Rule) bypassDuration(bypass Bypass) time.Duration {
+	if r.BypassDuration > 0 {
+		return r.BypassDuration
+	}
+
+	return bypass.Duration
+}
+
+// BypassKey returns the bypass store key for a grant, based on the rule's (or the global) scope
+func (r Rule) BypassKey(req *http.Request, bypass Bypass) string {
+	scope := bypass.Scope
+
+	if r.BypassScope.IsValid() {
+		scope = r.BypassScope
+	}
+
+	switch scope {
+	case "host":
+		return hostBypassKey(req)
+	case "all":
+		return BYPASS_KEY_ALL
+	default:
+		return r.Pattern
+	}
+}
+
+// grantKey returns the bypass store key for a grant made with the credential.  Credentials restricted to tagged rules
+// and restricted rules only unlock the rule (a host or all grant would unlock rules they can't bypass)
+func (r Rule) grantKey(req *http.Request, bypass Bypass, cred credential.Credential) string {
+	if len(cred.Tags) > 0 || r.restricted() {
+		return r.Pattern
+	}
+
+	return r.BypassKey(req, bypass)
+}
+
+// restricted returns true for the rules only some credentials can bypass (rules with their own password or with tags).
+// They are only unlocked by grants for the rule, so a host or all grant made with another password doesn't unlock them
+func (r Rule) restricted() bool {
+	return r.Credential != nil || len(r.Tags) > 0
+}
+
+func hostBypassKey(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.Host)
+
+	if err != nil {
+		// no port in the host
+		host = req.Host
+	}
+
+	return BYPASS_KEY_HOST_PREFIX + host
+}
+
 func (a RuleAccess) IsValid() bool {
 	_, ok := accessValues[string(a)]
 
@@ -156,3 +487,35 @@ func (t RuleType) String() string {
 
 	return ret
 }
+
+func (s BypassScope) IsValid() bool {
+	_, ok := scopeValues[string(s)]
+
+	return ok
+}
+
+func (s BypassScope) String() string {
+	ret, ok := scopeValues[string(s)]
+
+	if !ok {
+		return ""
+	}
+
+	return ret
+}
+
+func (r Route) IsValid() bool {
+	_, ok := routeValues[string(r)]
+
+	return ok
+}
+
+func (r Route) String() string {
+	ret, ok := routeValues[string(r)]
+
+	if !ok {
+		return ""
+	}
+
+	return ret
+}
@@ -1,9 +1,19 @@
 package rule
 
 import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/cthayer/pc-proxy/internal/bypass"
+	"github.com/cthayer/pc-proxy/internal/client"
+	"github.com/cthayer/pc-proxy/internal/credential"
+	"github.com/cthayer/pc-proxy/internal/digest"
+	"github.com/cthayer/pc-proxy/internal/lockout"
 )
 
 func TestNew(t *testing.T) {
@@ -30,13 +40,11 @@ func TestRule_Match(t *testing.T) {
 	target := "http://example.com"
 
 	req := httptest.NewRequest("GET", target, nil)
-	bypassCache := map[string]map[string]time.Duration{}
-
 	r := New()
 
 	r.Pattern = "example\\.com"
 
-	match, allow := r.Match(req, httptest.NewRecorder(), "", &bypassCache, time.Minute)
+	match, allow := r.Match(req, httptest.NewRecorder(), Bypass{Credentials: credential.NewSet(), Store: bypass.NewMemoryStore(), Duration: time.Minute})
 
 	if !match {
 		t.Errorf("expected rule to match.  pattern: %v, target: %v, type: %v", r.Pattern, target, r.Type)
@@ -46,3 +54,497 @@ func TestRule_Match(t *testing.T) {
 		t.Errorf("expected the url to be blocked")
 	}
 }
+
+func TestRule_Match_Throttle(t *testing.T) {
+	target := "http://example.com"
+
+	req := httptest.NewRequest("GET", target, nil)
+	r := New()
+
+	r.Access = "throttle"
+	r.Pattern = "example\\.com"
+
+	if !r.Access.IsValid() {
+		t.Error("expected throttle Access to be valid")
+	}
+
+	match, allow := r.Match(req, httptest.NewRecorder(), Bypass{Credentials: credential.NewSet(), Store: bypass.NewMemoryStore(), Duration: time.Minute})
+
+	if !match {
+		t.Errorf("expected rule to match.  pattern: %v, target: %v, type: %v", r.Pattern, target, r.Type)
+	}
+
+	if !allow {
+		t.Errorf("expected the throttled url to be allowed")
+	}
+}
+
+func TestRule_Match_Credentials(t *testing.T) {
+	hash, err := credential.Hash("homework")
+
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+
+	kid, _ := credential.New("kid", hash, []string{"games"}, time.Minute*30)
+
+	var unlockedWith string
+
+	store := bypass.NewMemoryStore()
+	b := Bypass{
+		Credentials: credential.NewSet(credential.NewPlaintext("parent", "secret"), kid),
+		Store:       store,
+		Duration:    time.Hour,
+		OnEvent: func(e BypassEvent) {
+			if e.Type == BYPASS_EVENT_UNLOCK {
+				unlockedWith = e.Credential
+			}
+		},
+	}
+
+	r := New()
+	r.Pattern = "example\\.com"
+
+	newReq := func(password string) *http.Request {
+		req := httptest.NewRequest("GET", "http://example.com", nil)
+		req.SetBasicAuth("", password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+
+		return req
+	}
+
+	// the kid's credential is restricted to rules tagged "games"
+	if _, allow := r.Match(newReq("homework"), httptest.NewRecorder(), b); allow {
+		t.Error("expected the restricted credential to be rejected for an untagged rule")
+	}
+
+	r.Tags = []string{"games"}
+
+	start := time.Now()
+
+	if _, allow := r.Match(newReq("homework"), httptest.NewRecorder(), b); !allow {
+		t.Error("expected the restricted credential to be accepted for a tagged rule")
+	}
+
+	if unlockedWith != "kid" {
+		t.Errorf("expected bypass to be unlocked with %v, got %v", "kid", unlockedWith)
+	}
+
+	if grants := store.Grants(); len(grants) != 1 || !expiresAfter(grants[0], start, time.Minute*30) {
+		t.Errorf("expected bypass to be limited to the credential MaxDuration, got %v", grants)
+	}
+}
+
+func TestRule_Match_RuleCredential(t *testing.T) {
+	kid, _ := credential.New("kid", "$2a$10$u.VvPb7coU2tC7wWO3uJNuQXHadcRVA0jnGfdj9eIT.tvjNaHsG3K", []string{"games"}, 0)
+	homework := credential.NewPlaintext("rule:homework", "homework")
+
+	b := Bypass{
+		Credentials: credential.NewSet(credential.NewPlaintext("BYPASS_PASSWORD", "secret"), kid),
+		Store:       bypass.NewMemoryStore(),
+		Duration:    time.Hour,
+		Default:     "BYPASS_PASSWORD",
+	}
+
+	newReq := func(password string) *http.Request {
+		req := httptest.NewRequest("GET", "http://example.com", nil)
+		req.RemoteAddr = "192.168.1.10:1234"
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(":"+password)))
+
+		return req
+	}
+
+	r := New()
+	r.Pattern = "example\\.com"
+
+	if _, allow := r.Match(newReq("homework"), httptest.NewRecorder(), b); allow {
+		t.Error("expected the rule password to be rejected by a rule without it")
+	}
+
+	r.Credential = &homework
+
+	if _, allow := r.Match(newReq("secret"), httptest.NewRecorder(), b); allow {
+		t.Error("expected the default password to be replaced by the rule password")
+	}
+
+	if _, allow := r.Match(newReq("homework"), httptest.NewRecorder(), b); !allow {
+		t.Error("expected the rule password to be accepted")
+	}
+}
+
+func TestRule_Match_BypassScope(t *testing.T) {
+	newReq := func(target string, password string) *http.Request {
+		req := httptest.NewRequest("GET", target, nil)
+
+		if password != "" {
+			req.SetBasicAuth("", password)
+			req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+			req.Header.Del("Authorization")
+		}
+
+		return req
+	}
+
+	youtube := New()
+	youtube.Pattern = "youtube\\.com"
+
+	games := New()
+	games.Pattern = "games\\.com"
+
+	tests := []struct {
+		scope    BypassScope
+		key      string
+		unlocked []string
+		blocked  []string
+	}{
+		{"rule", youtube.Pattern, []string{"http://www.youtube.com"}, []string{"http://games.com"}},
+		{"host", "host:music.youtube.com", []string{"http://music.youtube.com"}, []string{"http://www.youtube.com", "http://games.com"}},
+		{"all", BYPASS_KEY_ALL, []string{"http://www.youtube.com", "http://games.com"}, nil},
+	}
+
+	for _, tt := range tests {
+		store := bypass.NewMemoryStore()
+		b := Bypass{
+			Credentials: credential.NewSet(credential.NewPlaintext("parent", "secret")),
+			Store:       store,
+			Duration:    time.Hour,
+			Scope:       "rule",
+		}
+
+		r := youtube
+		r.BypassScope = tt.scope
+		r.BypassDuration = time.Minute * 15
+
+		start := time.Now()
+
+		if _, allow := r.Match(newReq("http://music.youtube.com", "secret"), httptest.NewRecorder(), b); !allow {
+			t.Fatalf("scope %v: expected the password to unlock the rule", tt.scope)
+		}
+
+		if grants := store.Grants(); len(grants) != 1 || grants[0].Key != tt.key || !expiresAfter(grants[0], start, time.Minute*15) {
+			t.Errorf("scope %v: expected a %v grant for %v, got %v", tt.scope, time.Minute*15, tt.key, grants)
+		}
+
+		for _, target := range tt.unlocked {
+			for _, rr := range []Rule{youtube, games} {
+				if match, allow := rr.Match(newReq(target, ""), httptest.NewRecorder(), b); match && !allow {
+					t.Errorf("scope %v: expected %v to be unlocked", tt.scope, target)
+				}
+			}
+		}
+
+		for _, target := range tt.blocked {
+			for _, rr := range []Rule{youtube, games} {
+				if match, allow := rr.Match(newReq(target, ""), httptest.NewRecorder(), b); match && allow {
+					t.Errorf("scope %v: expected %v to be blocked", tt.scope, target)
+				}
+			}
+		}
+	}
+}
+
+func TestRule_Match_BypassScope_Restricted(t *testing.T) {
+	kid := credential.NewPlaintext("kid", "homework")
+	kid.Tags = []string{"games"}
+	homework := credential.NewPlaintext("rule:homework", "homework2")
+
+	newReq := func(password string) *http.Request {
+		req := httptest.NewRequest("GET", "http://music.youtube.com", nil)
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(":"+password)))
+
+		return req
+	}
+
+	tests := []struct {
+		name       string
+		tags       []string
+		credential *credential.Credential
+		password   string
+		key        string
+	}{
+		{name: "unrestricted", password: "secret", key: BYPASS_KEY_ALL},
+		{name: "tagged credential", tags: []string{"games"}, password: "homework", key: "youtube\\.com"},
+		{name: "tagged rule", tags: []string{"games"}, password: "secret", key: "youtube\\.com"},
+		{name: "rule credential", credential: &homework, password: "homework2", key: "youtube\\.com"},
+	}
+
+	for _, tt := range tests {
+		store := bypass.NewMemoryStore()
+		b := Bypass{
+			Credentials: credential.NewSet(credential.NewPlaintext("parent", "secret"), kid),
+			Store:       store,
+			Duration:    time.Hour,
+			Scope:       "all",
+		}
+
+		r := New()
+		r.Pattern = "youtube\\.com"
+		r.Tags = tt.tags
+		r.Credential = tt.credential
+
+		if _, allow := r.Match(newReq(tt.password), httptest.NewRecorder(), b); !allow {
+			t.Fatalf("%v: expected the password to unlock the rule", tt.name)
+		}
+
+		if grants := store.Grants(); len(grants) != 1 || grants[0].Key != tt.key {
+			t.Errorf("%v: expected a grant for %v, got %v", tt.name, tt.key, grants)
+		}
+	}
+}
+
+func TestRule_Bypassed_Restricted(t *testing.T) {
+	homework := credential.NewPlaintext("rule:homework", "homework")
+
+	store := bypass.NewMemoryStore()
+	b := Bypass{
+		Default:     "parent",
+		Credentials: credential.NewSet(credential.NewPlaintext("parent", "secret")),
+		Store:       store,
+		Duration:    time.Hour,
+		Scope:       "all",
+	}
+
+	// an all grant made with the env password
+	store.Grant("192.0.2.1", BYPASS_KEY_ALL, time.Now().Add(time.Hour))
+	store.Grant("192.0.2.1", BYPASS_KEY_HOST_PREFIX+"music.youtube.com", time.Now().Add(time.Hour))
+
+	req := httptest.NewRequest("GET", "http://music.youtube.com", nil)
+
+	r := New()
+	r.Pattern = "youtube\\.com"
+
+	if !r.Bypassed(req, b) {
+		t.Error("expected the all grant to unlock a rule without its own password")
+	}
+
+	r.Credential = &homework
+
+	if r.Bypassed(req, b) {
+		t.Error("expected the all and host grants to not unlock a rule with its own password")
+	}
+
+	r.Credential = nil
+	r.Tags = []string{"games"}
+
+	if r.Bypassed(req, b) {
+		t.Error("expected the all and host grants to not unlock a tagged rule")
+	}
+
+	store.Grant("192.0.2.1", r.Pattern, time.Now().Add(time.Hour))
+
+	if !r.Bypassed(req, b) {
+		t.Error("expected the rule's grant to unlock it")
+	}
+}
+
+func TestBypassScope_IsValid(t *testing.T) {
+	for _, s := range []BypassScope{"rule", "host", "all"} {
+		if !s.IsValid() {
+			t.Errorf("expected %v to be valid", s)
+		}
+	}
+
+	if BypassScope("forever").IsValid() {
+		t.Error("expected an unknown scope to be invalid")
+	}
+}
+
+func TestRule_Match_BypassExpiry(t *testing.T) {
+	store := bypass.NewMemoryStore()
+	b := Bypass{Credentials: credential.NewSet(), Store: store, Duration: time.Hour}
+
+	r := New()
+	r.Pattern = "example\\.com"
+
+	store.Grant("192.0.2.1", r.Pattern, time.Now().Add(-time.Second))
+
+	if _, allow := r.Match(httptest.NewRequest("GET", "http://example.com", nil), httptest.NewRecorder(), b); allow {
+		t.Error("expected an expired grant to be ignored")
+	}
+
+	store.Grant("192.0.2.1", r.Pattern, time.Now().Add(time.Minute))
+
+	if _, allow := r.Match(httptest.NewRequest("GET", "http://example.com", nil), httptest.NewRecorder(), b); !allow {
+		t.Error("expected an active grant to allow the request")
+	}
+}
+
+// expiresAfter returns true when the grant expires `d` after `start` (allowing for the time the test took)
+func expiresAfter(g bypass.Grant, start time.Time, d time.Duration) bool {
+	return !g.Expires.Before(start.Add(d)) && !g.Expires.After(time.Now().Add(d))
+}
+
+func TestRule_Match_Lockout(t *testing.T) {
+	var events []BypassEventType
+
+	tracker := lockout.New(lockout.Config{MaxFailures: 2, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Hour})
+	b := Bypass{
+		Credentials: credential.NewSet(credential.NewPlaintext("parent", "secret")),
+		Store:       bypass.NewMemoryStore(),
+		Lockout:     tracker,
+		Duration:    time.Hour,
+		OnEvent: func(e BypassEvent) {
+			events = append(events, e.Type)
+		},
+	}
+
+	r := New()
+	r.Pattern = "example\\.com"
+
+	newReq := func(password string) *http.Request {
+		req := httptest.NewRequest("GET", "http://example.com", nil)
+		req.SetBasicAuth("", password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+
+		return req
+	}
+
+	rec := httptest.NewRecorder()
+
+	if _, allow := r.Match(newReq("guess1"), rec, b); allow || rec.Code != http.StatusProxyAuthRequired {
+		t.Errorf("expected a wrong password to be challenged again, got %v", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+
+	if _, allow := r.Match(newReq("guess2"), rec, b); allow || rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the client to be locked out, got %v", rec.Code)
+	}
+
+	// the correct password is rejected while locked out
+	rec = httptest.NewRecorder()
+
+	if _, allow := r.Match(newReq("secret"), rec, b); allow || rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the correct password to be rejected while locked out, got %v", rec.Code)
+	}
+
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+
+	// the lockout is for the device, so it applies to the users logged in on it (and to their proxy logins)
+	if locked, _ := tracker.LockedOut("192.0.2.1"); !locked {
+		t.Error("expected the client's address to be locked out")
+	}
+
+	req := newReq("secret")
+	req = req.WithContext(client.WithIdentity(req.Context(), client.Identity{IP: "192.0.2.1", User: "alice"}))
+	rec = httptest.NewRecorder()
+
+	if _, allow := r.Match(req, rec, b); allow || rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected a user of the locked out device to be locked out, got %v", rec.Code)
+	}
+
+	want := []BypassEventType{BYPASS_EVENT_FAILURE, BYPASS_EVENT_LOCKOUT}
+
+	if len(events) != len(want) || events[0] != want[0] || events[1] != want[1] {
+		t.Errorf("expected events %v, got %v", want, events)
+	}
+}
+
+func TestRule_Match_Clients(t *testing.T) {
+	kids, _ := client.ParseSelector("user:alice")
+
+	r := New()
+	r.Pattern = "example\\.com"
+	r.Clients = []client.Selector{kids}
+
+	newReq := func(id client.Identity) *http.Request {
+		req := httptest.NewRequest("GET", "http://example.com", nil)
+
+		return req.WithContext(client.WithIdentity(req.Context(), id))
+	}
+
+	store := bypass.NewMemoryStore()
+	b := Bypass{Credentials: credential.NewSet(), Store: store, Duration: time.Hour}
+
+	if match, _ := r.Match(newReq(client.Identity{IP: "192.0.2.1", User: "bob"}), httptest.NewRecorder(), b); match {
+		t.Error("expected the rule to not apply to other clients")
+	}
+
+	alice := client.Identity{IP: "192.0.2.1", User: "alice"}
+
+	if match, allow := r.Match(newReq(alice), httptest.NewRecorder(), b); !match || allow {
+		t.Error("expected the rule to block the selected client")
+	}
+
+	// grants for the client's address don't apply to the users of the device
+	store.Grant("192.0.2.1", r.Pattern, time.Now().Add(time.Minute))
+
+	if _, allow := r.Match(newReq(alice), httptest.NewRecorder(), b); allow {
+		t.Error("expected a grant for the client's address to not allow a user's request")
+	}
+
+	store.Grant("user:alice", r.Pattern, time.Now().Add(time.Minute))
+
+	if _, allow := r.Match(newReq(alice), httptest.NewRecorder(), b); !allow {
+		t.Error("expected a grant for the user to allow the request")
+	}
+}
+
+func TestRule_Match_Digest(t *testing.T) {
+	var events []BypassEventType
+
+	b := Bypass{
+		Credentials: credential.NewSet(credential.NewPlaintext("parent", "secret")),
+		Store:       bypass.NewMemoryStore(),
+		Digest:      digest.NewServer(),
+		Duration:    time.Hour,
+		OnEvent: func(e BypassEvent) {
+			events = append(events, e.Type)
+		},
+	}
+
+	r := New()
+	r.Pattern = "example\\.com"
+
+	newReq := func(authorization string) *http.Request {
+		req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+		req.Header.Set("Proxy-Authorization", authorization)
+
+		return req
+	}
+
+	// basic auth isn't accepted
+	rec := httptest.NewRecorder()
+	basic := newReq("")
+	basic.SetBasicAuth("", "secret")
+
+	if _, allow := r.Match(newReq(basic.Header.Get("Authorization")), rec, b); allow || rec.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("expected basic auth to be challenged, got %v", rec.Code)
+	}
+
+	challenge := rec.Header().Values("Proxy-Authenticate")
+
+	if len(challenge) != 2 || !strings.HasPrefix(challenge[0], "Digest ") || !strings.Contains(challenge[0], "algorithm=SHA-256") {
+		t.Fatalf("expected a digest challenge, got %v", challenge)
+	}
+
+	rec = httptest.NewRecorder()
+
+	if _, allow := r.Match(newReq(digest.Authorization(challenge[0], "CONNECT", "example.com:443", "kid", "guess")), rec, b); allow || rec.Code != http.StatusProxyAuthRequired {
+		t.Errorf("expected a wrong password to be challenged again, got %v", rec.Code)
+	}
+
+	authorization := digest.Authorization(rec.Header().Values("Proxy-Authenticate")[0], "CONNECT", "example.com:443", "parent", "secret")
+
+	if _, allow := r.Match(newReq(authorization), httptest.NewRecorder(), b); !allow {
+		t.Error("expected the password to unlock the rule")
+	}
+
+	// a replayed response is challenged again (and isn't a failed attempt)
+	b.Store = bypass.NewMemoryStore()
+	rec = httptest.NewRecorder()
+
+	if _, allow := r.Match(newReq(authorization), rec, b); allow || rec.Code != http.StatusProxyAuthRequired {
+		t.Errorf("expected a replayed response to be challenged, got %v", rec.Code)
+	}
+
+	want := []BypassEventType{BYPASS_EVENT_CHALLENGE, BYPASS_EVENT_FAILURE, BYPASS_EVENT_UNLOCK, BYPASS_EVENT_CHALLENGE}
+
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("expected events %v, got %v", want, events)
+	}
+}
@@ -0,0 +1,268 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	VERSION = 0x05
+
+	// RFC 1929 sub-negotiation version
+	AUTH_VERSION = 0x01
+
+	METHOD_NO_AUTH       = 0x00
+	METHOD_USER_PASS     = 0x02
+	METHOD_NO_ACCEPTABLE = 0xff
+
+	COMMAND_CONNECT = 0x01
+
+	ADDRESS_IPV4   = 0x01
+	ADDRESS_DOMAIN = 0x03
+	ADDRESS_IPV6   = 0x04
+
+	REPLY_SUCCEEDED             = 0x00
+	REPLY_GENERAL_FAILURE       = 0x01
+	REPLY_NOT_ALLOWED           = 0x02
+	REPLY_NETWORK_UNREACHABLE   = 0x03
+	REPLY_HOST_UNREACHABLE      = 0x04
+	REPLY_CONNECTION_REFUSED    = 0x05
+	REPLY_COMMAND_NOT_SUPPORTED = 0x07
+	REPLY_ADDRESS_NOT_SUPPORTED = 0x08
+
+	AUTH_SUCCEEDED = 0x00
+	AUTH_FAILED    = 0x01
+)
+
+var (
+	ErrVersion          = errors.New("unsupported SOCKS version")
+	ErrNoAcceptableAuth = errors.New("no acceptable authentication method")
+	ErrAuthFailed       = errors.New("authentication failed")
+	ErrCommand          = errors.New("unsupported SOCKS command")
+	ErrAddressType      = errors.New("unsupported SOCKS address type")
+	errAuthVersion      = errors.New("unsupported SOCKS authentication version")
+	errEmptyDomain      = errors.New("empty SOCKS domain name")
+)
+
+// Request is a client's CONNECT request
+type Request struct {
+	Host string // a domain name or an IP address
+	Port int
+	User string // set when the client authenticated
+}
+
+// Authenticator checks the username and password of a client.  It returns false to refuse the client
+type Authenticator func(user string, password string) bool
+
+func (r Request) Address() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+}
+
+// Handshake negotiates the authentication method (username/password when `auth` is set, no authentication otherwise) and
+// reads the client's request.  Failures are answered before the error is returned.  The caller answers the request with
+// `WriteReply`
+func Handshake(conn io.ReadWriter, auth Authenticator) (Request, error) {
+	var req Request
+
+	methods, err := readGreeting(conn)
+
+	if err != nil {
+		return req, err
+	}
+
+	method := byte(METHOD_NO_AUTH)
+
+	if auth != nil {
+		method = METHOD_USER_PASS
+	}
+
+	if !containsMethod(methods, method) {
+		_, _ = conn.Write([]byte{VERSION, METHOD_NO_ACCEPTABLE})
+		return req, ErrNoAcceptableAuth
+	}
+
+	if _, err := conn.Write([]byte{VERSION, method}); err != nil {
+		return req, err
+	}
+
+	if auth != nil {
+		user, password, err := readUserPass(conn)
+
+		if err != nil {
+			return req, err
+		}
+
+		if !auth(user, password) {
+			_, _ = conn.Write([]byte{AUTH_VERSION, AUTH_FAILED})
+			return req, ErrAuthFailed
+		}
+
+		if _, err := conn.Write([]byte{AUTH_VERSION, AUTH_SUCCEEDED}); err != nil {
+			return req, err
+		}
+
+		req.User = user
+	}
+
+	// VER CMD RSV ATYP
+	header := make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return req, err
+	}
+
+	if header[0] != VERSION {
+		return req, ErrVersion
+	}
+
+	if req.Host, err = readAddress(conn, header[3]); err != nil {
+		if err == ErrAddressType {
+			_ = WriteReply(conn, REPLY_ADDRESS_NOT_SUPPORTED, nil)
+		}
+
+		return req, err
+	}
+
+	port := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return req, err
+	}
+
+	req.Port = int(binary.BigEndian.Uint16(port))
+
+	if header[1] != COMMAND_CONNECT {
+		_ = WriteReply(conn, REPLY_COMMAND_NOT_SUPPORTED, nil)
+		return req, ErrCommand
+	}
+
+	return req, nil
+}
+
+// WriteReply answers the client's request.  `bound` is the address of the proxy's connection to the target (it can be nil)
+func WriteReply(w io.Writer, reply byte, bound net.Addr) error {
+	ip := net.IPv4zero.To4()
+	port := 0
+
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+
+	msg := []byte{VERSION, reply, 0x00}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		msg = append(append(msg, ADDRESS_IPV4), ip4...)
+	} else {
+		msg = append(append(msg, ADDRESS_IPV6), ip.To16()...)
+	}
+
+	msg = append(msg, byte(port>>8), byte(port))
+
+	_, err := w.Write(msg)
+
+	return err
+}
+
+// readGreeting reads the authentication methods the client supports
+func readGreeting(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if header[0] != VERSION {
+		return nil, ErrVersion
+	}
+
+	methods := make([]byte, header[1])
+
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+
+	return methods, nil
+}
+
+// readUserPass reads an RFC 1929 username/password request
+func readUserPass(r io.Reader) (string, string, error) {
+	header := make([]byte, 2)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", "", err
+	}
+
+	if header[0] != AUTH_VERSION {
+		return "", "", errAuthVersion
+	}
+
+	user := make([]byte, header[1])
+
+	if _, err := io.ReadFull(r, user); err != nil {
+		return "", "", err
+	}
+
+	passLen := make([]byte, 1)
+
+	if _, err := io.ReadFull(r, passLen); err != nil {
+		return "", "", err
+	}
+
+	password := make([]byte, passLen[0])
+
+	if _, err := io.ReadFull(r, password); err != nil {
+		return "", "", err
+	}
+
+	return string(user), string(password), nil
+}
+
+func readAddress(r io.Reader, addressType byte) (string, error) {
+	switch addressType {
+	case ADDRESS_IPV4, ADDRESS_IPV6:
+		ip := make(net.IP, net.IPv4len)
+
+		if addressType == ADDRESS_IPV6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+
+		return ip.String(), nil
+	case ADDRESS_DOMAIN:
+		length := make([]byte, 1)
+
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+
+		if length[0] == 0 {
+			return "", errEmptyDomain
+		}
+
+		domain := make([]byte, length[0])
+
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+
+		return string(domain), nil
+	}
+
+	return "", ErrAddressType
+}
+
+func containsMethod(methods []byte, method byte) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
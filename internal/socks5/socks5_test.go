@@ -0,0 +1,122 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// conn is a scripted client: reads come from the client's messages, writes are the server's answers
+type conn struct {
+	io.Reader
+	bytes.Buffer
+}
+
+func newConn(msgs ...[]byte) *conn {
+	return &conn{Reader: bytes.NewReader(bytes.Join(msgs, nil))}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		msgs    [][]byte
+		host    string
+		port    int
+		answers []byte
+	}{
+		{"domain", [][]byte{{5, 1, 0}, {5, 1, 0, 3, 11}, []byte("example.com"), {0x01, 0xbb}}, "example.com", 443, []byte{5, 0}},
+		{"ipv4", [][]byte{{5, 2, 2, 0}, {5, 1, 0, 1, 93, 184, 216, 34, 0, 80}}, "93.184.216.34", 80, []byte{5, 0}},
+		{"ipv6", [][]byte{{5, 1, 0}, {5, 1, 0, 4}, net.ParseIP("2001:db8::1"), {0x01, 0xbb}}, "2001:db8::1", 443, []byte{5, 0}},
+	}
+
+	for _, tt := range tests {
+		c := newConn(tt.msgs...)
+
+		req, err := Handshake(c, nil)
+
+		if err != nil {
+			t.Fatalf("%v: Handshake() error = %v", tt.name, err)
+		}
+
+		if req.Host != tt.host || req.Port != tt.port {
+			t.Errorf("%v: expected %v:%v, got %v:%v", tt.name, tt.host, tt.port, req.Host, req.Port)
+		}
+
+		if !bytes.Equal(c.Bytes(), tt.answers) {
+			t.Errorf("%v: expected the answers %v, got %v", tt.name, tt.answers, c.Bytes())
+		}
+	}
+}
+
+func TestHandshake_UserPass(t *testing.T) {
+	auth := func(user string, password string) bool {
+		return user == "alice" && password == "alicepw"
+	}
+
+	c := newConn([]byte{5, 1, 2}, []byte{1, 5}, []byte("alice"), []byte{7}, []byte("alicepw"), []byte{5, 1, 0, 3, 11}, []byte("example.com"), []byte{0, 80})
+
+	req, err := Handshake(c, auth)
+
+	if err != nil || req.User != "alice" || req.Address() != "example.com:80" {
+		t.Fatalf("Handshake() = %v, %v", req, err)
+	}
+
+	if !bytes.Equal(c.Bytes(), []byte{5, 2, 1, 0}) {
+		t.Errorf("unexpected answers %v", c.Bytes())
+	}
+
+	c = newConn([]byte{5, 1, 2}, []byte{1, 5}, []byte("alice"), []byte{5}, []byte("wrong"))
+
+	if _, err := Handshake(c, auth); err != ErrAuthFailed || !bytes.Equal(c.Bytes(), []byte{5, 2, 1, 1}) {
+		t.Errorf("expected the login to fail, got %v (%v)", err, c.Bytes())
+	}
+
+	// the client doesn't support username/password auth
+	c = newConn([]byte{5, 1, 0})
+
+	if _, err := Handshake(c, auth); err != ErrNoAcceptableAuth || !bytes.Equal(c.Bytes(), []byte{5, 0xff}) {
+		t.Errorf("expected no acceptable method, got %v (%v)", err, c.Bytes())
+	}
+}
+
+func TestHandshake_Errors(t *testing.T) {
+	// SOCKS4
+	if _, err := Handshake(newConn([]byte{4, 1, 0, 80}), nil); err != ErrVersion {
+		t.Errorf("expected %v, got %v", ErrVersion, err)
+	}
+
+	// BIND
+	c := newConn([]byte{5, 1, 0}, []byte{5, 2, 0, 1, 127, 0, 0, 1, 0, 80})
+
+	if _, err := Handshake(c, nil); err != ErrCommand || c.Bytes()[3] != REPLY_COMMAND_NOT_SUPPORTED {
+		t.Errorf("expected %v, got %v (%v)", ErrCommand, err, c.Bytes())
+	}
+
+	c = newConn([]byte{5, 1, 0}, []byte{5, 1, 0, 9})
+
+	if _, err := Handshake(c, nil); err != ErrAddressType || c.Bytes()[3] != REPLY_ADDRESS_NOT_SUPPORTED {
+		t.Errorf("expected %v, got %v (%v)", ErrAddressType, err, c.Bytes())
+	}
+}
+
+func TestWriteReply(t *testing.T) {
+	var b bytes.Buffer
+
+	_ = WriteReply(&b, REPLY_SUCCEEDED, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8080})
+
+	if want := []byte{5, 0, 0, 1, 10, 0, 0, 1, 0x1f, 0x90}; !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("expected %v, got %v", want, b.Bytes())
+	}
+
+	b.Reset()
+	_ = WriteReply(&b, REPLY_NOT_ALLOWED, nil)
+
+	if want := []byte{5, 2, 0, 1, 0, 0, 0, 0, 0, 0}; !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("expected %v, got %v", want, b.Bytes())
+	}
+}
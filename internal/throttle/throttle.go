@@ -0,0 +1,222 @@
+package throttle
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cthayer/pc-proxy/internal/ratelimit"
+)
+
+const (
+	// buckets that have been idle this long are discarded
+	BUCKET_IDLE_TIMEOUT = time.Minute * 10
+)
+
+// rate units and the number of bytes per second they represent
+var rateUnits map[string]float64 = map[string]float64{
+	"bit":  1.0 / 8,
+	"kbit": 1000.0 / 8,
+	"mbit": 1000000.0 / 8,
+	"gbit": 1000000000.0 / 8,
+	"b":    1,
+	"kb":   1000,
+	"mb":   1000000,
+	"gb":   1000000000,
+}
+
+// Registry hands out bandwidth buckets shared by every connection with the same key
+type Registry struct {
+	mu      sync.Mutex
+	buckets map[string]*ratelimit.Bucket
+}
+
+// Conn is a connection whose reads and writes are limited by a shared bandwidth bucket
+type Conn struct {
+	net.Conn
+	bucket *ratelimit.Bucket
+}
+
+// Writer is an io.Writer with limited bandwidth
+type Writer struct {
+	w      io.Writer
+	bucket *ratelimit.Bucket
+}
+
+type halfCloser interface {
+	CloseRead() error
+	CloseWrite() error
+}
+
+// ParseRate converts a rate like "500kbit", "2mbit/s", or "64kB" to bytes per second.  Units are case-insensitive and a rate without a unit is in bytes
+func ParseRate(rate string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(rate))
+	s = strings.TrimSuffix(s, "/s")
+
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+
+	num, unit := s, "b"
+
+	if i >= 0 {
+		num, unit = strings.TrimSpace(s[:i]), strings.TrimSpace(s[i:])
+	}
+
+	multiplier, ok := rateUnits[unit]
+
+	if !ok {
+		return 0, errors.New("invalid rate unit in (" + rate + ").  Must be one of: 'bit', 'kbit', 'mbit', 'gbit', 'B', 'kB', 'MB', or 'GB'")
+	}
+
+	n, err := strconv.ParseFloat(num, 64)
+
+	if err != nil {
+		return 0, errors.New("invalid rate (" + rate + "): " + err.Error())
+	}
+
+	bytes := int64(n * multiplier)
+
+	if bytes < 1 {
+		return 0, errors.New("invalid rate (" + rate + ").  Must be at least 1 byte per second")
+	}
+
+	return bytes, nil
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		buckets: map[string]*ratelimit.Bucket{},
+	}
+}
+
+// Bucket returns the bucket for `key`, creating it (or updating its rate) as needed
+func (r *Registry) Bucket(key string, bytesPerSecond int64) *ratelimit.Bucket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.buckets[key]
+
+	if !ok {
+		b = ratelimit.NewBucket(float64(bytesPerSecond), int(bytesPerSecond))
+		r.buckets[key] = b
+
+		return b
+	}
+
+	if rate, _ := b.Rate(); rate != float64(bytesPerSecond) {
+		b.SetRate(float64(bytesPerSecond), int(bytesPerSecond))
+	}
+
+	return b
+}
+
+// Prune discards buckets that haven't been used recently
+func (r *Registry) Prune() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, b := range r.buckets {
+		if b.Idle(BUCKET_IDLE_TIMEOUT) {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+func NewConn(conn net.Conn, bucket *ratelimit.Bucket) *Conn {
+	return &Conn{
+		Conn:   conn,
+		bucket: bucket,
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if max := c.chunkSize(); len(p) > max {
+		p = p[:max]
+	}
+
+	n, err := c.Conn.Read(p)
+
+	if n > 0 {
+		time.Sleep(c.bucket.Reserve(n))
+	}
+
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	return write(c.Conn, c.bucket, p)
+}
+
+// CloseRead and CloseWrite keep half-close support of the wrapped TCP connection
+func (c *Conn) CloseRead() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseRead()
+	}
+
+	return nil
+}
+
+func (c *Conn) CloseWrite() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseWrite()
+	}
+
+	return nil
+}
+
+// NewWriter limits the bandwidth of writes to `w` (like the body of an HTTP response)
+func NewWriter(w io.Writer, bucket *ratelimit.Bucket) *Writer {
+	return &Writer{
+		w:      w,
+		bucket: bucket,
+	}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	return write(w.w, w.bucket, p)
+}
+
+func write(w io.Writer, bucket *ratelimit.Bucket, p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		chunk := len(p)
+
+		if max := chunkSize(bucket); chunk > max {
+			chunk = max
+		}
+
+		time.Sleep(bucket.Reserve(chunk))
+
+		n, err := w.Write(p[:chunk])
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+func (c *Conn) chunkSize() int {
+	return chunkSize(c.bucket)
+}
+
+// chunkSize keeps single reads and writes from borrowing more than a second worth of bandwidth
+func chunkSize(bucket *ratelimit.Bucket) int {
+	_, burst := bucket.Rate()
+
+	if burst < 1 {
+		return 1
+	}
+
+	return burst
+}
@@ -0,0 +1,111 @@
+package throttle
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := map[string]int64{
+		"500kbit":   62500,
+		"500kbit/s": 62500,
+		"2mbit":     250000,
+		"64kB":      64000,
+		"1MB/s":     1000000,
+		"1024":      1024,
+		" 1.5 kb ":  1500,
+	}
+
+	for rate, want := range tests {
+		got, err := ParseRate(rate)
+
+		if err != nil {
+			t.Errorf("ParseRate(%q) error = %v", rate, err)
+		}
+
+		if got != want {
+			t.Errorf("ParseRate(%q) = %v, wanted %v", rate, got, want)
+		}
+	}
+
+	for _, rate := range []string{"", "fast", "10 parsecs", "0kbit", "1bit"} {
+		if _, err := ParseRate(rate); err == nil {
+			t.Errorf("ParseRate(%q) expected an error", rate)
+		}
+	}
+}
+
+func TestRegistry_Bucket(t *testing.T) {
+	r := NewRegistry()
+
+	a := r.Bucket("10.0.0.1|youtube", 1000)
+	b := r.Bucket("10.0.0.1|youtube", 1000)
+	c := r.Bucket("10.0.0.2|youtube", 1000)
+
+	if a != b {
+		t.Error("expected connections with the same key to share a bucket")
+	}
+
+	if a == c {
+		t.Error("expected connections with different keys to have separate buckets")
+	}
+
+	r.Bucket("10.0.0.1|youtube", 2000)
+
+	if rate, _ := a.Rate(); rate != 2000 {
+		t.Errorf("expected the bucket rate to be updated to %v, got %v", 2000, rate)
+	}
+}
+
+func TestConn_Write(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, server)
+	}()
+
+	r := NewRegistry()
+	rate := int64(10000)
+
+	// two connections sharing the same bucket
+	c1 := NewConn(client, r.Bucket("key", rate))
+	c2 := NewConn(client, r.Bucket("key", rate))
+
+	start := time.Now()
+
+	// the first second worth of data is sent immediately (burst), the remaining half second is throttled
+	if _, err := c1.Write(make([]byte, rate)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	if _, err := c2.Write(make([]byte, rate/2)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Millisecond*400 {
+		t.Errorf("expected shared throttling to take at least 400ms, took %v", elapsed)
+	}
+
+	_ = c1.Close()
+}
+
+func TestWriter_Write(t *testing.T) {
+	rate := int64(10000)
+	w := NewWriter(ioutil.Discard, NewRegistry().Bucket("key", rate))
+
+	start := time.Now()
+
+	n, err := w.Write(make([]byte, rate+rate/2))
+
+	if err != nil || n != int(rate+rate/2) {
+		t.Fatalf("Write() = %v, %v", n, err)
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Millisecond*400 {
+		t.Errorf("expected throttling to take at least 400ms, took %v", elapsed)
+	}
+}
@@ -0,0 +1,52 @@
+// +build linux
+
+package transparent
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+const (
+	// getsockopt option of the netfilter NAT table (linux/netfilter_ipv4.h)
+	SO_ORIGINAL_DST = 80
+)
+
+// OriginalDestination returns the address (`ip:port`) a connection redirected by an iptables REDIRECT or DNAT rule was
+// sent to.  Only IPv4 connections are supported.  A connection that wasn't redirected returns an error (or its local address)
+func OriginalDestination(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+
+	if !ok {
+		return "", errors.New("not a TCP connection")
+	}
+
+	raw, err := tcpConn.SyscallConn()
+
+	if err != nil {
+		return "", err
+	}
+
+	var addr *syscall.IPv6Mreq
+	var sockErr error
+
+	// the sockaddr_in is returned in a struct of the same size as an ipv6_mreq
+	err = raw.Control(func(fd uintptr) {
+		addr, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, SO_ORIGINAL_DST)
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if sockErr != nil {
+		return "", errors.New("error reading the original destination: " + sockErr.Error())
+	}
+
+	ip := net.IPv4(addr.Multiaddr[4], addr.Multiaddr[5], addr.Multiaddr[6], addr.Multiaddr[7])
+	port := int(addr.Multiaddr[2])<<8 | int(addr.Multiaddr[3])
+
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package transparent
+
+import (
+	"errors"
+	"net"
+)
+
+// OriginalDestination is only supported on linux
+func OriginalDestination(conn net.Conn) (string, error) {
+	return "", errors.New("the original destination of redirected connections is only available on linux")
+}
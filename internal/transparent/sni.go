@@ -0,0 +1,84 @@
+package transparent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+)
+
+var errPeeked = errors.New("client hello read")
+
+// peekedConn replays the bytes read while peeking before reading the rest of the connection
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+// readOnlyConn lets the TLS library read the ClientHello without answering it
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+// PeekServerName reads the TLS ClientHello from the connection and returns the server name (SNI) it asks for (empty when
+// the client didn't send one), and a connection that replays the ClientHello so the TLS session can be passed on unchanged
+func PeekServerName(conn net.Conn) (string, net.Conn, error) {
+	var buf bytes.Buffer
+	var serverName string
+
+	peeked := false
+
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			peeked = true
+
+			// stop the handshake, the TLS session isn't terminated here
+			return nil, errPeeked
+		},
+	}).Handshake()
+
+	if !peeked {
+		if err == nil {
+			err = errors.New("no TLS client hello")
+		}
+
+		return "", nil, err
+	}
+
+	return serverName, &peekedConn{Conn: conn, r: io.MultiReader(&buf, conn)}, nil
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// Splice copies data between the connections until either side is done, then closes both of them
+func Splice(a net.Conn, b net.Conn) {
+	done := make(chan struct{}, 2)
+
+	cp := func(dst net.Conn, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		done <- struct{}{}
+	}
+
+	go cp(a, b)
+	go cp(b, a)
+
+	<-done
+
+	_ = a.Close()
+	_ = b.Close()
+
+	<-done
+}
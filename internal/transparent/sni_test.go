@@ -0,0 +1,60 @@
+package transparent
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPeekServerName(t *testing.T) {
+	// use the test server's certificate to finish the handshake after peeking
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	clientConn, serverConn := net.Pipe()
+
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	errs := make(chan error, 1)
+
+	go func() {
+		errs <- tls.Client(clientConn, &tls.Config{ServerName: "www.example.com", InsecureSkipVerify: true}).Handshake()
+	}()
+
+	serverName, conn, err := PeekServerName(serverConn)
+
+	if err != nil {
+		t.Fatalf("PeekServerName() error = %v", err)
+	}
+
+	if serverName != "www.example.com" {
+		t.Errorf("expected %v, got %v", "www.example.com", serverName)
+	}
+
+	// the client hello is replayed, so the handshake can still complete
+	if err := tls.Server(conn, srv.TLS).Handshake(); err != nil {
+		t.Errorf("expected the handshake to complete after peeking, got %v", err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Errorf("client handshake error = %v", err)
+	}
+}
+
+func TestPeekServerName_NotTLS(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+
+	defer serverConn.Close()
+
+	go func() {
+		_, _ = clientConn.Write([]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+		_ = clientConn.Close()
+	}()
+
+	if _, _, err := PeekServerName(serverConn); err == nil {
+		t.Error("expected an error for a connection that isn't TLS")
+	}
+}
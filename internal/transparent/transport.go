@@ -0,0 +1,25 @@
+package transparent
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	DIAL_TIMEOUT         = time.Second * 10
+	IDLE_CONN_TIMEOUT    = time.Second * 90
+	MAX_IDLE_CONNECTIONS = 100
+)
+
+// NewTransport returns the transport used to forward redirected requests.  Unlike the default transport it ignores the
+// proxy environment variables, requests go straight to their original destination
+func NewTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:               nil,
+		DialContext:         (&net.Dialer{Timeout: DIAL_TIMEOUT}).DialContext,
+		MaxIdleConns:        MAX_IDLE_CONNECTIONS,
+		IdleConnTimeout:     IDLE_CONN_TIMEOUT,
+		TLSHandshakeTimeout: DIAL_TIMEOUT,
+	}
+}
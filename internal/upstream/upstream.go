@@ -0,0 +1,100 @@
+package upstream
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Dialer connects to addresses through a parent HTTP proxy with CONNECT requests
+type Dialer struct {
+	Address  string // host:port of the parent proxy
+	User     string // sent with Basic proxy authentication when set
+	Password string
+	Timeout  time.Duration // for connecting to the parent proxy and reading its response
+}
+
+// bufferedConn keeps the bytes the parent proxy sent after its response to the CONNECT request
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseRead and CloseWrite let tunnels close one direction at a time, like a TCP connection
+func (c *bufferedConn) CloseRead() error {
+	if tcp, ok := c.Conn.(*net.TCPConn); ok {
+		return tcp.CloseRead()
+	}
+
+	return nil
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if tcp, ok := c.Conn.(*net.TCPConn); ok {
+		return tcp.CloseWrite()
+	}
+
+	return nil
+}
+
+// Dial returns a tunnel to the address (host:port) through the parent proxy
+func (d *Dialer) Dial(address string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", d.Address, d.Timeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+
+	if d.User != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(d.User+":"+d.Password)))
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(r, req)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New("upstream proxy refused the connection to " + address + " (" + strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode) + ")")
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,96 @@
+package upstream
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// parentProxy accepts one CONNECT request, answers it with `status` and then echoes what the client sends
+func parentProxy(t *testing.T, status int, requests chan<- *http.Request) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+
+		req, err := http.ReadRequest(r)
+
+		if err != nil {
+			return
+		}
+
+		requests <- req
+
+		_, _ = io.WriteString(conn, "HTTP/1.1 "+strconv.Itoa(status)+" "+http.StatusText(status)+"\r\n\r\n")
+
+		if status == http.StatusOK {
+			_, _ = io.Copy(conn, r)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestDialer_Dial(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+
+	d := &Dialer{Address: parentProxy(t, http.StatusOK, requests), User: "alice", Password: "secret", Timeout: time.Second * 5}
+
+	conn, err := d.Dial("example.com:443")
+
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+
+	defer conn.Close()
+
+	req := <-requests
+
+	if req.Method != http.MethodConnect || req.Host != "example.com:443" {
+		t.Errorf("request = %v %v, want CONNECT example.com:443", req.Method, req.Host)
+	}
+
+	if got := req.Header.Get("Proxy-Authorization"); got != "Basic YWxpY2U6c2VjcmV0" {
+		t.Errorf("Proxy-Authorization = %q, want %q", got, "Basic YWxpY2U6c2VjcmV0")
+	}
+
+	_, _ = conn.Write([]byte("ping"))
+
+	b := make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Errorf("read = %q, %v, want %q", b, err, "ping")
+	}
+}
+
+func TestDialer_Dial_Refused(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+
+	d := &Dialer{Address: parentProxy(t, http.StatusForbidden, requests), Timeout: time.Second * 5}
+
+	if _, err := d.Dial("example.com:443"); err == nil {
+		t.Fatal("Dial() error = nil, want an error")
+	}
+
+	if req := <-requests; req.Header.Get("Proxy-Authorization") != "" {
+		t.Errorf("Proxy-Authorization = %q, want none", req.Header.Get("Proxy-Authorization"))
+	}
+}
@@ -1,6 +1,6 @@
 # can specify as many rules as needed
 rules {
-  # can be: "block" or "allow" (default: "block")
+  # can be: "block", "allow", or "throttle" (default: "block")
   access = "block"
 
   # can be "host", "path", or "url" (default: "host")
@@ -11,10 +11,257 @@ rules {
 
   # when using `access = "block"` allow the site to be accessed if the correct password is provided (default: true)
   passwordBypass = true
+
+  # when using `access = "throttle"` limit the bandwidth of matching connections to this rate.
+  # all connections of a client matching the rule share the rate.
+  # units: "bit", "kbit", "mbit", "gbit" or "B", "kB", "MB", "GB" per second (example: "500kbit").  a number is in bytes
+  # per second
+  # throttleRate = "500kbit"
+
+  # tags used to select which `credentials` can bypass this rule (default: [])
+  tags = []
+
+  # override the global `bypass` duration and scope for this rule
+  # bypassDuration = "15m"
+  # bypassScope = "host"
+
+  # only apply the rule to these clients: IP addresses, CIDRs, "mac:<address>" (when `arp` is enabled), "name:<host name>" (when `leases` is enabled), or "user:<name>"
+  # (when `proxyAuth` is enabled) (default: [], all clients)
+  # clients = ["192.168.1.100/30", "mac:aa:bb:cc:dd:ee:ff", "user:alice"]
+
+  # a password for this rule that replaces the `BYPASS_PASSWORD` env var (other `credentials` still apply by their tags).
+  # set either the plain password or a bcrypt or argon2id hash of it (a hash can't be used with the "digest" bypass scheme)
+  # bypassPassword = "homework"
+  # bypassPasswordHash = "$2a$10$u.VvPb7coU2tC7wWO3uJNuQXHadcRVA0jnGfdj9eIT.tvjNaHsG3K"
+
+  # when `upstream` is enabled, connect allowed requests matching this rule "direct" or through the "upstream" proxy
+  # (default: "", the `upstream` host lists and route decide)
+  # route = "direct"
+
+  # when `intercept` is enabled, decrypt the CONNECT requests this rule allows so "path" and "url" rules apply to the
+  # HTTPS requests inside them (default: false)
+  # intercept = true
+}
+
+# can specify as many bypass credentials as needed (in addition to the `BYPASS_PASSWORD` env var)
+credentials {
+  # the name is recorded in the logs when the credential is used
+  name = "parent"
+
+  # bcrypt or argon2id hash of the password (create a bcrypt hash with: `echo 'changeme' | pc-proxy hash-password`)
+  hash = "$2a$10$u.VvPb7coU2tC7wWO3uJNuQXHadcRVA0jnGfdj9eIT.tvjNaHsG3K"
+
+  # or read the hash from a file
+  # hashFile = "/etc/pc-proxy/parent.hash"
+
+  # only allow this credential to bypass rules with one of these tags (default: [], all rules)
+  tags = []
+
+  # the longest bypass this credential can grant (default: "0s", no limit)
+  maxDuration = "0s"
+
+  # allow this credential to approve access requests on the admin page (default: false)
+  admin = false
+}
+
+# a credential can accept time-based one-time codes from an authenticator app instead of a password
+# (create a secret and the otpauth:// URI used to enroll it with: `pc-proxy totp-secret babysitter`)
+credentials {
+  name = "babysitter"
+
+  # base32 encoded TOTP secrets (a code from any of them is accepted, each code only once)
+  totpSecrets = ["JBSWY3DPEHPK3PXP"]
+
+  tags = []
+  maxDuration = "4h"
+}
+
+bypass {
+  # how long a client can access blocked sites after entering the bypass password (default: "20h")
+  duration = "20h"
+
+  # what a bypass unlocks (default: "rule")
+  #   "rule" - only the rule that blocked the request
+  #   "host" - all rules for the requested host
+  #   "all"  - all rules
+  # credentials with `tags` only unlock the rule.  rules with `tags` or their own `bypassPassword` are only unlocked
+  # for themselves (a "host" or "all" bypass made with another password doesn't unlock them)
+  scope = "rule"
+
+  # how the bypass password is requested (default: "basic")
+  #   "basic"  - the password is sent base64 encoded (readable by anyone on the network when using the http listener)
+  #   "digest" - the password is never sent (RFC 7616 digest auth).  hashed `credentials` can't be used with digest auth,
+  #              only the `BYPASS_PASSWORD` env var and credentials with `totpSecrets`
+  scheme = "basic"
+
+  # lock a client out after this many wrong passwords within `failureWindow` (default: 5, 0 disables lockouts).  lockouts
+  # apply to the client's device (MAC or IP address), whoever is logged in, and count failed proxy logins too
+  maxFailures = 5
+  failureWindow = "10m"
+
+  # length of the first lockout.  each following lockout is twice as long, up to `maxLockoutDuration` (default: "1m")
+  lockoutDuration = "1m"
+  maxLockoutDuration = "1h"
+}
+
+# access requests let a child ask for a blocked site to be unlocked (at `http://<proxy>/access/request`)
+# a parent approves or denies them at `http://<proxy>/admin` using an admin credential (or the `BYPASS_PASSWORD` env var)
+accessRequests {
+  # enable access requests (default: false)
+  enabled = false
+
+  # maximum number of pending requests per client (default: 5)
+  maxPending = 5
+}
+
+# require clients to log in to the proxy, so rules, client groups and bypasses can be keyed by user instead of IP address
+# (a bypass password is accepted in place of the user's password to unlock a blocked site.  those requests are identified
+# by the client's address, not the user.  a logged in user only gets the bypasses granted to the user)
+proxyAuth {
+  # enable proxy authentication (default: false)
+  enabled = false
+
+  # how the login is requested: "basic" or "digest" (default: "basic")
+  scheme = "basic"
+
+  # htpasswd file with bcrypt entries, used with the "basic" scheme (create one with: `htpasswd -cB /etc/pc-proxy/htpasswd alice`)
+  htpasswdFile = "/etc/pc-proxy/htpasswd"
+
+  # htdigest file, used with the "digest" scheme.  the realm must be "pc-proxy"
+  # MD5 entries can be created with: `htdigest -c /etc/pc-proxy/htdigest pc-proxy alice`
+  # SHA-256 entries can be created with: `echo "alice:pc-proxy:$(printf 'alice:pc-proxy:password' | sha256sum | cut -d' ' -f1)"`
+  htdigestFile = "/etc/pc-proxy/htdigest"
+}
+
+# identify clients by their MAC address (from the kernel's ARP table, and its IPv6 neighbour table from `ip -6 neigh`)
+# instead of their IP address, so rules, client groups and bypasses follow a device when its IP address changes.  only
+# clients on the same network as the proxy have a MAC address
+arp {
+  # enable MAC address identification (default: false)
+  enabled = false
+
+  # the ARP table of IPv4 clients, in the `/proc/net/arp` format (default: "/proc/net/arp")
+  file = "/proc/net/arp"
+
+  # how long the tables are cached before they are read again (default: "30s")
+  cacheTime = "30s"
+}
+
+# name clients using the DHCP server's lease file.  the name is added to the logs and can be used in rules and client
+# groups ("name:<host name>").  clients choose their own host name, so don't rely on names to block a determined user
+leases {
+  # enable client names (default: false)
+  enabled = false
+
+  # the lease file (default: "/var/lib/misc/dnsmasq.leases")
+  file = "/var/lib/misc/dnsmasq.leases"
+
+  # the lease file format: "dnsmasq", or "isc" for an ISC dhcpd `dhcpd.leases` file (default: "dnsmasq")
+  format = "dnsmasq"
 }
 
+# serve a proxy auto-config file at `/proxy.pac` and `/wpad.dat` so devices can be configured with "automatic proxy
+# configuration" (or found with WPAD by pointing the `wpad` DNS name at the proxy).  the file is generated from `listen`
+# and changes when the configuration is reloaded
+pac {
+  # enable the PAC file (default: false)
+  enabled = false
+
+  # also serve the file on this port (needed for WPAD, which expects port 80) (default: 0, only on the proxy's listener)
+  port = 0
+
+  # the proxy host name written in the file (default: "", the host of the first http listener, or the host the file was
+  # requested from when listening on every address)
+  proxyHost = ""
+
+  # requests to these hosts don't use the proxy: IPv4 CIDRs or shell expressions matched against the host name
+  # (default: [])
+  directHosts = ["localhost", "127.0.0.1", "*.lan", "192.168.0.0/16"]
+}
+
+# forward allowed requests through a parent proxy (a school filter or a work proxy).  requests are chained with CONNECT,
+# so only HTTPS (and other tunneled) requests are forwarded.  the password for `user` is read from the
+# `UPSTREAM_PASSWORD` env var
+upstream {
+  # enable the parent proxy (default: false)
+  enabled = false
+
+  # host:port of the parent proxy (required when enabled)
+  address = "proxy.school.example:3128"
+
+  # the user name sent with Basic authentication (default: "", no authentication)
+  user = ""
+
+  # the route of requests that don't match a host list or a rule with a `route`: "upstream" or "direct"
+  # (default: "upstream")
+  route = "upstream"
+
+  # regex patterns matched against the requested host, like host rules.  `directHosts` are connected directly and
+  # `upstreamHosts` through the parent proxy (`directHosts` are checked first) (default: [])
+  directHosts = ["\\.lan$"]
+  upstreamHosts = []
+}
+
+# decrypt HTTPS requests (CONNECT requests allowed by rules with `intercept = true`) so "path" and "url" rules apply to
+# them, like "allow youtube.com but block /shorts".  clients must trust the proxy's CA: download it from
+# `http://<proxy>/ca.crt` and install it as a trusted root.  keep the CA key private, it can impersonate any site.
+# blocked requests inside a decrypted connection get the block page: browsers can't be asked for the bypass password
+# there, so only a password already sent for the CONNECT request (or an approved access request) unlocks them
+intercept {
+  # enable interception (default: false)
+  enabled = false
+
+  # the CA certificate and key (PEM), generated when both files are missing.  when empty, the CA is saved as `ca.pem`
+  # and `ca-key.pem` in the `dataDir` (or a temporary CA is generated when there is no `dataDir`) (default: "")
+  caCert = ""
+  caKey = ""
+
+  # regex patterns matched against the requested host, like host rules.  these hosts are never decrypted (apps that
+  # pin their certificates stop working when intercepted) (default: [])
+  doNotIntercept = ["\\.apple\\.com$", "\\.icloud\\.com$"]
+
+  # show the block page (with a link to ask for access when `accessRequests` is enabled) for blocked requests, instead
+  # of a connection error for HTTPS and a bare 403 for plain HTTP.  only blocked HTTPS requests are decrypted, it doesn't
+  # need `enabled`.  requests that ask for a bypass password are not changed (default: false)
+  blockPage = false
+}
+
+# answer DNS queries (UDP and TCP) so devices that ignore the proxy are filtered by the same rules.  names blocked by
+# "host" rules (checked for the client sending the query, bypasses it was granted apply) are answered with NXDOMAIN or
+# the sinkhole address, every other query is forwarded to the upstream resolver.  queries from the proxy's own host are
+# never blocked (a loopback address or the address of a listener)
+dns {
+  # enable the DNS server (default: false)
+  enabled = false
+
+  # the port to listen on, on the hosts of the proxy `listeners` (default: 53)
+  port = 53
+
+  # host:port of the resolver queries are forwarded to (required when enabled)
+  upstream = "1.1.1.1:53"
+
+  # answer blocked names with this address (point it at a page explaining the block) (default: "", NXDOMAIN)
+  # (both answers are cached by clients for a minute)
+  sinkhole = ""
+}
+
+# record every bypass event (challenges, unlocks, failures, lockouts, expiries and access request decisions) in a JSON lines file
+audit {
+  # path of the audit file (default: "", no audit file is written)
+  file = ""
+
+  # rotate the file when it reaches this size in megabytes (default: 10, 0 never rotates)
+  maxSize = 10
+
+  # number of rotated files to keep (default: 5, 0 keeps all of them)
+  maxBackups = 5
+}
+
+# directory used to save state (like bypass grants) so it survives restarts (default: "", state is not saved)
+dataDir = ""
+
 tls {
-  # enable support for TLS (default: false)
+  # enable support for TLS on `listen.tlsPort` (default: false).  the certificate is also used by "tls" listeners
   enabled = false
   cert = ""
   key = ""
@@ -35,4 +282,66 @@ listen {
   host = "0.0.0.0"
   port = 80
   tlsPort = 443
+
+  # the addresses to accept proxy clients on, replacing `port` and `tlsPort` (`host` is still used by the other
+  # listeners).  can specify as many listeners as needed.  the address is "host:port", with IPv6 hosts in brackets.  "[::]:3128" accepts IPv4 and IPv6 clients
+  # (dual-stack), "0.0.0.0:3128" only accepts IPv4 clients.  the protocol is "http" or "tls" (HTTPS, using the
+  # certificate from the `tls` block).  when the config is reloaded, only the listeners that were added or removed are
+  # started or stopped (removed listeners finish their requests first)
+  # (default: none, listen on `port` and `tlsPort` (when tls is enabled))
+  listeners {
+    address = "[::]:3128"
+    protocol = "http"
+  }
+
+  listeners {
+    address = "127.0.0.1:8080"
+    protocol = "http"
+  }
+
+  # accept plain HTTP requests redirected to the proxy by iptables, for devices that ignore the proxy settings (linux only).
+  # requests are checked against the rules and forwarded to the address the client connected to.  proxy auth doesn't
+  # apply and clients can't be asked for the bypass password (they don't know they are using a proxy), blocked requests
+  # get the block page (with `intercept blockPage`) or a 403.  only IPv4 connections are supported
+  #   iptables -t nat -A PREROUTING -i br-lan -p tcp --dport 80 -j REDIRECT --to-ports 8080
+  # (default: 0, disabled)
+  transparentPort = 0
+
+  # accept HTTPS connections redirected to the proxy by iptables, for devices that ignore the proxy settings (linux only).
+  # the server name the client asks for is checked against the rules without decrypting the connection.  blocked
+  # connections are dropped (clients can't be asked for the bypass password).  only IPv4 connections are supported
+  #   iptables -t nat -A PREROUTING -i br-lan -p tcp --dport 443 -j REDIRECT --to-ports 8443
+  # (default: 0, disabled)
+  transparentTlsPort = 0
+
+  # the port to accept SOCKS5 clients on.  CONNECT requests are checked against the same rules as HTTP proxy clients (the
+  # host and port are the requested destination).  When proxyAuth is enabled, clients log in with a username and password
+  # from the htpasswd (or htdigest) file.  SOCKS clients can't be asked for a bypass password, but bypasses already
+  # granted to the client apply
+  # (default: 0, disabled)
+  socksPort = 0
+}
+
+rateLimit {
+  # maximum number of requests per second for each client (default: 0, unlimited)
+  requestsPerSecond = 0
+
+  # number of requests a client can make in a burst above `requestsPerSecond` (default: 0, one second worth of requests)
+  burst = 0
+
+  # maximum number of concurrent connections for each client (default: 0, unlimited)
+  maxConnections = 0
+}
+
+# can specify as many client groups as needed
+clientGroups {
+  name = "kids"
+
+  # IP addresses, CIDRs, "mac:<address>" (when `arp` is enabled), "name:<host name>" (when `leases` is enabled), or "user:<name>" (when `proxyAuth` is enabled) of the clients in the group
+  clients = ["192.168.1.100/30"]
+
+  # override the global `rateLimit` settings for clients in this group (default: 0, use the global setting)
+  requestsPerSecond = 10
+  burst = 20
+  maxConnections = 50
 }